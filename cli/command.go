@@ -26,10 +26,17 @@ type commandOptions struct {
 	updateForced  bool
 	extractPath   string
 	interactive   bool
+	keyForced     bool
+	publisherName string
+	publisherKey  string
+	plugin        pluginOptions
+	lintQuiet     bool
 }
 
 func parseCommand() commandOptions {
-	var cmd commandOptions
+	cmd := commandOptions{
+		plugin: pluginOptions{parameters: make(map[string]string)},
+	}
 	app := kingpin.New("gypsum", "gypsum cli")
 	app.Command("daemon", "start daemon gypsum").Default()
 	app.Command("run", "start run gypsum")
@@ -41,6 +48,44 @@ func parseCommand() commandOptions {
 	cmdUpdate.Arg("version", "new version to fetch").Default("stable").StringVar(&cmd.updateVersion)
 	cmdUpdate.Flag("mirror", "mirror to replace github.com for downloading").Short('m').StringVar(&cmd.githubMirror)
 	cmdUpdate.Flag("force", "forced update").Short('f').Default("false").BoolVar(&cmd.updateForced)
+	cmdKey := app.Command("key", "manage the key for signing plugins")
+	cmdKeyGenerate := cmdKey.Command("generate", "generate a new signing key")
+	cmdKeyGenerate.Flag("force", "overwrite existing key").Short('f').Default("false").BoolVar(&cmd.keyForced)
+	cmdKey.Command("show", "show public key of signing key")
+	cmdTrust := app.Command("trust", "manage trusted plugin publishers")
+	cmdTrustAdd := cmdTrust.Command("add", "trust a publisher")
+	cmdTrustAdd.Arg("name", "name of publisher").Required().StringVar(&cmd.publisherName)
+	cmdTrustAdd.Arg("public-key", "public key of publisher").Required().StringVar(&cmd.publisherKey)
+	cmdTrustRemove := cmdTrust.Command("remove", "distrust a publisher")
+	cmdTrustRemove.Arg("name", "name or public key of publisher").Required().StringVar(&cmd.publisherName)
+	cmdTrust.Command("list", "list trusted publishers")
+	cmdPlugin := app.Command("plugin", "manage plugins from repositories, gypsum must be running")
+	cmdPluginList := cmdPlugin.Command("list", "list installed plugins")
+	cmdPluginList.Flag("check-updates", "check latest versions in repositories").Short('u').Default("false").BoolVar(&cmd.plugin.checkUpdates)
+	cmdPluginSearch := cmdPlugin.Command("search", "search plugins in repositories")
+	cmdPluginSearch.Arg("keyword", "keyword in name or description").StringVar(&cmd.plugin.keyword)
+	cmdPluginInstall := cmdPlugin.Command("install", "install plugin from repositories")
+	cmdPluginInstall.Arg("name", "name of plugin").Required().StringVar(&cmd.plugin.name)
+	cmdPluginInstall.Flag("plugin-version", "version to install, the latest by default").Int64Var(&cmd.plugin.version)
+	cmdPluginInstall.Flag("group", "group to install plugin into").Short('g').Uint64Var(&cmd.plugin.groupID)
+	cmdPluginInstall.Flag("side-by-side", "install even if the plugin is installed").Default("false").BoolVar(&cmd.plugin.sideBySide)
+	cmdPluginInstall.Flag("param", "value of plugin parameter").Short('p').StringMapVar(&cmd.plugin.parameters)
+	cmdPluginInstall.Flag("dry-run", "only show what would be installed").Default("false").BoolVar(&cmd.plugin.dryRun)
+	cmdPluginUpgrade := cmdPlugin.Command("upgrade", "upgrade installed plugin from repositories")
+	cmdPluginUpgrade.Arg("name", "name of plugin").Required().StringVar(&cmd.plugin.name)
+	cmdPluginUpgrade.Flag("plugin-version", "version to upgrade to, the latest by default").Int64Var(&cmd.plugin.version)
+	cmdPluginUpgrade.Flag("target", "group id of installation to upgrade").Short('t').Uint64Var(&cmd.plugin.target)
+	cmdPluginUpgrade.Flag("allow-downgrade", "allow upgrading to a lower version").Default("false").BoolVar(&cmd.plugin.allowDowngrade)
+	cmdPluginUpgrade.Flag("param", "value of plugin parameter").Short('p').StringMapVar(&cmd.plugin.parameters)
+	cmdPluginUpgrade.Flag("dry-run", "only show changes").Default("false").BoolVar(&cmd.plugin.dryRun)
+	cmdPluginUninstall := cmdPlugin.Command("uninstall", "uninstall plugin and remove all its items")
+	cmdPluginUninstall.Arg("name", "name of plugin").Required().StringVar(&cmd.plugin.name)
+	cmdPluginUninstall.Flag("target", "group id of installation to uninstall").Short('t').Uint64Var(&cmd.plugin.target)
+	cmdPluginUninstall.Flag("delete-data", "also delete data stored by the plugin").Default("false").BoolVar(&cmd.plugin.deleteData)
+	cmdPluginIndex := cmdPlugin.Command("index", "generate index.json for a local repository directory")
+	cmdPluginIndex.Arg("dir", "directory of plugin files").Default(".").StringVar(&cmd.plugin.indexDir)
+	cmdLint := app.Command("lint", "check templates of all rules, triggers, jobs and snippets, gypsum must be running")
+	cmdLint.Flag("quiet", "hide infos, only show errors and warnings").Short('q').Default("false").BoolVar(&cmd.lintQuiet)
 	app.Version(fmt.Sprintf("gypsum %s, commit %s", version, commit))
 	app.VersionFlag.Short('V')
 	app.HelpFlag.Short('h')
@@ -74,6 +119,68 @@ func Entry(v, c string) {
 			fmt.Println("error when updating: ", err)
 			os.Exit(1)
 		}
+	case "key generate":
+		publicKey, err := gypsum.GenerateSigningKey(cmd.keyForced)
+		if err != nil {
+			fmt.Println("error when generating key: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("签名密钥已生成，请妥善保管私钥文件。将以下公钥分享给插件使用者：")
+		fmt.Println(publicKey)
+	case "key show":
+		publicKey, err := gypsum.SigningPublicKey()
+		if err != nil {
+			fmt.Println("error when reading key: ", err)
+			os.Exit(1)
+		}
+		fmt.Println(publicKey)
+	case "trust add":
+		if err := gypsum.TrustPublisher(cmd.publisherName, cmd.publisherKey); err != nil {
+			fmt.Println("error when adding publisher: ", err)
+			os.Exit(1)
+		}
+		fmt.Printf("已信任发布者 %s\n", cmd.publisherName)
+	case "trust remove":
+		removed, err := gypsum.DistrustPublisher(cmd.publisherName)
+		if err != nil {
+			fmt.Println("error when removing publisher: ", err)
+			os.Exit(1)
+		}
+		if removed == 0 {
+			fmt.Printf("未找到发布者 %s\n", cmd.publisherName)
+			os.Exit(1)
+		}
+		fmt.Printf("已移除 %d 个发布者\n", removed)
+	case "trust list":
+		publishers, err := gypsum.TrustedPublishers()
+		if err != nil {
+			fmt.Println("error when reading publishers: ", err)
+			os.Exit(1)
+		}
+		for _, p := range publishers {
+			fmt.Printf("%s %s\n", p.PublicKey, p.Name)
+		}
+	case "plugin index":
+		count, err := gypsum.BuildRepositoryIndex(cmd.plugin.indexDir)
+		if err != nil {
+			fmt.Println("error when generating index: ", err)
+			os.Exit(1)
+		}
+		fmt.Printf("已生成索引，共 %d 个插件\n", count)
+	case "plugin list", "plugin search", "plugin install", "plugin upgrade", "plugin uninstall":
+		if err := pluginCommand(cmd.action, cmd.plugin); err != nil {
+			fmt.Println("error: ", err)
+			os.Exit(1)
+		}
+	case "lint":
+		ok, err := lintCommand(cmd.lintQuiet)
+		if err != nil {
+			fmt.Println("error: ", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
 	default:
 		fmt.Println("unknown command " + cmd.action)
 		os.Exit(1)
@@ -13,6 +13,7 @@ import (
 	"github.com/BurntSushi/toml"
 
 	"github.com/yuudi/gypsum/gypsum"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 type zeroConfig struct {
@@ -31,7 +32,10 @@ type Config struct {
 }
 
 func (c *Config) Save() error {
-	tmpl, err := template.New("config").Parse(defaultConfig)
+	tmpl, err := template.New("config").Funcs(template.FuncMap{
+		// an empty list in policies of plugins is kept, it differs from a missing list
+		"isSet": func(list []string) bool { return list != nil },
+	}).Parse(defaultConfig)
 	if err != nil {
 		return err
 	}
@@ -72,11 +76,32 @@ func initialConfig(interactive bool) {
 			SuperUsers:    []string{},
 		},
 		Gypsum: gypsum.ConfigType{
-			Listen:         "http://0.0.0.0:9900",
-			Password:       "",
-			ExternalAssets: "",
-			ResourceShare:  "file",
-			HttpBackRef:    "",
+			Listen:           "http://0.0.0.0:9900",
+			Password:         "",
+			ExternalAssets:   "",
+			ResourceShare:    "file",
+			HttpBackRef:      "",
+			ResourceSign:     "permanent",
+			ResourceSignTTL:  3600,
+			ResourceStorage:  "local",
+			MaxResourceSize:  64,
+			MaxPluginSize:    256,
+			UntrustedPlugins: "allow",
+			Repositories:     []string{},
+			ExecutionTimeout: 60,
+			MaxConcurrency:   16,
+			Outbound: gypsum.OutboundPolicy{
+				MaxLength:     3000,
+				ChunkInterval: 1000,
+			},
+			Sandbox: sandbox.Config{
+				Policy: sandbox.Policy{
+					BaseDirs:        []string{"resources"},
+					AllowedHosts:    []string{},
+					Timeout:         10,
+					MaxResponseSize: 2048,
+				},
+			},
 		},
 	}
 	if interactive {
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"fmt"
+)
+
+// lintCommand prints problems of all items found by running gypsum, ok is false if there is any error
+func lintCommand(quiet bool) (ok bool, err error) {
+	conf, err := readConfig()
+	if err != nil {
+		return false, err
+	}
+	a, err := newAPIClient(conf)
+	if err != nil {
+		return false, err
+	}
+	var issues []struct {
+		ItemType string `json:"item_type"`
+		ItemID   uint64 `json:"item_id"`
+		Severity string `json:"severity"`
+		Line     int    `json:"line"`
+		Message  string `json:"message"`
+	}
+	if _, err := a.call("GET", "/lint", nil, &issues); err != nil {
+		return false, err
+	}
+	counts := make(map[string]int)
+	for _, issue := range issues {
+		counts[issue.Severity]++
+		if quiet && issue.Severity == "info" {
+			continue
+		}
+		position := fmt.Sprintf("%s %d", issue.ItemType, issue.ItemID)
+		if issue.Line != 0 {
+			position += fmt.Sprintf(":%d", issue.Line)
+		}
+		fmt.Printf("%s [%s] %s\n", position, issue.Severity, issue.Message)
+	}
+	fmt.Printf("共 %d 个错误，%d 个警告，%d 个提示\n", counts["error"], counts["warning"], counts["info"])
+	return counts["error"] == 0, nil
+}
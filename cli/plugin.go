@@ -0,0 +1,278 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiClient calls the api of running gypsum, so that plugins can be managed while gypsum is running
+type apiClient struct {
+	base   string
+	client *http.Client
+}
+
+func newAPIClient(conf *Config) (*apiClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{}
+	listen := conf.Gypsum.Listen
+	var base string
+	switch {
+	case strings.HasPrefix(listen, "unix://"):
+		socket := listen[len("unix:/"):]
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		base = "http://gypsum"
+	case strings.HasPrefix(listen, "https://"):
+		// the certificate is usually self signed
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		base = "https://" + localAddress(listen[len("https://"):])
+	default:
+		base = "http://" + localAddress(strings.TrimPrefix(listen, "http://"))
+	}
+	a := &apiClient{
+		base: base + "/api/v1",
+		client: &http.Client{
+			Jar:       jar,
+			Transport: transport,
+			Timeout:   10 * time.Minute,
+		},
+	}
+	var result map[string]interface{}
+	status, err := a.call("PUT", "/gypsum/login", map[string]string{"password": conf.Gypsum.Password}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to gypsum, is it running? %s", err)
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("cannot login: %v", result["message"])
+	}
+	return a, nil
+}
+
+// localAddress converts listening address to an address to connect
+func localAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (a *apiClient) call(method, path string, body interface{}, result interface{}) (int, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, a.base+path, &reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return resp.StatusCode, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+type pluginOptions struct {
+	name           string
+	keyword        string
+	version        int64
+	groupID        uint64
+	target         uint64
+	sideBySide     bool
+	allowDowngrade bool
+	dryRun         bool
+	checkUpdates   bool
+	deleteData     bool
+	parameters     map[string]string
+	indexDir       string
+}
+
+func pluginCommand(action string, opts pluginOptions) error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+	a, err := newAPIClient(conf)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "plugin list":
+		var plugins []struct {
+			GroupID       uint64 `json:"group_id"`
+			PluginName    string `json:"plugin_name"`
+			PluginVersion int64  `json:"plugin_version"`
+			DisplayName   string `json:"display_name"`
+			LatestVersion int64  `json:"latest_version"`
+		}
+		path := "/plugins"
+		if opts.checkUpdates {
+			path += "?check_updates=true"
+		}
+		if _, err := a.call("GET", path, nil, &plugins); err != nil {
+			return err
+		}
+		for _, p := range plugins {
+			line := fmt.Sprintf("[%d] %s %d（%s）", p.GroupID, p.PluginName, p.PluginVersion, p.DisplayName)
+			if p.LatestVersion > p.PluginVersion {
+				line += fmt.Sprintf("，可升级至 %d", p.LatestVersion)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	case "plugin search":
+		var result struct {
+			Plugins []struct {
+				Name             string `json:"name"`
+				Version          int64  `json:"version"`
+				DisplayName      string `json:"display_name"`
+				Description      string `json:"description"`
+				InstalledVersion int64  `json:"installed_version"`
+			} `json:"plugins"`
+			Failures map[string]string `json:"failures"`
+		}
+		if _, err := a.call("GET", "/plugins/search?q="+url.QueryEscape(opts.keyword), nil, &result); err != nil {
+			return err
+		}
+		for source, reason := range result.Failures {
+			fmt.Printf("仓库 %s 不可用：%s\n", source, reason)
+		}
+		for _, p := range result.Plugins {
+			line := fmt.Sprintf("%s %d（%s）", p.Name, p.Version, p.DisplayName)
+			if p.InstalledVersion != 0 {
+				line += fmt.Sprintf("，已安装 %d", p.InstalledVersion)
+			}
+			fmt.Println(line)
+			if p.Description != "" {
+				fmt.Println("    " + p.Description)
+			}
+		}
+		return nil
+	case "plugin install", "plugin upgrade":
+		parameters := make(map[string]interface{}, len(opts.parameters))
+		for k, v := range opts.parameters {
+			parameters[k] = v
+		}
+		body := map[string]interface{}{
+			"name":            opts.name,
+			"version":         opts.version,
+			"group_id":        opts.groupID,
+			"target":          opts.target,
+			"side_by_side":    opts.sideBySide,
+			"allow_downgrade": opts.allowDowngrade,
+			"dry_run":         opts.dryRun,
+			"parameters":      parameters,
+		}
+		path := "/plugins/install"
+		if action == "plugin upgrade" {
+			path = "/plugins/upgrade"
+		}
+		var result pluginResult
+		status, err := a.call("POST", path, body, &result)
+		if err != nil {
+			return err
+		}
+		result.print()
+		if status >= 300 {
+			return errors.New(result.Message)
+		}
+		return nil
+	case "plugin uninstall":
+		var result pluginResult
+		status, err := a.call("POST", "/plugins/uninstall", map[string]interface{}{
+			"name":        opts.name,
+			"target":      opts.target,
+			"delete_data": opts.deleteData,
+		}, &result)
+		if err != nil {
+			return err
+		}
+		result.print()
+		if status >= 300 {
+			return errors.New(result.Message)
+		}
+		return nil
+	}
+	return errors.New("unknown command " + action)
+}
+
+type pluginResult struct {
+	Code              int      `json:"code"`
+	Message           string   `json:"message"`
+	GroupID           uint64   `json:"group_id"`
+	InstalledVersion  int64    `json:"installed_version"`
+	PluginVersion     int64    `json:"plugin_version"`
+	Installations     []uint64 `json:"installations"`
+	MissingParameters []struct {
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		DisplayName string `json:"display_name"`
+		Description string `json:"description"`
+	} `json:"missing_parameters"`
+	Diff []struct {
+		Path   string `json:"path"`
+		Change string `json:"change"`
+	} `json:"diff"`
+	Signature struct {
+		Status    string `json:"status"`
+		Publisher string `json:"publisher"`
+	} `json:"signature"`
+}
+
+func (r *pluginResult) print() {
+	fmt.Println(r.Message)
+	if r.GroupID != 0 {
+		fmt.Printf("组号：%d\n", r.GroupID)
+	}
+	if r.InstalledVersion != 0 {
+		fmt.Printf("已安装版本：%d，仓库版本：%d\n", r.InstalledVersion, r.PluginVersion)
+	}
+	if r.Code == 4002 {
+		fmt.Println("插件已安装，使用 gypsum plugin upgrade 升级，或使用 --side-by-side 并列安装")
+	}
+	if len(r.Installations) != 0 {
+		fmt.Printf("插件有多个安装，使用 --target 指定组号：%v\n", r.Installations)
+	}
+	if r.Signature.Status != "" {
+		if r.Signature.Publisher != "" {
+			fmt.Printf("签名：%s（%s）\n", r.Signature.Status, r.Signature.Publisher)
+		} else {
+			fmt.Printf("签名：%s\n", r.Signature.Status)
+		}
+	}
+	for _, d := range r.Diff {
+		fmt.Printf("  %-8s %s\n", d.Change, d.Path)
+	}
+	if len(r.MissingParameters) != 0 {
+		fmt.Println("需要填写参数（--param 名称=值）：")
+		for _, p := range r.MissingParameters {
+			fmt.Printf("  %s（%s，%s）%s\n", p.Name, p.DisplayName, p.Type, p.Description)
+		}
+	}
+}
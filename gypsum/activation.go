@@ -0,0 +1,86 @@
+package gypsum
+
+import (
+	"encoding/json"
+
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// MarshalJSON shows `Disabled` as `active`, because gob does not save false values,
+// a stored `Active` field would turn off all groups created before it was introduced.
+func (g *Group) MarshalJSON() ([]byte, error) {
+	type group Group
+	return json.Marshal(struct {
+		*group
+		Active bool `json:"active"`
+	}{
+		group:  (*group)(g),
+		Active: !g.Disabled,
+	})
+}
+
+func (g *Group) UnmarshalJSON(b []byte) error {
+	type group Group
+	aux := struct {
+		*group
+		Active *bool `json:"active"`
+	}{
+		group: (*group)(g),
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if aux.Active != nil {
+		g.Disabled = !*aux.Active
+	}
+	return nil
+}
+
+// activeIn tells whether the group itself is turned on in the chat group, chatGroupID is 0 for private chats
+func (g *Group) activeIn(chatGroupID int64) bool {
+	if g.Disabled {
+		return false
+	}
+	if chatGroupID == 0 {
+		return true
+	}
+	for _, id := range g.DisabledGroupsID {
+		if id == chatGroupID {
+			return false
+		}
+	}
+	if len(g.EnabledGroupsID) == 0 {
+		return true
+	}
+	for _, id := range g.EnabledGroupsID {
+		if id == chatGroupID {
+			return true
+		}
+	}
+	return false
+}
+
+// groupActive tells whether items in the group should work in the chat group,
+// an item works only if all groups from its parent up to root group are turned on.
+func groupActive(groupID uint64, chatGroupID int64) bool {
+	for depth := 0; depth < 64; depth++ {
+		g, exists := groups[groupID]
+		if !exists {
+			return true
+		}
+		if !g.activeIn(chatGroupID) {
+			return false
+		}
+		if groupID == 0 {
+			return true
+		}
+		groupID = g.ParentGroup
+	}
+	return true
+}
+
+func groupActiveRule(parentID func() uint64) zero.Rule {
+	return func(event *zero.Event, _ zero.State) bool {
+		return groupActive(parentID(), event.GroupID)
+	}
+}
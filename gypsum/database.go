@@ -1,7 +1,7 @@
 package gypsum
 
 import (
-	"math/rand"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -33,22 +33,63 @@ func initDb() error {
 	coldSalt, err = db.Get([]byte("gypsum-$meta-coldsalt"), nil)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
-			rand.Read(coldSalt)
-			err = db.Put([]byte("gypsum-$meta-coldsalt"), coldSalt, nil)
-			if err != nil {
+			if err = rotateColdSalt(); err != nil {
 				log.Warnf("error when write database: %s", err)
 			}
 		} else {
 			return err
 		}
 	}
+	loginSalt, err = db.Get([]byte("gypsum-$meta-loginsalt"), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+		// login cookie was derived from coldSalt, start with it so that logged in sessions are kept
+		loginSalt = coldSalt
+		if err = db.Put([]byte("gypsum-$meta-loginsalt"), loginSalt, nil); err != nil {
+			log.Warnf("error when write database: %s", err)
+		}
+	}
 	luatag.SetDB(db)
 	template.SetDB(db)
+	go cleanExpiredValues()
 	return nil
 }
 
+// cleanExpiredValues deletes expired values in user databases, expired http cache and unused rendered images periodically
+func cleanExpiredValues() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		cleaned, err := template.CleanExpired([]byte("gypsum-userDB-"), []byte("gypsum-pluginDB-"))
+		if err != nil {
+			log.Errorf("error when cleaning expired values: %s", err)
+		}
+		if cleaned != 0 {
+			log.Infof("%d expired values are cleaned", cleaned)
+		}
+		cleaned, err = template.CleanHTTPCache()
+		if err != nil {
+			log.Errorf("error when cleaning http cache: %s", err)
+		}
+		if cleaned != 0 {
+			log.Infof("%d expired http responses are cleaned", cleaned)
+		}
+		cleaned, err = cleanTextImages()
+		if err != nil {
+			log.Errorf("error when cleaning rendered images: %s", err)
+		}
+		if cleaned != 0 {
+			log.Infof("%d unused rendered images are cleaned", cleaned)
+		}
+	}
+}
+
 func loadData() error {
 	loadGroups()
+	// snippets are needed when compiling templates
+	loadSnippets()
 	loadRules()
 	loadTriggers()
 	loadJobs()
@@ -72,18 +72,20 @@ func (t *testCase) TestMessage() (string, bool, error) {
 	if !matched {
 		return "", false, nil
 	}
-	tmpl, err := pongo2.FromString(t.Response)
+	tmpl, err := templateSet.FromString(t.Response)
 	if err != nil {
 		return "", true, errors.New("模板预处理出错：" + err.Error())
 	}
 	var receiver responseReceiver
-	handler := templateRuleHandler(*tmpl, receiver.ReceiveSend, receiver.ReceiveLogger)
-	handler(nil, event, state)
+	handler := templateRuleHandler(*tmpl, DebugItem, 0, nil, nil, receiver.ReceiveSend, receiver.ReceiveLogger)
+	if handler(nil, event, state) == PassResponse {
+		receiver.ReceiveLogger("规则放弃处理（pass），不会回复，优先级更低的规则会继续匹配")
+	}
 	return receiver.String(), true, nil
 }
 
 func (t *testCase) TestNotice() (string, error) {
-	tmpl, err := pongo2.FromString(t.Response)
+	tmpl, err := templateSet.FromString(t.Response)
 	if err != nil {
 		return "", errors.New("模板预处理出错：" + err.Error())
 	}
@@ -91,28 +93,38 @@ func (t *testCase) TestNotice() (string, error) {
 	var state zero.State
 	event.RawEvent = t.Event
 	var receiver responseReceiver
-	handler := templateTriggerHandler(*tmpl, receiver.ReceiveSend, receiver.ReceiveLogger)
-	handler(nil, event, state)
+	handler := templateTriggerHandler(*tmpl, DebugItem, 0, nil, nil, receiver.ReceiveSend, receiver.ReceiveLogger)
+	if handler(nil, event, state) == PassResponse {
+		receiver.ReceiveLogger("触发器放弃处理（pass），不会回复，优先级更低的触发器会继续匹配")
+	}
 	return receiver.String(), nil
 }
 
 func (t *testCase) TestTemplate() (string, error) {
-	tmpl, err := pongo2.FromString(t.Response)
+	tmpl, err := templateSet.FromString(t.Response)
 	if err != nil {
 		return "", errors.New("模板预处理出错：" + err.Error())
 	}
+	execCtx, finish, ok := startExecution(DebugItem, 0)
+	if !ok {
+		return "", errors.New("等待执行超时或被取消")
+	}
+	defer finish()
 	var luaState *lua.LState
 	defer func() {
 		if luaState != nil {
 			luaState.Close()
 		}
 	}()
-	msg, err := tmpl.Execute(pongo2.Context{
+	msg, err := tmpl.Execute(bindExecution(pongo2.Context{
 		"_lua": luaState,
-	})
+	}, execCtx))
 	if err != nil {
 		return "", errors.New("渲染模板出错：" + err.Error())
 	}
+	if execCtx.Err() != nil {
+		return "", errors.New("执行超时或被取消")
+	}
 	msg = strings.TrimSpace(msg)
 	return msg, nil
 }
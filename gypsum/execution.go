@@ -0,0 +1,146 @@
+package gypsum
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// DebugItem is the item type of executions started by debugger
+const DebugItem ItemType = "debug"
+
+// Execution is a running or queued template execution
+type Execution struct {
+	ItemType  ItemType `json:"item_type"`
+	ItemID    uint64   `json:"item_id"`
+	Running   bool     `json:"running"`
+	QueueTime int64    `json:"queue_time"`
+	StartTime int64    `json:"start_time,omitempty"`
+	cancel    context.CancelFunc
+}
+
+var (
+	executionsLock  sync.Mutex
+	executions      = make(map[uint64]*Execution)
+	executionCursor uint64
+	executionSlots  chan struct{}
+)
+
+func initExecutions() {
+	executionSlots = make(chan struct{}, Config.MaxConcurrency)
+}
+
+// startExecution waits for a free slot and returns a context that is cancelled at deadline,
+// finish must be called after execution, it can be called more than once. ok is false if it has waited too long or is cancelled in queue.
+func startExecution(itemType ItemType, itemID uint64) (ctx context.Context, finish func(), ok bool) {
+	timeout := time.Duration(Config.ExecutionTimeout) * time.Second
+	// one cancel function for both waiting and running, so that cancelling is never lost between them
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	queueCtx, cancelQueue := context.WithTimeout(runCtx, timeout)
+	defer cancelQueue()
+	e := &Execution{
+		ItemType:  itemType,
+		ItemID:    itemID,
+		QueueTime: time.Now().Unix(),
+		cancel:    cancelRun,
+	}
+	executionsLock.Lock()
+	executionCursor++
+	id := executionCursor
+	executions[id] = e
+	executionsLock.Unlock()
+	remove := func() {
+		executionsLock.Lock()
+		delete(executions, id)
+		executionsLock.Unlock()
+	}
+
+	select {
+	case executionSlots <- struct{}{}:
+	case <-queueCtx.Done():
+		cancelRun()
+		remove()
+		if queueCtx.Err() == context.Canceled {
+			log.Warnf("%s %d is cancelled before execution", itemType, itemID)
+		} else {
+			log.Warnf("%s %d is not executed: waited too long for other executions", itemType, itemID)
+		}
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(runCtx, timeout)
+	executionsLock.Lock()
+	e.Running = true
+	e.StartTime = time.Now().Unix()
+	executionsLock.Unlock()
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			cancelRun()
+			remove()
+			<-executionSlots
+		})
+	}, true
+}
+
+// bindExecution puts functions that should stop at the end of execution into context,
+// it is called after event and namespace are set, so scoped variables are bound here as well
+func bindExecution(ctx pongo2.Context, execCtx context.Context) pongo2.Context {
+	setScopedVars(ctx)
+	box := defaultSandbox
+	if b, ok := ctx["_sandbox"].(*sandbox.Sandbox); ok {
+		box = b
+	}
+	ctx["_ctx"] = execCtx
+	ctx["sleep"] = template.Sleep(execCtx)
+	ctx["file_get_contents"] = template.FileGetContents(execCtx, box)
+	ctx["random_file"] = template.RandomFile(box)
+	ctx["http"] = template.HTTPRequest(execCtx, box)
+	return ctx
+}
+
+func getExecutions(c *gin.Context) {
+	executionsLock.Lock()
+	defer executionsLock.Unlock()
+	c.JSON(200, executions)
+}
+
+func cancelExecution(c *gin.Context) {
+	executionIDStr := c.Param("eid")
+	executionID, err := strconv.ParseUint(executionIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such execution",
+		})
+		return
+	}
+	executionsLock.Lock()
+	e, ok := executions[executionID]
+	var cancel context.CancelFunc
+	if ok {
+		cancel = e.cancel
+	}
+	executionsLock.Unlock()
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such execution",
+		})
+		return
+	}
+	cancel()
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
@@ -3,7 +3,7 @@ package gypsum
 import (
 	"archive/zip"
 	"bytes"
-	"crypto/sha256"
+	"crypto/ed25519"
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
@@ -11,7 +11,6 @@ import (
 	"io"
 	"net/url"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 
@@ -26,6 +25,9 @@ type Item struct {
 	ItemType    ItemType `json:"item_type"`
 	DisplayName string   `json:"display_name"`
 	ItemID      uint64   `json:"item_id"`
+	Customized  bool     `json:"customized,omitempty"` // customized items are kept when plugin upgrades
+	// InstalledSum is the digest of content installed by plugin, upgrades only replace items changed by plugin since then
+	InstalledSum string `json:"-"`
 }
 
 type Group struct {
@@ -34,6 +36,13 @@ type Group struct {
 	PluginVersion int64  `json:"plugin_version"`
 	Items         []Item `json:"items"`
 	ParentGroup   uint64 `json:"-"`
+	// Parameters are declared by plugin, values are only readable through parameters api
+	Parameters      []Parameter       `json:"parameters,omitempty"`
+	ParameterValues map[string]string `json:"-"`
+	// Disabled turns off all items in the group and its sub groups, shown as `active` in json
+	Disabled         bool    `json:"-"`
+	EnabledGroupsID  []int64 `json:"enabled_groups_id,omitempty"`  // if not empty, the group only works in these chat groups
+	DisabledGroupsID []int64 `json:"disabled_groups_id,omitempty"` // the group does not work in these chat groups
 }
 
 type ArchiveItem struct {
@@ -83,27 +92,35 @@ func (g *GroupArchive) ToBytes() ([]byte, error) {
 }
 
 func (g Group) ExportToArchive(name string, version int64) *GroupArchive {
-	archiveItems := make([]ArchiveItem, len(g.Items))
-	for i, item := range g.Items {
+	archiveItems := make([]ArchiveItem, 0, len(g.Items))
+	for _, item := range g.Items {
+		var itBytes []byte
+		var err error
 		if item.ItemType == GroupItem {
-			log.Warnf("group in group are not supported yet, exporting would ignore group %d", item.ItemID)
-			continue
-		}
-		it, ok := findItem(item.ItemType, item.ItemID)
-		if !ok {
-			log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
-			continue
+			subGroup, ok := groups[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			// sub groups are archived recursively, keeping their own plugin information
+			itBytes, err = subGroup.ExportToArchive(subGroup.PluginName, subGroup.PluginVersion).ToBytes()
+		} else {
+			it, ok := findItem(item.ItemType, item.ItemID)
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			itBytes, err = it.ToBytes()
 		}
-		itBytes, err := it.ToBytes()
 		if err != nil {
 			log.Error(err)
 			continue
 		}
-		archiveItems[i] = ArchiveItem{
+		archiveItems = append(archiveItems, ArchiveItem{
 			ItemType:    item.ItemType,
 			DisplayName: item.DisplayName,
 			ItemBytes:   itBytes,
-		}
+		})
 	}
 	return &GroupArchive{
 		DisplayName:   g.DisplayName,
@@ -115,6 +132,15 @@ func (g Group) ExportToArchive(name string, version int64) *GroupArchive {
 	}
 }
 
+func GroupArchiveFromBytes(b []byte) (*GroupArchive, error) {
+	ga := &GroupArchive{}
+	buffer := bytes.Buffer{}
+	buffer.Write(b)
+	decoder := gob.NewDecoder(&buffer)
+	err := decoder.Decode(ga)
+	return ga, err
+}
+
 func GroupFromArchiveReader(reader io.Reader, newGroupID uint64) (*Group, error) {
 	ga := &GroupArchive{
 		DisplayName:   "",
@@ -128,27 +154,20 @@ func GroupFromArchiveReader(reader io.Reader, newGroupID uint64) (*Group, error)
 	if err := decoder.Decode(ga); err != nil {
 		return nil, err
 	}
-	g := &Group{
-		DisplayName:   ga.DisplayName,
-		PluginName:    ga.PluginName,
-		PluginVersion: ga.PluginVersion,
-		Items:         nil,
-		ParentGroup:   0,
-	}
-	g.Items = make([]Item, len(ga.ArchiveItems))
-	for i, item := range ga.ArchiveItems {
-		idx, err := RestoreFromUserRecord(item.ItemType, item.ItemBytes, newGroupID)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		g.Items[i] = Item{
-			ItemType:    item.ItemType,
-			DisplayName: item.DisplayName,
-			ItemID:      idx,
+	mg := ga.toManifestGroup()
+	return mg.restore(newGroupID), nil
+}
+
+// walkItems calls fn for every item in the group and its sub groups
+func (g *Group) walkItems(fn func(item Item)) {
+	for _, item := range g.Items {
+		fn(item)
+		if item.ItemType == GroupItem {
+			if subGroup, ok := groups[item.ItemID]; ok {
+				subGroup.walkItems(fn)
+			}
 		}
 	}
-	return g, nil
 }
 
 func loadGroups() {
@@ -205,6 +224,8 @@ func findItem(itemType ItemType, itemID uint64) (item UserRecord, ok bool) {
 		item, ok = jobs[itemID]
 	case ResourceItem:
 		item, ok = resources[itemID]
+	case SnippetItem:
+		item, ok = snippets[itemID]
 	case GroupItem:
 		item, ok = groups[itemID]
 	default:
@@ -260,6 +281,46 @@ func ChangeNameForParent(parentID, selfID uint64, newName string) error {
 	return errors.New(fmt.Sprintf("item %d not found in parent: %d", selfID, parentID))
 }
 
+// markCustomized marks the item customized if it belongs to a plugin,
+// so that changes made through api are kept when the plugin upgrades
+func markCustomized(parentID, selfID uint64) error {
+	if !inPlugin(parentID) {
+		return nil
+	}
+	parentGroup, ok := groups[parentID]
+	if !ok {
+		return errors.New(fmt.Sprintf("parent not found: %d", parentID))
+	}
+	for index := range parentGroup.Items {
+		if parentGroup.Items[index].ItemID == selfID {
+			if parentGroup.Items[index].Customized {
+				return nil
+			}
+			parentGroup.Items[index].Customized = true
+			return parentGroup.SaveToDB(parentID)
+		}
+	}
+	return errors.New(fmt.Sprintf("item %d not found in parent: %d", selfID, parentID))
+}
+
+// inPlugin tells whether the group or any of its parents is installed from plugin
+func inPlugin(groupID uint64) bool {
+	for depth := 0; depth < 64; depth++ {
+		g, ok := groups[groupID]
+		if !ok {
+			return false
+		}
+		if g.PluginName != "" {
+			return true
+		}
+		if groupID == 0 {
+			return false
+		}
+		groupID = g.ParentGroup
+	}
+	return false
+}
+
 func getGroups(c *gin.Context) {
 	c.JSON(200, groups)
 }
@@ -286,7 +347,7 @@ func getGroupByID(c *gin.Context) {
 }
 
 func createGroup(c *gin.Context) {
-	if c.ContentType() == "application/zip" {
+	if c.ContentType() == "application/zip" || c.ContentType() == "multipart/form-data" {
 		importGroup(c)
 		return
 	}
@@ -298,6 +359,13 @@ func createGroup(c *gin.Context) {
 		})
 		return
 	}
+	if err := checkParameters(group.Parameters); err != nil {
+		c.JSON(422, gin.H{
+			"code":    4020,
+			"message": err.Error(),
+		})
+		return
+	}
 	parentStr := c.Param("gid")
 	var parentID uint64
 	if len(parentStr) == 0 {
@@ -312,13 +380,6 @@ func createGroup(c *gin.Context) {
 			})
 			return
 		}
-		if parentID != 0 {
-			c.JSON(400, gin.H{
-				"code":    1400,
-				"message": "group in group are not supported yet",
-			})
-			return
-		}
 	}
 	parentGroup, ok := groups[parentID]
 	if !ok {
@@ -444,6 +505,69 @@ func addGroupItem(c *gin.Context) {
 	})
 }
 
+type groupItemPatch struct {
+	Customized bool `json:"customized"`
+}
+
+func patchGroupItem(c *gin.Context) {
+	groupIDStr := c.Param("gid")
+	groupID, err := strconv.ParseUint(groupIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	itemIDStr := c.Param("iid")
+	itemID, err := strconv.ParseUint(itemIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item",
+		})
+		return
+	}
+	group, ok := groups[groupID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1001,
+			"message": "no such group",
+		})
+		return
+	}
+	patch := groupItemPatch{}
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	iType := ItemType(c.Param("type"))
+	for index := range group.Items {
+		if group.Items[index].ItemType == iType && group.Items[index].ItemID == itemID {
+			group.Items[index].Customized = patch.Customized
+			if err := group.SaveToDB(groupID); err != nil {
+				c.JSON(500, gin.H{
+					"code":    3000,
+					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+				})
+				return
+			}
+			c.JSON(200, gin.H{
+				"code":    0,
+				"message": "ok",
+			})
+			return
+		}
+	}
+	c.JSON(404, gin.H{
+		"code":    1002,
+		"message": "item not found",
+	})
+}
+
 func exportGroup(c *gin.Context) {
 	pluginName := c.Query("plugin_name")
 	pluginVersionStr := c.Query("plugin_version")
@@ -466,162 +590,110 @@ func exportGroup(c *gin.Context) {
 		c.String(404, "404: group not found")
 		return
 	}
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
-	f, err := zipWriter.Create("gypsum-plugin.dat")
-	if err != nil {
-		log.Error(err)
-		c.String(500, fmt.Sprintf("500 Internal Server Error\nerror when create plugin zipfile: %s", err))
-		return
-	}
-	groupData, err := group.ExportToArchive(pluginName, pluginVersion).ToBytes()
-	if err != nil {
-		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "gob" {
+		c.String(400, "400 Bad Request\nformat must be json or gob")
 		return
 	}
-	_, err = f.Write(groupData)
-	if err != nil {
-		log.Error(err)
-		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-		return
-	}
-	for _, item := range group.Items {
-		if item.ItemType == ResourceItem {
-			// attach all resources
-			res := resources[item.ItemID]
-			fileData, err := os.ReadFile(path.Join(resDir, res.Sha256Sum+res.Ext))
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-				return
-			}
-			f, err := zipWriter.Create(res.Sha256Sum + res.Ext)
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-				return
-			}
-			_, err = f.Write(fileData)
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+	var privateKey ed25519.PrivateKey
+	if c.Query("sign") == "true" {
+		if privateKey, err = loadSigningKey(); err != nil {
+			if err == errNoSigningKey {
+				c.String(412, fmt.Sprintf("412 Precondition Failed\n%s", err))
 				return
 			}
+			log.Error(err)
+			c.String(500, fmt.Sprintf("500 Internal Server Error\nerror when signing plugin: %s", err))
+			return
 		}
 	}
-	err = zipWriter.Close()
-	if err != nil {
-		log.Error(err)
-		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-		return
-	}
+	// the archive is streamed to the client, so the status cannot be changed once it is started.
+	// if anything fails, the archive is left without its central directory, so it cannot be imported.
 	c.Header("Content-Description", "File Transfer")
 	c.Header("Content-Transfer-Encoding", "binary")
 	c.Header("Content-Disposition", "attachment; filename="+helper.ReplaceFilename(pluginName, "_")+".gypsum; filename*=utf-8''"+url.QueryEscape(pluginName)+".gypsum")
 	c.Header("Content-Type", "application/octet-stream")
-	_, err = c.Writer.Write(buf.Bytes())
+	c.Status(200)
+	zipWriter := zip.NewWriter(c.Writer)
+	archive := newHashingArchiveWriter(zipWriter)
+	if format == "json" {
+		err = writeManifestArchive(archive, group, pluginName, pluginVersion, c.Query("description"))
+	} else {
+		// legacy format, for gypsum before manifest was introduced
+		err = writeLegacyArchive(archive, group, pluginName, pluginVersion)
+	}
 	if err != nil {
-		log.Error(err)
-		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+		log.Errorf("error when create plugin zipfile: %s", err)
 		return
 	}
+	attached := make(map[string]bool)
+	var attachErr error
+	group.walkItems(func(item Item) {
+		if attachErr != nil || item.ItemType != ResourceItem {
+			return
+		}
+		// attach all resources, including those in sub groups
+		res, ok := resources[item.ItemID]
+		if !ok || attached[res.Sha256Sum+res.Ext] {
+			return
+		}
+		attached[res.Sha256Sum+res.Ext] = true
+		attachErr = attachResource(archive, res)
+	})
+	if attachErr != nil {
+		log.Errorf("error when attach resources to plugin zipfile: %s", attachErr)
+		return
+	}
+	if c.Query("include_data") == "true" {
+		if err = writePluginData(archive, groupID); err != nil {
+			log.Errorf("error when export plugin data: %s", err)
+			return
+		}
+	}
+	if privateKey != nil {
+		if err = signArchive(archive, privateKey); err != nil {
+			log.Errorf("error when signing plugin: %s", err)
+			return
+		}
+	}
+	if err = zipWriter.Close(); err != nil {
+		log.Errorf("error when finish plugin zipfile: %s", err)
+	}
 }
 
-func importGroup(c *gin.Context) {
-	if c.ContentType() != "application/zip" {
-		c.JSON(415, gin.H{
-			"code":    5000,
-			"message": fmt.Sprintf("request type do not meet application/zip: %s", c.ContentType()),
-		})
+func writeLegacyArchive(zipWriter archiveWriter, g *Group, name string, version int64) error {
+	f, err := zipWriter.Create(legacyManifestFileName)
+	if err != nil {
+		return err
 	}
-	bodyReader := c.Request.Body
-	body, err := io.ReadAll(bodyReader)
+	groupData, err := g.ExportToArchive(name, version).ToBytes()
 	if err != nil {
-		c.JSON(500, gin.H{
-			"code":    6000,
-			"message": fmt.Sprintf("error when reading request body: %s", err),
-		})
-		return
+		return err
 	}
-	zipReader, err := zip.NewReader(bytes.NewReader(body), c.Request.ContentLength)
+	_, err = f.Write(groupData)
+	return err
+}
+
+// attachResource copies the resource file into the archive
+func attachResource(zipWriter archiveWriter, res *Resource) error {
+	fileReader, err := resStorage.Get(res.Sha256Sum + res.Ext)
 	if err != nil {
-		c.JSON(400, gin.H{
-			"code":    5000,
-			"message": fmt.Sprintf("cannot read body as zipfile: %s", err),
-		})
+		return err
 	}
-	var newGroup *Group
-	itemCursor++
-	cursor := itemCursor
-	for _, file := range zipReader.File {
-		if file.Name == "gypsum-plugin.dat" {
-			fr, err := file.Open()
-			if err != nil {
-				log.Error(err)
-				c.JSON(500, gin.H{
-					"code":    3000,
-					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-				})
-				return
-			}
-			newGroup, err = GroupFromArchiveReader(fr, cursor)
-			if err != nil {
-				log.Error(err)
-				c.JSON(500, gin.H{
-					"code":    3000,
-					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-				})
-				return
-			}
-			continue
-		}
-		nameSplit := strings.Split(file.Name, ".")
-		if len(nameSplit[0]) == 64 {
-			_, exists := resourceIDByHash(nameSplit[0])
-			if exists {
-				continue
-			}
-			fr, err := file.Open()
-			if err != nil {
-				log.Error(err)
-				c.JSON(500, gin.H{
-					"code":    3000,
-					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-				})
-				return
-			}
-			body, err := io.ReadAll(fr)
-			if err != nil {
-				log.Error(err)
-				c.JSON(500, gin.H{
-					"code":    3000,
-					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-				})
-				return
-			}
-			hashBytes := sha256.Sum256(body)
-			hashHex := hex.EncodeToString(hashBytes[:])
-			if !strings.EqualFold(nameSplit[0], hashHex) {
-				c.JSON(400, gin.H{
-					"code":    3000,
-					"message": fmt.Sprintf("zipfile sha256sum dose not match fine name: %s", file.Name),
-				})
-				return
-			}
-			if err := os.WriteFile(path.Join(resDir, file.Name), body, 0444); err != nil {
-				c.JSON(500, gin.H{
-					"code":    6000,
-					"message": fmt.Sprintf("error when writing file: %s", err),
-				})
-				return
-			}
-		}
+	defer fileReader.Close()
+	f, err := zipWriter.Create(res.Sha256Sum + res.Ext)
+	if err != nil {
+		return err
 	}
-	if newGroup == nil {
-		// no meta file in zip file
-		c.JSON(412, gin.H{
-			"code":    4000,
-			"message": fmt.Sprintf("zipfile has no gypsum metadata"),
+	_, err = io.Copy(f, fileReader)
+	return err
+}
+
+func importGroup(c *gin.Context) {
+	if c.ContentType() != "application/zip" && c.ContentType() != "multipart/form-data" {
+		c.JSON(415, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("request type do not meet application/zip: %s", c.ContentType()),
 		})
 		return
 	}
@@ -639,22 +711,280 @@ func importGroup(c *gin.Context) {
 			})
 			return
 		}
-		if parentID != 0 {
-			c.JSON(400, gin.H{
-				"code":    1400,
-				"message": "group in group are not supported yet",
+	}
+	if _, ok := groups[parentID]; !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "group not found",
+		})
+		return
+	}
+	opts := importOptions{
+		Mode:           c.DefaultQuery("mode", "auto"),
+		AllowDowngrade: c.Query("allow_downgrade") == "true",
+		DryRun:         c.Query("dry_run") == "true",
+	}
+	if targetStr := c.Query("target"); targetStr != "" {
+		targetID, err := strconv.ParseUint(targetStr, 10, 64)
+		if err != nil || targetID == 0 {
+			c.JSON(404, gin.H{
+				"code":    1000,
+				"message": "target is not an installation of this plugin",
 			})
 			return
 		}
+		opts.Target = targetID
 	}
+	archiveFile, archiveSize, parameterValues, status, result := receivePluginRequest(c)
+	if result != nil {
+		c.JSON(status, result)
+		return
+	}
+	defer discardTempFile(archiveFile)
+	opts.Values = parameterValues
+	c.JSON(importPlugin(parentID, archiveFile, archiveSize, opts))
+}
+
+// importOptions controls how a plugin is imported, see importPlugin
+type importOptions struct {
+	Mode           string // auto, install or upgrade
+	Target         uint64 // installation to upgrade, 0 means the earliest one
+	AllowDowngrade bool
+	DryRun         bool
+	Values         map[string]interface{} // values of plugin parameters
+}
+
+// importPlugin installs or upgrades plugin from zipfile, and returns the response for api
+func importPlugin(parentID uint64, archive io.ReaderAt, size int64, opts importOptions) (int, gin.H) {
 	parentGroup, ok := groups[parentID]
 	if !ok {
-		c.JSON(404, gin.H{
+		return 404, gin.H{
 			"code":    1000,
 			"message": "group not found",
-		})
-		return
+		}
+	}
+	zipReader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return 400, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("cannot read body as zipfile: %s", err),
+		}
+	}
+	files := make(map[string]*zip.File, len(zipReader.File))
+	for _, file := range zipReader.File {
+		if _, ok := files[file.Name]; ok {
+			return 400, gin.H{
+				"code":    5000,
+				"message": fmt.Sprintf("duplicated file in zipfile: %s", file.Name),
+			}
+		}
+		files[file.Name] = file
+	}
+	signature, err := verifyArchive(zipReader)
+	if err != nil {
+		log.Error(err)
+		return 500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		}
+	}
+	if signature.Status == SignatureInvalid {
+		return 400, gin.H{
+			"code":      4010,
+			"message":   "plugin signature is invalid, the file may have been tampered with",
+			"signature": signature,
+		}
+	}
+	if signature.Status != SignatureTrusted && Config.UntrustedPlugins == "refuse" {
+		return 403, gin.H{
+			"code":      4011,
+			"message":   fmt.Sprintf("plugin is %s, only plugins signed by trusted publishers are accepted", signature.Status),
+			"signature": signature,
+		}
+	}
+	manifest, err := readManifest(files)
+	if err != nil {
+		if err == errNoManifest {
+			return 412, gin.H{
+				"code":    4000,
+				"message": err.Error(),
+			}
+		}
+		if errors.Is(err, errUnsupportedSchema) {
+			return 422, gin.H{
+				"code":    4001,
+				"message": err.Error(),
+			}
+		}
+		return 400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		}
+	}
+	if err := manifest.fillParameterValues(opts.Values); err != nil {
+		return 422, gin.H{
+			"code":    4020,
+			"message": err.Error(),
+		}
+	}
+	dryRun := opts.DryRun
+	installedID, installed := findPluginGroup(manifest.PluginName)
+	if targetID := opts.Target; targetID != 0 {
+		// choose one of side-by-side installations
+		if target, ok := groups[targetID]; !ok || target.PluginName != manifest.PluginName {
+			return 404, gin.H{
+				"code":    1000,
+				"message": "target is not an installation of this plugin",
+			}
+		}
+		installedID, installed = targetID, true
+	}
+	switch opts.Mode {
+	case "auto":
+		if installed {
+			// let user decide whether to upgrade or install side by side
+			diffs := make([]ItemDiff, 0)
+			if err := manifest.upgradeGroup(installedID, "", nil, &diffs); err != nil {
+				log.Error(err)
+			}
+			diffs = append(diffs, manifest.snippetConflicts(installedID)...)
+			return 409, gin.H{
+				"code":               4002,
+				"message":            "plugin already installed",
+				"group_id":           installedID,
+				"installed_version":  groups[installedID].PluginVersion,
+				"plugin_version":     manifest.PluginVersion,
+				"diff":               diffs,
+				"missing_parameters": manifest.missingParameters(groups[installedID].parameterValueNames()),
+				"signature":          signature,
+			}
+		}
+	case "install":
+	case "upgrade":
+		if !installed {
+			return 404, gin.H{
+				"code":    1000,
+				"message": "plugin not installed",
+			}
+		}
+		installedVersion := groups[installedID].PluginVersion
+		if manifest.PluginVersion < installedVersion && !opts.AllowDowngrade {
+			return 409, gin.H{
+				"code":              4003,
+				"message":           fmt.Sprintf("installed version %d is newer than %d", installedVersion, manifest.PluginVersion),
+				"group_id":          installedID,
+				"installed_version": installedVersion,
+				"plugin_version":    manifest.PluginVersion,
+			}
+		}
+		diffs := make([]ItemDiff, 0)
+		missing := manifest.missingParameters(groups[installedID].parameterValueNames())
+		if dryRun {
+			if err := manifest.upgradeGroup(installedID, "", nil, &diffs); err != nil {
+				log.Error(err)
+			}
+			diffs = append(diffs, manifest.snippetConflicts(installedID)...)
+			return 200, gin.H{
+				"code":               0,
+				"message":            "dry run",
+				"group_id":           installedID,
+				"diff":               diffs,
+				"missing_parameters": missing,
+				"signature":          signature,
+			}
+		}
+		if len(missing) != 0 {
+			return 422, gin.H{
+				"code":               4021,
+				"message":            "values of parameters are required",
+				"missing_parameters": missing,
+			}
+		}
+		if conflicts := manifest.snippetConflicts(installedID); len(conflicts) != 0 {
+			return 409, gin.H{
+				"code":      2051,
+				"message":   "snippet name is already used",
+				"conflicts": conflicts,
+			}
+		}
+		if err := manifest.checkTemplates(); err != nil {
+			return 422, gin.H{
+				"code":    2041,
+				"message": fmt.Sprintf("template error: %s", err),
+			}
+		}
+		if status, result := storeArchiveResources(zipReader); result != nil {
+			return status, result
+		}
+		if err := manifest.applyUpgrade(installedID, &diffs); err != nil {
+			log.Error(err)
+			return 500, gin.H{
+				"code":    3000,
+				"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+				"diff":    diffs,
+			}
+		}
+		backfillMediaInfo(groups[installedID])
+		return 200, gin.H{
+			"code":         0,
+			"message":      "ok",
+			"group_id":     installedID,
+			"display_name": groups[installedID].DisplayName,
+			"diff":         diffs,
+			"signature":    signature,
+		}
+	default:
+		return 400, gin.H{
+			"code":    2000,
+			"message": "mode must be auto, install or upgrade",
+		}
+	}
+	missing := manifest.missingParameters(nil)
+	if dryRun {
+		diffs := make([]ItemDiff, 0)
+		manifest.diffInstall("", &diffs)
+		diffs = append(diffs, manifest.snippetConflicts(0)...)
+		return 200, gin.H{
+			"code":               0,
+			"message":            "dry run",
+			"diff":               diffs,
+			"missing_parameters": missing,
+			"signature":          signature,
+		}
+	}
+	if len(missing) != 0 {
+		return 422, gin.H{
+			"code":               4021,
+			"message":            "values of parameters are required",
+			"missing_parameters": missing,
+		}
+	}
+	if conflicts := manifest.snippetConflicts(0); len(conflicts) != 0 {
+		return 409, gin.H{
+			"code":      2051,
+			"message":   "snippet name is already used",
+			"conflicts": conflicts,
+		}
+	}
+	if err := manifest.checkTemplates(); err != nil {
+		return 422, gin.H{
+			"code":    2041,
+			"message": fmt.Sprintf("template error: %s", err),
+		}
+	}
+	if status, result := storeArchiveResources(zipReader); result != nil {
+		return status, result
+	}
+	itemCursor++
+	cursor := itemCursor
+	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
+		return 500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		}
 	}
+	newGroup := manifest.restore(cursor)
+	backfillMediaInfo(newGroup)
 	newGroup.ParentGroup = parentID
 
 	parentGroup.Items = append(parentGroup.Items, Item{
@@ -663,38 +993,203 @@ func importGroup(c *gin.Context) {
 		ItemID:      cursor,
 	})
 	if err = parentGroup.SaveToDB(parentID); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
 	groups[cursor] = newGroup
 	if err = newGroup.SaveToDB(cursor); err != nil {
 		log.Error(err)
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
-	c.JSON(201, gin.H{
+	if err = restorePluginData(files, cursor); err != nil {
+		log.Error(err)
+		return 500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("error when restore plugin data: %s", err),
+		}
+	}
+	return 201, gin.H{
 		"code":         0,
 		"message":      "ok",
 		"group_id":     cursor,
 		"display_name": newGroup.DisplayName,
+		"signature":    signature,
+	}
+}
+
+// receivePluginRequest reads plugin zipfile from request body, or from the "plugin" field of multipart form,
+// in which the "parameters" field holds values of plugin parameters as json object. result is nil if succeeded.
+func receivePluginRequest(c *gin.Context) (archiveFile *os.File, archiveSize int64, values map[string]interface{}, status int, result gin.H) {
+	tooLarge := gin.H{
+		"code":    6001,
+		"message": fmt.Sprintf("plugin is larger than %d MiB", Config.MaxPluginSize),
+	}
+	if c.ContentType() == "application/zip" {
+		var err error
+		archiveFile, _, archiveSize, err = receiveFile(c.Request.Body, Config.MaxPluginSize<<20)
+		if err != nil {
+			if err == errFileTooLarge {
+				return nil, 0, nil, 413, tooLarge
+			}
+			return nil, 0, nil, 500, gin.H{
+				"code":    6000,
+				"message": fmt.Sprintf("error when reading request body: %s", err),
+			}
+		}
+		return archiveFile, archiveSize, map[string]interface{}{}, 0, nil
+	}
+	multipartReader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, 0, nil, 415, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("request is not multipart form: %s", err),
+		}
+	}
+	fail := func(status int, result gin.H) (*os.File, int64, map[string]interface{}, int, gin.H) {
+		if archiveFile != nil {
+			discardTempFile(archiveFile)
+		}
+		return nil, 0, nil, status, result
+	}
+	var rawValues []byte
+	for {
+		part, err := multipartReader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(400, gin.H{
+				"code":    6000,
+				"message": fmt.Sprintf("error when reading request body: %s", err),
+			})
+		}
+		switch part.FormName() {
+		case "plugin":
+			if archiveFile != nil {
+				_ = part.Close()
+				return fail(400, gin.H{
+					"code":    5000,
+					"message": "more than one plugin in request",
+				})
+			}
+			archiveFile, _, archiveSize, err = receiveFile(part, Config.MaxPluginSize<<20)
+			if err != nil {
+				_ = part.Close()
+				if err == errFileTooLarge {
+					return fail(413, tooLarge)
+				}
+				return fail(500, gin.H{
+					"code":    6000,
+					"message": fmt.Sprintf("error when reading request body: %s", err),
+				})
+			}
+		case "parameters":
+			rawValues, err = io.ReadAll(io.LimitReader(part, 1<<20))
+			if err != nil {
+				_ = part.Close()
+				return fail(400, gin.H{
+					"code":    6000,
+					"message": fmt.Sprintf("error when reading request body: %s", err),
+				})
+			}
+		}
+		_ = part.Close()
+	}
+	if archiveFile == nil {
+		return fail(400, gin.H{
+			"code":    5000,
+			"message": "plugin field not found in form",
+		})
+	}
+	values, err = parseParameterValues(rawValues)
+	if err != nil {
+		return fail(422, gin.H{
+			"code":    4020,
+			"message": err.Error(),
+		})
+	}
+	return archiveFile, archiveSize, values, 0, nil
+}
+
+// storeArchiveResources saves resource files in plugin zipfile into storage, result is nil if succeeded
+func storeArchiveResources(zipReader *zip.Reader) (int, gin.H) {
+	for _, file := range zipReader.File {
+		nameSplit := strings.Split(file.Name, ".")
+		if len(nameSplit[0]) == 64 {
+			_, exists := resourceIDByHash(nameSplit[0])
+			if exists {
+				continue
+			}
+			fr, err := file.Open()
+			if err != nil {
+				log.Error(err)
+				return 500, gin.H{
+					"code":    3000,
+					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+				}
+			}
+			resFile, hashBytes, resSize, err := receiveFile(fr, Config.MaxResourceSize<<20)
+			_ = fr.Close()
+			if err != nil {
+				if err == errFileTooLarge {
+					return 413, gin.H{
+						"code":    6001,
+						"message": fmt.Sprintf("resource %s is larger than %d MiB", file.Name, Config.MaxResourceSize),
+					}
+				}
+				log.Error(err)
+				return 500, gin.H{
+					"code":    3000,
+					"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+				}
+			}
+			hashHex := hex.EncodeToString(hashBytes[:])
+			if !strings.EqualFold(nameSplit[0], hashHex) {
+				discardTempFile(resFile)
+				return 400, gin.H{
+					"code":    3000,
+					"message": fmt.Sprintf("zipfile sha256sum dose not match fine name: %s", file.Name),
+				}
+			}
+			err = resStorage.Put(file.Name, resFile, resSize)
+			discardTempFile(resFile)
+			if err != nil {
+				return 500, gin.H{
+					"code":    6000,
+					"message": fmt.Sprintf("error when writing file: %s", err),
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// backfillMediaInfo fills metadata of resources in group, archives exported by old version have no resource metadata
+func backfillMediaInfo(g *Group) {
+	g.walkItems(func(item Item) {
+		if item.ItemType != ResourceItem {
+			return
+		}
+		if res, ok := resources[item.ItemID]; ok && res.MIME == "" {
+			if err := res.fillMediaInfo(); err != nil {
+				log.Warnf("无法读取资源%d的信息：%s", item.ItemID, err)
+				return
+			}
+			if err := res.SaveToDB(item.ItemID); err != nil {
+				log.Error(err)
+			}
+		}
 	})
 }
 
 type groupMoveTo struct {
-	MoveTo uint64 `json:"move_to"`
+	MoveTo     uint64 `json:"move_to"`
+	DeleteData bool   `json:"delete_data"`
 }
 
 func deleteGroup(c *gin.Context) {
@@ -756,6 +1251,11 @@ func deleteGroup(c *gin.Context) {
 		}
 	}
 	newGroup.Items = append(newGroup.Items, group.Items...)
+	if movePatch.DeleteData {
+		if err := deletePluginData(groupID); err != nil {
+			log.Errorf("error when delete data of group %d: %s", groupID, err)
+		}
+	}
 	// remove self from database
 	delete(groups, groupID)
 	if err := db.Delete(append([]byte("gypsum-groups-"), helper.U64ToBytes(groupID)...), nil); err != nil {
@@ -779,11 +1279,14 @@ func deleteGroup(c *gin.Context) {
 	return
 }
 
-type groupNamePatch struct {
-	DisplayName string `json:"display_name"`
+type groupPatch struct {
+	DisplayName      *string  `json:"display_name"`
+	Active           *bool    `json:"active"`
+	EnabledGroupsID  *[]int64 `json:"enabled_groups_id"`
+	DisabledGroupsID *[]int64 `json:"disabled_groups_id"`
 }
 
-func renameGroup(c *gin.Context) {
+func patchGroup(c *gin.Context) {
 	groupIDStr := c.Param("gid")
 	groupID, err := strconv.ParseUint(groupIDStr, 10, 64)
 	if err != nil {
@@ -801,17 +1304,29 @@ func renameGroup(c *gin.Context) {
 		})
 		return
 	}
-	np := groupNamePatch{}
-	if err = c.BindJSON(&np); err != nil {
+	patch := groupPatch{}
+	if err = c.BindJSON(&patch); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
 			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	group.DisplayName = np.DisplayName
-	if err = ChangeNameForParent(group.ParentGroup, groupID, np.DisplayName); err != nil {
-		log.Errorf("error when change group %d from parent group %d: %s", groupID, group.ParentGroup, err)
+	if patch.DisplayName != nil {
+		group.DisplayName = *patch.DisplayName
+		if err = ChangeNameForParent(group.ParentGroup, groupID, *patch.DisplayName); err != nil {
+			log.Errorf("error when change group %d from parent group %d: %s", groupID, group.ParentGroup, err)
+		}
+	}
+	// items keep their own `active`, they are checked against the group when matching
+	if patch.Active != nil {
+		group.Disabled = !*patch.Active
+	}
+	if patch.EnabledGroupsID != nil {
+		group.EnabledGroupsID = *patch.EnabledGroupsID
+	}
+	if patch.DisabledGroupsID != nil {
+		group.DisabledGroupsID = *patch.DisabledGroupsID
 	}
 	if err = group.SaveToDB(groupID); err != nil {
 		c.JSON(500, gin.H{
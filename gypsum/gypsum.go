@@ -12,15 +12,29 @@ import (
 	zero "github.com/wdvxdr1123/ZeroBot"
 
 	_ "github.com/yuudi/gypsum/gypsum/helper/jsoniter_plugin_integer_interface"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type ConfigType struct {
-	Listen         string
-	Password       string
-	PasswordSalt   string
-	ExternalAssets string
-	ResourceShare  string
-	HttpBackRef    string
+	Listen           string
+	Password         string
+	PasswordSalt     string
+	ExternalAssets   string
+	ResourceShare    string
+	HttpBackRef      string
+	ResourceSign     string
+	ResourceSignTTL  int64
+	ResourceStorage  string
+	S3               storage.S3Config
+	MaxResourceSize  int64 // MiB
+	MaxPluginSize    int64 // MiB
+	UntrustedPlugins string
+	Repositories     []string
+	ExecutionTimeout int64 // seconds
+	MaxConcurrency   int
+	Outbound         OutboundPolicy
+	Sandbox          sandbox.Config
 }
 
 func (c *ConfigType) CheckValid() (changed bool, err error) {
@@ -34,6 +48,55 @@ func (c *ConfigType) CheckValid() (changed bool, err error) {
 	default:
 		return false, errors.New("unknown ResourceShare: " + c.ResourceShare)
 	}
+	switch c.ResourceSign {
+	case "", "permanent":
+		c.ResourceSign = "permanent"
+	case "expiring":
+	default:
+		return false, errors.New("unknown ResourceSign: " + c.ResourceSign)
+	}
+	// also used by presigned urls of object storage, even if ResourceSign is permanent
+	if c.ResourceSignTTL <= 0 {
+		c.ResourceSignTTL = 3600
+	}
+	switch c.ResourceStorage {
+	case "", "local":
+		c.ResourceStorage = "local"
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+			return false, errors.New("ResourceStorage is s3, but S3.Endpoint or S3.Bucket is not set")
+		}
+	default:
+		return false, errors.New("unknown ResourceStorage: " + c.ResourceStorage)
+	}
+	if c.MaxResourceSize <= 0 {
+		c.MaxResourceSize = 64
+	}
+	if c.MaxPluginSize <= 0 {
+		c.MaxPluginSize = 256
+	}
+	switch c.UntrustedPlugins {
+	case "", "allow":
+		c.UntrustedPlugins = "allow"
+	case "refuse":
+	default:
+		return false, errors.New("unknown UntrustedPlugins: " + c.UntrustedPlugins)
+	}
+	if c.ExecutionTimeout <= 0 {
+		c.ExecutionTimeout = 60
+	}
+	if c.MaxConcurrency <= 0 {
+		c.MaxConcurrency = 16
+	}
+	if c.Sandbox.BaseDirs == nil {
+		c.Sandbox.BaseDirs = []string{"resources"}
+	}
+	if c.Sandbox.Timeout <= 0 {
+		c.Sandbox.Timeout = 10
+	}
+	if c.Sandbox.MaxResponseSize <= 0 {
+		c.Sandbox.MaxResponseSize = 2048
+	}
 	if len(c.Password) == 0 {
 		return false, errors.New("未设置密码")
 	}
@@ -78,6 +141,7 @@ func (_ *gypsumPlugin) Start() { // 插件主体
 		log.Fatalf("pongo2引擎初始化错误：%s", err)
 		return
 	}
+	initExecutions()
 	if err := initDb(); err != nil {
 		log.Fatalf("数据库初始化错误：%s", err)
 		return
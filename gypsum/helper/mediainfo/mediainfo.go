@@ -0,0 +1,275 @@
+package mediainfo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+type Info struct {
+	MIME     string
+	Width    int
+	Height   int
+	Duration float64 // seconds
+}
+
+// DetectMIME works like http.DetectContentType, with some audio formats used by QQ
+func DetectMIME(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("#!AMR")):
+		return "audio/amr"
+	case bytes.HasPrefix(head, []byte("#!SILK_V3")), bytes.HasPrefix(head, []byte("\x02#!SILK_V3")):
+		return "audio/silk"
+	}
+	m := http.DetectContentType(head)
+	if i := strings.IndexByte(m, ';'); i != -1 {
+		m = m[:i]
+	}
+	if m == "application/octet-stream" && len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0 {
+		// mp3 without id3 tag
+		return "audio/mpeg"
+	}
+	return m
+}
+
+var audioExtensions = map[string][]string{
+	"audio/mpeg":      {".mp3"},
+	"audio/wave":      {".wav"},
+	"audio/amr":       {".amr"},
+	"audio/silk":      {".silk", ".slk"},
+	"application/ogg": {".ogg", ".oga", ".opus"},
+}
+
+// MatchExtension reports whether ext is a proper extension of mime type, unknown types are always matched
+func MatchExtension(mimeType, ext string) bool {
+	exts, ok := audioExtensions[mimeType]
+	if !ok {
+		exts, _ = mime.ExtensionsByType(mimeType)
+	}
+	if len(exts) == 0 {
+		return true
+	}
+	for _, e := range exts {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// MediaExtension returns the usual extension of image and audio types, or "" for other types
+func MediaExtension(mimeType string) string {
+	if ext, ok := imageExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, ok := audioExtensions[mimeType]; ok {
+		return exts[0]
+	}
+	return ""
+}
+
+func IsImage(mime string) bool {
+	return strings.HasPrefix(mime, "image/")
+}
+
+func IsAudio(mime string) bool {
+	return strings.HasPrefix(mime, "audio/") || mime == "application/ogg"
+}
+
+// Probe reads the content and finds out its type, dimensions of image or duration of audio
+func Probe(r io.ReadSeeker) (Info, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Info{}, err
+	}
+	head = head[:n]
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return Info{MIME: DetectMIME(head)}, err
+	}
+	return probe(head, r)
+}
+
+// ProbeReader is Probe for content that cannot seek, such as a file in object storage.
+// only the header is read, except for mp3 whose frames are all counted
+func ProbeReader(r io.Reader) (Info, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Info{}, err
+	}
+	head = head[:n]
+	return probe(head, io.MultiReader(bytes.NewReader(head), r))
+}
+
+// probe reads the content from the beginning, head is the first bytes of it
+func probe(head []byte, r io.Reader) (Info, error) {
+	var err error
+	info := Info{MIME: DetectMIME(head)}
+	switch info.MIME {
+	case "image/webp":
+		info.Width, info.Height = webpSize(head)
+	case "audio/mpeg":
+		info.Duration, err = mp3Duration(r)
+	case "audio/wave":
+		info.Duration, err = wavDuration(r)
+	default:
+		if IsImage(info.MIME) {
+			if config, _, e := image.DecodeConfig(r); e == nil {
+				info.Width, info.Height = config.Width, config.Height
+			}
+		}
+	}
+	return info, err
+}
+
+func webpSize(head []byte) (int, int) {
+	if len(head) < 30 {
+		return 0, 0
+	}
+	data := head[20:]
+	switch string(head[12:16]) {
+	case "VP8 ":
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0
+		}
+		return int(binary.LittleEndian.Uint16(data[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(data[8:]) & 0x3fff)
+	case "VP8L":
+		if data[0] != 0x2f {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(data[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		w := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16
+		h := uint32(data[7]) | uint32(data[8])<<8 | uint32(data[9])<<16
+		return int(w) + 1, int(h) + 1
+	}
+	return 0, 0
+}
+
+func wavDuration(r io.Reader) (float64, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	var byteRate uint32
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		switch string(chunk[:4]) {
+		case "fmt ":
+			fmtChunk := make([]byte, size)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return 0, err
+			}
+			if size >= 12 {
+				byteRate = binary.LittleEndian.Uint32(fmtChunk[8:])
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0, nil
+			}
+			return float64(size) / float64(byteRate), nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size)+int64(size&1)); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+var mp3Bitrates = [2][3][15]int{
+	{ // mpeg 1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // layer 1
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // layer 2
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // layer 3
+	},
+	{ // mpeg 2 and 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mp3SampleRates = map[uint32][3]int{
+	3: {44100, 48000, 32000}, // mpeg 1
+	2: {22050, 24000, 16000}, // mpeg 2
+	0: {11025, 12000, 8000},  // mpeg 2.5
+}
+
+// mp3Duration walks through all frames, so that it works for vbr files
+func mp3Duration(r io.Reader) (float64, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	if id3, err := reader.Peek(10); err == nil && string(id3[:3]) == "ID3" {
+		skip := 10 + (int(id3[6])<<21 | int(id3[7])<<14 | int(id3[8])<<7 | int(id3[9]))
+		if id3[5]&0x10 != 0 {
+			skip += 10 // footer
+		}
+		if _, err = reader.Discard(skip); err != nil {
+			return 0, err
+		}
+	}
+	var duration float64
+	for {
+		head, err := reader.Peek(4)
+		if err != nil {
+			return duration, nil
+		}
+		h := binary.BigEndian.Uint32(head)
+		version := h >> 19 & 3
+		layer := 3 - (h >> 17 & 3) // 0: layer 1, 1: layer 2, 2: layer 3
+		bitrateIndex := h >> 12 & 0xf
+		sampleRateIndex := h >> 10 & 3
+		padding := int(h >> 9 & 1)
+		if h&0xffe00000 != 0xffe00000 || version == 1 || layer == 3 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			// not a frame header, resync
+			_, _ = reader.Discard(1)
+			continue
+		}
+		versionIndex := 0
+		if version != 3 {
+			versionIndex = 1
+		}
+		bitrate := mp3Bitrates[versionIndex][layer][bitrateIndex] * 1000
+		sampleRate := mp3SampleRates[version][sampleRateIndex]
+		var samples, length int
+		switch {
+		case layer == 0:
+			samples = 384
+			length = (12*bitrate/sampleRate + padding) * 4
+		case layer == 2 && versionIndex == 1:
+			samples = 576
+			length = 72*bitrate/sampleRate + padding
+		default:
+			samples = 1152
+			length = 144*bitrate/sampleRate + padding
+		}
+		duration += float64(samples) / float64(sampleRate)
+		if _, err = reader.Discard(length); err != nil {
+			return duration, nil
+		}
+	}
+}
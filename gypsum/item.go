@@ -2,6 +2,7 @@ package gypsum
 
 import (
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +17,7 @@ const (
 	TriggerItem   ItemType = "trigger"
 	SchedulerItem ItemType = "scheduler"
 	ResourceItem  ItemType = "resource"
+	SnippetItem   ItemType = "snippet"
 	GroupItem     ItemType = "group"
 )
 
@@ -33,81 +35,174 @@ func init() {
 	gob.Register(Resource{})
 	gob.Register(Rule{})
 	gob.Register(Trigger{})
+	gob.Register(Snippet{})
 }
 
-func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint64) (uint64, error) {
+func UserRecordFromBytes(itemType ItemType, itemBytes []byte) (UserRecord, error) {
 	switch itemType {
 	case RuleItem:
-		rule, err := RuleFromBytes(itemBytes)
+		return RuleFromBytes(itemBytes)
+	case TriggerItem:
+		return TriggerFromByte(itemBytes)
+	case SchedulerItem:
+		return JobFromBytes(itemBytes)
+	case ResourceItem:
+		return ResourceFromBytes(itemBytes)
+	case SnippetItem:
+		return SnippetFromBytes(itemBytes)
+	case GroupItem:
+		return GroupFromBytes(itemBytes)
+	default:
+		log.Warnf("unknown type: %s", itemType)
+		return nil, errors.New("unexpected type of user_record")
+	}
+}
+
+func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint64) (uint64, error) {
+	if itemType == GroupItem {
+		ga, err := GroupArchiveFromBytes(itemBytes)
 		if err != nil {
 			return 0, err
 		}
-		rule.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
+		mg := ga.toManifestGroup()
+		return mg.restoreAsChild(newParentID)
+	}
+	record, err := UserRecordFromBytes(itemType, itemBytes)
+	if err != nil {
+		return 0, err
+	}
+	return restoreUserRecord(record, newParentID)
+}
+
+// restoreUserRecord saves record with a new id, and takes it into effect
+func restoreUserRecord(record UserRecord, newParentID uint64) (uint64, error) {
+	itemCursor++
+	cursor := itemCursor
+	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
+		return 0, err
+	}
+	if err := putUserRecord(cursor, record, newParentID); err != nil {
+		return 0, err
+	}
+	return cursor, nil
+}
+
+// putUserRecord saves record with given id, and takes it into effect.
+// if the id was used by another record, unregisterUserRecord should be called first
+func putUserRecord(id uint64, record UserRecord, parentID uint64) error {
+	switch r := record.(type) {
+	case *Rule:
+		r.ParentGroup = parentID
+		rules[id] = r
+		if err := r.Register(id); err != nil {
+			log.Errorf("无法注册规则%d：%s", id, err)
 		}
-		rules[cursor] = rule
-		if err := rule.SaveToDB(cursor); err != nil {
-			return 0, err
+	case *Trigger:
+		r.ParentGroup = parentID
+		triggers[id] = r
+		if err := r.Register(id); err != nil {
+			log.Errorf("无法注册触发器%d：%s", id, err)
 		}
-		return cursor, nil
-	case TriggerItem:
-		trigger, err := TriggerFromByte(itemBytes)
-		if err != nil {
-			return 0, err
+	case *Job:
+		r.ParentGroup = parentID
+		jobs[id] = r
+		if err := r.Register(id); err != nil {
+			log.Errorf("无法注册任务%d：%s", id, err)
 		}
-		trigger.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
+	case *Resource:
+		r.ParentGroup = parentID
+		resources[id] = r
+		if hashBytes, err := hex.DecodeString(r.Sha256Sum); err == nil {
+			hashKey := append([]byte("gypsum-resources_hash-"), hashBytes...)
+			if exists, _ := db.Has(hashKey, nil); !exists {
+				if err := db.Put(hashKey, helper.U64ToBytes(id), nil); err != nil {
+					return err
+				}
+			}
 		}
-		triggers[cursor] = trigger
-		if err := trigger.SaveToDB(cursor); err != nil {
-			return 0, err
+	case *Snippet:
+		r.ParentGroup = parentID
+		snippets[id] = r
+		if err := r.SaveToDB(id); err != nil {
+			return err
 		}
-		return cursor, nil
-	case SchedulerItem:
-		job, err := JobFromBytes(itemBytes)
-		if err != nil {
-			return 0, err
+		// templates may have been waiting for this snippet
+		recompileSnippetDependents()
+		return nil
+	case *Group:
+		r.ParentGroup = parentID
+		groups[id] = r
+	}
+	return record.SaveToDB(id)
+}
+
+// unregisterUserRecord takes record out of effect, the record is still in database
+func unregisterUserRecord(itemType ItemType, id uint64) {
+	switch itemType {
+	case RuleItem:
+		if matcher, ok := zeroMatcher[id]; ok {
+			matcher.Delete()
+			delete(zeroMatcher, id)
 		}
-		job.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
+		delete(rules, id)
+	case TriggerItem:
+		if matcher, ok := zeroTrigger[id]; ok {
+			matcher.Delete()
+			delete(zeroTrigger, id)
 		}
-		jobs[cursor] = job
-		if err := job.SaveToDB(cursor); err != nil {
-			return 0, err
+		delete(triggers, id)
+	case SchedulerItem:
+		if entry, ok := entries[id]; ok {
+			scheduler.Remove(entry)
+			delete(entries, id)
 		}
-		return cursor, nil
+		delete(jobs, id)
 	case ResourceItem:
-		resource, err := ResourceFromBytes(itemBytes)
-		if err != nil {
-			return 0, err
-		}
-		resource.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
+		if r, ok := resources[id]; ok {
+			if hashBytes, err := hex.DecodeString(r.Sha256Sum); err == nil {
+				hashKey := append([]byte("gypsum-resources_hash-"), hashBytes...)
+				if idx, err := db.Get(hashKey, nil); err == nil && helper.ToUint(idx) == id {
+					if err := db.Delete(hashKey, nil); err != nil {
+						log.Error(err)
+					}
+				}
+			}
 		}
-		resources[cursor] = resource
-		if err := resource.SaveToDB(cursor); err != nil {
-			return 0, err
-		}
-		return cursor, nil
+		delete(resources, id)
+	case SnippetItem:
+		delete(snippets, id)
 	case GroupItem:
-		err := errors.New("group in group are not supported yet")
-		log.Warn(err)
-		return 0, err
+		delete(groups, id)
+	}
+}
+
+// removeUserRecord deletes record from database, items in a group are removed together.
+// the record is not removed from its parent group.
+func removeUserRecord(itemType ItemType, id uint64) error {
+	var prefix string
+	switch itemType {
+	case RuleItem:
+		prefix = "gypsum-rules-"
+	case TriggerItem:
+		prefix = "gypsum-triggers-"
+	case SchedulerItem:
+		prefix = "gypsum-jobs-"
+	case ResourceItem:
+		prefix = "gypsum-resources-"
+	case SnippetItem:
+		prefix = "gypsum-snippets-"
+	case GroupItem:
+		prefix = "gypsum-groups-"
+		if g, ok := groups[id]; ok {
+			for _, item := range g.Items {
+				if err := removeUserRecord(item.ItemType, item.ItemID); err != nil {
+					return err
+				}
+			}
+		}
 	default:
-		err := errors.New("unexpected type of user_record")
-		log.Warnf("unknown type: %s", itemType)
-		return 0, err
+		return errors.New("unexpected type of user_record")
 	}
+	unregisterUserRecord(itemType, id)
+	return db.Delete(append([]byte(prefix), helper.U64ToBytes(id)...), nil)
 }
@@ -0,0 +1,679 @@
+package gypsum
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/gin-gonic/gin"
+	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/luatag"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+const (
+	LintError   = "error"   // the item fails at runtime
+	LintWarning = "warning" // the item probably does not work as expected
+	LintInfo    = "info"    // the item works, but something may be forgotten
+)
+
+// LintIssue is a problem found by static analysis, line is 0 if the problem is not in a line
+type LintIssue struct {
+	ItemType ItemType `json:"item_type,omitempty"`
+	ItemID   uint64   `json:"item_id,omitempty"`
+	Severity string   `json:"severity"`
+	Line     int      `json:"line,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// lintToken is a token inside `{{ }}` or `{% %}`
+type lintToken struct {
+	kind byte // 'i' for identifier, 's' for string, 'n' for number, 'p' for punctuation
+	val  string
+	line int
+}
+
+// lintBlock is a variable `{{ }}` or a tag `{% %}`
+type lintBlock struct {
+	tag    string // empty for variables
+	tokens []lintToken
+	line   int
+}
+
+// luaBlock is the code between `{% lua %}` and `{% endlua %}`
+type luaBlock struct {
+	code    string
+	line    int // line where the code starts
+	endLine int
+}
+
+var (
+	endCommentTag  = regexp.MustCompile(`\{%-?\s*endcomment\s*-?%}`)
+	endVerbatimTag = regexp.MustCompile(`\{%-?\s*endverbatim\s*-?%}`)
+	luaVariable    = regexp.MustCompile(`(?s)\{\{.*?}}`)
+	luaComment     = regexp.MustCompile(`(?s)\{#.*?#}`)
+	luaRequire     = regexp.MustCompile(`\brequire\s*\(?\s*["']([^"']+)["']`)
+	luaRes         = regexp.MustCompile(`\bres\s*\(\s*["']([^"']+)["']\s*\)`)
+)
+
+// scanTemplate finds all variables and tags in template, it stops at the first unclosed block
+func scanTemplate(src string) (blocks []lintBlock, luaBlocks []luaBlock) {
+	line := 1
+	pos := 0
+	luaStart, luaLine := -1, 0
+	for {
+		i := strings.IndexByte(src[pos:], '{')
+		if i == -1 {
+			return
+		}
+		start := pos + i
+		line += strings.Count(src[pos:start], "\n")
+		pos = start + 1
+		if start+1 >= len(src) {
+			return
+		}
+		var closing string
+		switch src[start+1] {
+		case '#':
+			end := strings.Index(src[start:], "#}")
+			if end == -1 {
+				return
+			}
+			line += strings.Count(src[start:start+end], "\n")
+			pos = start + end + 2
+			continue
+		case '{':
+			closing = "}}"
+		case '%':
+			closing = "%}"
+		default:
+			continue
+		}
+		tokens, end := lexBlock(src, start+2, closing, line)
+		if end == -1 {
+			return
+		}
+		block := lintBlock{tokens: tokens, line: line}
+		line += strings.Count(src[start:end], "\n")
+		pos = end
+		if closing == "%}" && len(tokens) != 0 && tokens[0].kind == 'i' {
+			block.tag = tokens[0].val
+		}
+		var skipUntil *regexp.Regexp
+		switch block.tag {
+		case "comment":
+			skipUntil = endCommentTag
+		case "verbatim":
+			skipUntil = endVerbatimTag
+		case "lua":
+			luaStart, luaLine = pos, line
+		case "endlua", "end_lua":
+			if luaStart != -1 {
+				luaBlocks = append(luaBlocks, luaBlock{code: src[luaStart:start], line: luaLine, endLine: block.line})
+				luaStart = -1
+			}
+		}
+		if skipUntil != nil {
+			// the content is not template
+			loc := skipUntil.FindStringIndex(src[pos:])
+			if loc == nil {
+				return
+			}
+			line += strings.Count(src[pos:pos+loc[1]], "\n")
+			pos += loc[1]
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// lexBlock splits the content of a block into tokens, end is the position after closing, or -1 if the block is not closed
+func lexBlock(src string, i int, closing string, line int) (tokens []lintToken, end int) {
+	tokens = make([]lintToken, 0)
+	if i < len(src) && src[i] == '-' {
+		i++
+	}
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case strings.HasPrefix(src[i:], closing):
+			return tokens, i + len(closing)
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, -1
+			}
+			value := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\'`, `'`).Replace(src[i+1 : j])
+			tokens = append(tokens, lintToken{kind: 's', val: value, line: line})
+			line += strings.Count(src[i:j], "\n")
+			i = j + 1
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, lintToken{kind: 'i', val: src[i:j], line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, lintToken{kind: 'n', val: src[i:j], line: line})
+			i = j
+		default:
+			n := 1
+			for _, op := range []string{"==", "!=", "<=", ">=", "<>", "&&", "||"} {
+				if strings.HasPrefix(src[i:], op) {
+					n = 2
+					break
+				}
+			}
+			tokens = append(tokens, lintToken{kind: 'p', val: src[i : i+n], line: line})
+			i += n
+		}
+	}
+	return nil, -1
+}
+
+// closingParen finds the index of ")" matching "(" at start, or len(tokens) if it is not closed
+func closingParen(tokens []lintToken, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		if tokens[i].kind != 'p' {
+			continue
+		}
+		switch tokens[i].val {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// callArguments splits the arguments of call, tokens start with "("
+func callArguments(tokens []lintToken) [][]lintToken {
+	args := make([][]lintToken, 0)
+	depth := 0
+	start := 1
+	for i, t := range tokens {
+		if t.kind != 'p' {
+			continue
+		}
+		switch t.val {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+			if depth == 0 {
+				if i > start {
+					args = append(args, tokens[start:i])
+				}
+				return args
+			}
+		case ",":
+			if depth == 1 {
+				args = append(args, tokens[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return args
+}
+
+// pongo2 keywords that may be followed by "("
+var lintKeywords = map[string]bool{
+	"in": true, "and": true, "or": true, "not": true, "is": true, "as": true, "true": true, "false": true,
+}
+
+// words that are not variables when they appear alone
+var lintBareWords = map[string]bool{
+	"reversed": true, "sorted": true, "with": true, "only": true, "silent": true, "export": true, "forloop": true,
+}
+
+// tags whose arguments are not expressions
+var lintNonExpressionTags = map[string]bool{
+	"block": true, "endblock": true, "filter": true, "autoescape": true, "templatetag": true, "lorem": true,
+	"extends": true, "import": true, "macro": true, "now": true,
+}
+
+// names that only make sense when there is an event
+var eventNames = map[string]bool{
+	"event": true, "state": true, "json_event": true, "matcher": true, "at_sender": true,
+	"approve": true, "withdraw": true, "set_title": true, "group_ban": true,
+}
+
+var typeOfExecutionContext = reflect.TypeOf(new(pongo2.ExecutionContext))
+
+type linter struct {
+	known     map[string]interface{}
+	resources map[string]bool
+	groups    map[int64]bool // groups that the bot is in, nil if unknown
+}
+
+// newLinter prepares names to check templates, groups are fetched from onebot if checkGroups
+func newLinter(checkGroups bool) *linter {
+	l := &linter{
+		known:     make(map[string]interface{}),
+		resources: make(map[string]bool),
+	}
+	for name, value := range pongo2.Globals {
+		l.known[name] = value
+	}
+	// functions that are put into context at execution, the event is in a group so that all of them exist
+	ctx := buildExecutionContext(context.Background(), nil, zero.Event{UserID: 1, GroupID: 1}, zero.State{}, nil, nil)
+	for name, value := range ctx {
+		l.known[name] = value
+	}
+	// database functions only exist in plugins
+	database := template.NewDatabase(nil)
+	l.known["db_get"] = database.Get
+	l.known["db_put"] = database.Put
+	l.known["db_delete"] = database.Delete
+	l.known["db_incr"] = database.Incr
+	l.known["db_keys"] = database.Keys
+	for _, r := range resources {
+		l.resources[r.Sha256Sum+r.Ext] = true
+	}
+	if checkGroups {
+		l.groups = botGroups()
+	}
+	return l
+}
+
+// botGroupsPending is true while a query of groups is waiting for onebot,
+// the query never returns if onebot is not connected, so it is not started again
+var (
+	botGroupsLock    sync.Mutex
+	botGroupsPending bool
+)
+
+// botGroups returns groups that the bot is in, or nil if onebot does not respond in time
+func botGroups() map[int64]bool {
+	botGroupsLock.Lock()
+	if botGroupsPending {
+		botGroupsLock.Unlock()
+		return nil
+	}
+	botGroupsPending = true
+	botGroupsLock.Unlock()
+	result := make(chan map[int64]bool, 1)
+	go func() {
+		defer func() {
+			botGroupsLock.Lock()
+			botGroupsPending = false
+			botGroupsLock.Unlock()
+		}()
+		list := zero.GetGroupList()
+		if !list.IsArray() {
+			result <- nil
+			return
+		}
+		groups := make(map[int64]bool)
+		for _, group := range list.Array() {
+			groups[group.Get("group_id").Int()] = true
+		}
+		result <- groups
+	}()
+	select {
+	case groups := <-result:
+		return groups
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+// lint checks a template, noEvent is true for jobs
+func (l *linter) lint(src string, noEvent bool) []LintIssue {
+	issues := make([]LintIssue, 0)
+	report := func(severity string, line int, format string, a ...interface{}) {
+		issues = append(issues, LintIssue{Severity: severity, Line: line, Message: fmt.Sprintf(format, a...)})
+	}
+	if err := checkTemplate(src); err != nil {
+		report(LintError, 0, "template error: %s", err)
+		return issues
+	}
+	blocks, luaBlocks := scanTemplate(src)
+
+	// variables defined in template
+	locals := make(map[string]bool)
+	for _, b := range blocks {
+		for i, t := range b.tokens {
+			if t.kind != 'i' {
+				continue
+			}
+			if i+1 < len(b.tokens) && b.tokens[i+1].val == "=" || i > 0 && b.tokens[i-1].val == "as" {
+				locals[t.val] = true
+			}
+		}
+		switch b.tag {
+		case "set":
+			if len(b.tokens) > 1 {
+				locals[b.tokens[1].val] = true
+			}
+		case "for":
+			for _, t := range b.tokens[1:] {
+				if t.val == "in" {
+					break
+				}
+				locals[t.val] = true
+			}
+		case "macro", "import":
+			for _, t := range b.tokens[1:] {
+				if t.kind == 'i' {
+					locals[t.val] = true
+				}
+			}
+		}
+	}
+
+	eventUsed := false
+	unknownReported := make(map[string]bool)
+	choices := make([]int, 0) // branches of each open random_choice
+	for _, b := range blocks {
+		usesInput := false
+		for i, t := range b.tokens {
+			switch {
+			case t.kind == 'p' && t.val == "|" && i+1 < len(b.tokens):
+				// unknown filters are reported by parser already
+				if name := b.tokens[i+1].val; b.tag == "" && usesInput && (name == "safe" || name == "parse") {
+					report(LintWarning, t.line, "content from users is marked %s, CQ codes sent by users will take effect", name)
+				}
+			case t.kind == 'i' && (i == 0 || b.tokens[i-1].val != "."):
+				if i == 0 && b.tag != "" {
+					continue
+				}
+				if eventNames[t.val] && !locals[t.val] {
+					usesInput = usesInput || t.val == "event" || t.val == "state" || t.val == "json_event"
+					if noEvent && !eventUsed {
+						eventUsed = true
+						report(LintWarning, t.line, "%s is used, but jobs are not triggered by events", t.val)
+					}
+				}
+				if i > 0 && b.tokens[i-1].val == "|" {
+					// filter name
+					continue
+				}
+				if i+1 < len(b.tokens) && b.tokens[i+1].val == "(" && !lintKeywords[t.val] && !(b.tag == "macro" && i == 1) {
+					issues = append(issues, l.checkCall(t, callArguments(b.tokens[i+1:]), locals)...)
+					if fields, ok := template.QueryFields(t.val); ok && !locals[t.val] {
+						// `member(...).card`
+						if j := closingParen(b.tokens, i+1); j+2 < len(b.tokens) && b.tokens[j+1].val == "." && b.tokens[j+2].kind == 'i' && !fields[b.tokens[j+2].val] {
+							report(LintWarning, b.tokens[j+2].line, "%s has no field %s", t.val, b.tokens[j+2].val)
+						}
+					}
+					continue
+				}
+				if _, known := l.known[t.val]; known || locals[t.val] || lintKeywords[t.val] || lintBareWords[t.val] ||
+					lintNonExpressionTags[b.tag] || unknownReported[t.val] {
+					continue
+				}
+				unknownReported[t.val] = true
+				if suggestion := l.suggest(t.val, false); suggestion != "" {
+					report(LintWarning, t.line, "unknown variable %s, did you mean %s?", t.val, suggestion)
+				} else {
+					report(LintWarning, t.line, "unknown variable %s", t.val)
+				}
+			}
+		}
+		switch b.tag {
+		case "send_group":
+			if len(b.tokens) > 1 && b.tokens[1].kind == 'n' && l.groups != nil {
+				if id, err := strconv.ParseInt(b.tokens[1].val, 10, 64); err == nil && !l.groups[id] {
+					report(LintWarning, b.line, "the bot is not in group %d", id)
+				}
+			}
+		case "pass":
+			if noEvent {
+				report(LintWarning, b.line, "pass does nothing in jobs")
+			}
+		case "random_choice":
+			choices = append(choices, 1)
+		case "otherwise":
+			if len(choices) != 0 {
+				choices[len(choices)-1]++
+			}
+		case "end_random_choice":
+			if len(choices) != 0 {
+				if choices[len(choices)-1] == 1 {
+					report(LintInfo, b.line, "random_choice has only one branch")
+				}
+				choices = choices[:len(choices)-1]
+			}
+		}
+	}
+
+	for _, block := range luaBlocks {
+		code := luaComment.ReplaceAllStringFunc(block.code, blankLines)
+		code = luaVariable.ReplaceAllStringFunc(code, func(s string) string {
+			// variables are rendered before lua runs
+			return "nil" + blankLines(s)
+		})
+		lineOf := func(offset int) int {
+			return block.line + strings.Count(code[:offset], "\n")
+		}
+		// tags may change the code, so the syntax is only checked without tags
+		if !strings.Contains(code, "{%") {
+			if line, message, ok := luatag.CheckSyntax(code); !ok {
+				if line == 0 {
+					line = block.endLine
+				} else {
+					line += block.line - 1
+				}
+				report(LintError, line, "lua error: %s", message)
+			}
+		}
+		for _, match := range luaRequire.FindAllStringSubmatchIndex(code, -1) {
+			if name := code[match[2]:match[3]]; !luatag.ModuleExists(name) {
+				report(LintWarning, lineOf(match[0]), "lua module %s does not exist", name)
+			}
+		}
+		for _, match := range luaRes.FindAllStringSubmatchIndex(code, -1) {
+			if name := code[match[2]:match[3]]; !l.resources[name] {
+				report(LintWarning, lineOf(match[0]), "no such resource %s", name)
+			}
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Line < issues[j].Line
+	})
+	return issues
+}
+
+// blankLines keeps only line breaks of s, so that lines after it are not moved
+func blankLines(s string) string {
+	return strings.Repeat("\n", strings.Count(s, "\n"))
+}
+
+// checkCall checks that the function exists and accepts the arguments
+func (l *linter) checkCall(name lintToken, args [][]lintToken, locals map[string]bool) []LintIssue {
+	issue := func(severity string, format string, a ...interface{}) []LintIssue {
+		return []LintIssue{{Severity: severity, Line: name.line, Message: fmt.Sprintf(format, a...)}}
+	}
+	if locals[name.val] {
+		return nil
+	}
+	fn, ok := l.known[name.val]
+	if !ok {
+		if suggestion := l.suggest(name.val, true); suggestion != "" {
+			return issue(LintWarning, "unknown function %s, did you mean %s?", name.val, suggestion)
+		}
+		return issue(LintWarning, "unknown function %s", name.val)
+	}
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return issue(LintWarning, "%s is not a function", name.val)
+	}
+	numIn := t.NumIn()
+	if numIn > 0 && t.In(0) == typeOfExecutionContext {
+		numIn--
+	}
+	if len(args) != numIn && !(t.IsVariadic() && len(args) >= numIn-1) {
+		if t.IsVariadic() {
+			return issue(LintError, "%s accepts at least %d arguments, but got %d", name.val, numIn-1, len(args))
+		}
+		return issue(LintError, "%s accepts %d arguments, but got %d", name.val, numIn, len(args))
+	}
+	literal := func(i int, kind byte) (string, bool) {
+		if i >= len(args) || len(args[i]) != 1 || args[i][0].kind != kind {
+			return "", false
+		}
+		return args[i][0].val, true
+	}
+	switch name.val {
+	case "res":
+		if file, ok := literal(0, 's'); ok && !l.resources[file] {
+			return issue(LintWarning, "no such resource %s", file)
+		}
+	case "sleep":
+		if s, ok := literal(0, 'n'); ok {
+			if seconds, err := strconv.ParseFloat(s, 64); err == nil && seconds >= float64(Config.ExecutionTimeout) {
+				return issue(LintWarning, "sleeping %s seconds exceeds ExecutionTimeout (%d seconds)", s, Config.ExecutionTimeout)
+			}
+		}
+	}
+	return nil
+}
+
+// suggest finds a known name with similar name, only functions are considered if onlyFunctions
+func (l *linter) suggest(name string, onlyFunctions bool) string {
+	best, bestDistance := "", 3
+	for known, value := range l.known {
+		if strings.HasPrefix(known, "_") {
+			continue
+		}
+		if onlyFunctions && (reflect.TypeOf(value) == nil || reflect.TypeOf(value).Kind() != reflect.Func) {
+			continue
+		}
+		if d := editDistance(name, known); d < bestDistance || d == bestDistance && known < best {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur := row[j]
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			row[j] = min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev = cur
+		}
+	}
+	return row[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// lintWarnings checks the template of an item that is being saved, onebot is not queried so that saving is not slowed down
+func lintWarnings(src string, noEvent bool) []LintIssue {
+	warnings := make([]LintIssue, 0)
+	for _, issue := range newLinter(false).lint(src, noEvent) {
+		if issue.Severity != LintInfo {
+			warnings = append(warnings, issue)
+		}
+	}
+	return warnings
+}
+
+// lintAll checks all rules, triggers, jobs and snippets, and resources that are not referenced
+func lintAll() []LintIssue {
+	l := newLinter(true)
+	issues := make([]LintIssue, 0)
+	sources := make([]string, 0)
+	add := func(itemType ItemType, id uint64, src string, noEvent bool) {
+		sources = append(sources, src)
+		for _, issue := range l.lint(src, noEvent) {
+			issue.ItemType = itemType
+			issue.ItemID = id
+			issues = append(issues, issue)
+		}
+	}
+	for _, id := range sortedIDs(rules) {
+		add(RuleItem, id, rules[id].Response, false)
+	}
+	for _, id := range sortedIDs(triggers) {
+		add(TriggerItem, id, triggers[id].Response, false)
+	}
+	for _, id := range sortedIDs(jobs) {
+		add(SchedulerItem, id, jobs[id].Action, true)
+	}
+	for _, id := range sortedIDs(snippets) {
+		add(SnippetItem, id, snippets[id].Content, false)
+	}
+	all := strings.Join(sources, "\n")
+	for _, id := range sortedIDs(resources) {
+		if r := resources[id]; !strings.Contains(all, r.Sha256Sum) {
+			issues = append(issues, LintIssue{
+				ItemType: ResourceItem,
+				ItemID:   id,
+				Severity: LintInfo,
+				Message:  fmt.Sprintf("resource %s%s is not referenced by any rule, trigger, job or snippet", r.FileName, r.Ext),
+			})
+		}
+	}
+	return issues
+}
+
+func getLintIssues(c *gin.Context) {
+	c.JSON(200, lintAll())
+}
+
+type lintRequest struct {
+	ItemType ItemType `json:"item_type"`
+	Template string   `json:"template"`
+}
+
+func lintTemplate(c *gin.Context) {
+	var req lintRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	c.JSON(200, newLinter(false).lint(req.Template, req.ItemType == SchedulerItem))
+}
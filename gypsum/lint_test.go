@@ -0,0 +1,101 @@
+package gypsum
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	useTestDB(t)
+	resources[1] = &Resource{FileName: "cat", Ext: ".png", Sha256Sum: "abc"}
+	timeout := Config.ExecutionTimeout
+	Config.ExecutionTimeout = 60
+	defer func() { Config.ExecutionTimeout = timeout }()
+	l := newLinter(false)
+
+	positives := []struct {
+		src      string
+		noEvent  bool
+		severity string
+		line     int
+		message  string
+	}{
+		{"{% if %}", false, LintError, 0, "template error"},
+		{"hello\n{{ unknwn }}", false, LintWarning, 2, "unknown variable unknwn"},
+		{"{{ evnt.user_id }}", false, LintWarning, 1, "unknown variable evnt, did you mean event?"},
+		{"{{ imag(res('abc.png')) }}", false, LintWarning, 1, "unknown function imag, did you mean image?"},
+		{"{{ url_encode() }}", false, LintError, 1, "url_encode accepts 1 arguments, but got 0"},
+		{"{{ res('dog.png') }}", false, LintWarning, 1, "no such resource dog.png"},
+		{"{{ sleep(100) }}", false, LintWarning, 1, "exceeds ExecutionTimeout"},
+		{"{{ event.message|safe }}", false, LintWarning, 1, "content from users is marked safe"},
+		{"\n{{ event.user_id }}", true, LintWarning, 2, "jobs are not triggered by events"},
+		{"{% pass %}", true, LintWarning, 1, "pass does nothing in jobs"},
+		{"{% random_choice %}a{% end_random_choice %}", false, LintInfo, 1, "random_choice has only one branch"},
+		{"{% lua %}\nlocal x =\n{% endlua %}", false, LintError, 3, "lua error"},
+		{"{% lua %}\n\nlocal m = require('nope')\n{% endlua %}", false, LintWarning, 3, "lua module nope does not exist"},
+		{"{% lua %}write(res('dog.png')){% endlua %}", false, LintWarning, 1, "no such resource dog.png"},
+	}
+	for _, c := range positives {
+		issues := l.lint(c.src, c.noEvent)
+		if len(issues) != 1 {
+			t.Errorf("lint(%q): got %+v, want one issue", c.src, issues)
+			continue
+		}
+		issue := issues[0]
+		if issue.Severity != c.severity || issue.Line != c.line || !strings.Contains(issue.Message, c.message) {
+			t.Errorf("lint(%q): got %+v, want %s at line %d containing %q", c.src, issue, c.severity, c.line, c.message)
+		}
+	}
+
+	negatives := []struct {
+		src     string
+		noEvent bool
+	}{
+		{"hello {{ at(event.user_id) }}", false},
+		{"{{ event.message }}", false},
+		{"{{ image(res('abc.png')) }}", false},
+		{"{% set x = 1 %}{{ x + 1 }}", false},
+		{"{% for i in range(3) %}{{ i }}{% endfor %}", false},
+		{"{% macro greet(name) %}hi {{ name }}{% endmacro %}{{ greet('a') }}", false},
+		{"{% random_choice %}a{% otherwise %}b{% end_random_choice %}", false},
+		{"{% lua %}local json = require('json')\nwrite(json.encode({1})){% endlua %}", false},
+		{"{% lua %}local n = {{ 1 }}{% endlua %}", false},
+		{"{{ sleep(1) }}{{ random_int(1, 6) }}", true},
+		{"{{ 'event'|upper }}", true},
+	}
+	for _, c := range negatives {
+		if issues := l.lint(c.src, c.noEvent); len(issues) != 0 {
+			t.Errorf("lint(%q): got %+v, want no issues", c.src, issues)
+		}
+	}
+}
+
+func TestLintIssuesSortedByLine(t *testing.T) {
+	useTestDB(t)
+	issues := newLinter(false).lint("{{ b }}\n{{ a }}\n{% lua %}\nlocal x =\n{% endlua %}", false)
+	lines := make([]int, len(issues))
+	for i, issue := range issues {
+		lines[i] = issue.Line
+	}
+	if len(lines) != 3 || lines[0] != 1 || lines[1] != 2 || lines[2] != 5 {
+		t.Fatalf("got issues at lines %v", lines)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"image", "image", 0},
+		{"imag", "image", 1},
+		{"evnet", "event", 2},
+		{"abc", "", 3},
+	}
+	for _, c := range cases {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package luatag
 
 import (
+	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,6 +24,9 @@ func botModLoaderFunc(event *zero.Event) lua.LGFunction {
 			"withdraw":     withdrawEventMessage(event),
 			"set_title":    setTitleToEvent(event),
 			"group_ban":    setGroupBanToEvent(event),
+			"reply":        replyToEvent(event),
+			"forward":      forwardToEvent(event),
+			"send_forward": sendGroupForwardMessage,
 		})
 		L.Push(mod)
 		return 1
@@ -304,3 +308,81 @@ func setGroupBanToEvent(event *zero.Event) lua.LGFunction {
 		return 0
 	}
 }
+
+func replyToEvent(event *zero.Event) lua.LGFunction {
+	return func(L *lua.LState) int {
+		messageID := L.Get(1)
+		if messageID != lua.LNil {
+			L.Push(lua.LString("[CQ:reply,id=" + messageID.String() + "]"))
+			return 1
+		}
+		if event == nil || event.MessageID == 0 {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("cannot reply without message"))
+			return 2
+		}
+		L.Push(lua.LString(fmt.Sprintf("[CQ:reply,id=%d]", event.MessageID)))
+		return 1
+	}
+}
+
+// forwardNodes converts lua table `{{name=, uin=, content=}, ...}` to forward message
+func forwardNodes(L *lua.LState, nodes *lua.LTable) (zeroMessage.Message, error) {
+	if nodes == nil {
+		return nil, fmt.Errorf("nodes must be a table")
+	}
+	forward := make(zeroMessage.Message, 0, nodes.Len())
+	var err error
+	nodes.ForEach(func(_ lua.LValue, v lua.LValue) {
+		node, ok := v.(*lua.LTable)
+		if !ok {
+			err = fmt.Errorf("node must be a table, not %s", v.Type().String())
+			return
+		}
+		content := L.GetField(node, "content").String()
+		if content == "" {
+			return
+		}
+		forward = append(forward, zeroMessage.CustomNode(L.GetField(node, "name").String(), L.GetField(node, "uin").String(), content))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(forward) == 0 {
+		return nil, fmt.Errorf("cannot send, all nodes are empty")
+	}
+	return forward, nil
+}
+
+func sendForward(L *lua.LState, groupID int64, nodes *lua.LTable) int {
+	forward, err := forwardNodes(L, nodes)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	result := zero.SendGroupForwardMessage(groupID, forward)
+	L.Push(lua.LNumber(result.Get("message_id").Int()))
+	return 1
+}
+
+func forwardToEvent(event *zero.Event) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if event == nil || event.GroupID == 0 {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("forward message can only be sent to group"))
+			return 2
+		}
+		return sendForward(L, event.GroupID, L.ToTable(1))
+	}
+}
+
+func sendGroupForwardMessage(L *lua.LState) int {
+	groupID := int64(L.ToNumber(1))
+	if groupID == 0 {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot send without group_id"))
+		return 2
+	}
+	return sendForward(L, groupID, L.ToTable(2))
+}
@@ -3,10 +3,13 @@ package luatag
 import (
 	"bytes"
 	"encoding/gob"
+	"math"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
 	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/template"
 )
 
 func init() {
@@ -23,60 +26,209 @@ func SetDB(newDB *leveldb.DB) {
 	db = newDB
 }
 
-func dbLoader(L *lua.LState) int {
-	mod := L.NewTable()
-	L.SetFuncs(mod, map[string]lua.LGFunction{
-		"get": dbGet,
-		"put": dbPut,
-	})
-	L.Push(mod)
-	return 1
+// sharedPrefix is the namespace accessible to all rules, and the one used before plugins had their own
+const sharedPrefix = "gypsum-userDB-lua-"
+
+// dbLoaderFunc loads `database` module, functions use the namespace of prefix,
+// while `database.shared` accesses the shared namespace
+func dbLoaderFunc(prefix []byte) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.NewTable()
+		L.SetFuncs(mod, dbFuncs(prefix))
+		shared := L.NewTable()
+		L.SetFuncs(shared, dbFuncs([]byte(sharedPrefix)))
+		L.SetField(mod, "shared", shared)
+		L.Push(mod)
+		return 1
+	}
+}
+
+func dbFuncs(prefix []byte) map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			return dbGet(L, prefix)
+		},
+		"put": func(L *lua.LState) int {
+			return dbPut(L, prefix)
+		},
+		"delete": func(L *lua.LState) int {
+			return dbDelete(L, prefix)
+		},
+		"incr": func(L *lua.LState) int {
+			return dbIncr(L, prefix)
+		},
+		"keys": func(L *lua.LState) int {
+			return dbKeys(L, prefix)
+		},
+	}
 }
 
-func dbGet(L *lua.LState) int {
-	key := L.ToString(1)
+func dbKey(prefix []byte, key string) []byte {
+	return append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+func dbGet(L *lua.LState, prefix []byte) int {
+	key := dbKey(prefix, L.ToString(1))
 	defaultValue := L.Get(2)
-	bytesKey := []byte(key)
-	bytesData, err := db.Get(append([]byte("gypsum-userDB-lua-"), bytesKey...), nil)
+	value, found, err := template.GetValue(key)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
-			L.Push(defaultValue)
+		// values stored by older versions
+		if legacy, legacyErr := dbGetLegacy(key); legacyErr == nil {
+			L.Push(legacy)
 			return 1
 		}
-		log.Error(err)
+		log.Errorf("error when reading data from database: %s", err)
 		L.Push(lua.LNil)
-		L.Push(lua.LString("database error: " + err.Error()))
+		L.Push(lua.LString("error when reading data from database: " + err.Error()))
 		return 2
 	}
+	if !found {
+		L.Push(defaultValue)
+		return 1
+	}
+	L.Push(goToLua(L, value))
+	return 1
+}
+
+func dbGetLegacy(key []byte) (lua.LValue, error) {
+	bytesData, err := db.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
 	var data *lua.LValue
 	buffer := bytes.Buffer{}
 	buffer.Write(bytesData)
 	decoder := gob.NewDecoder(&buffer)
 	if err := decoder.Decode(&data); err != nil {
-		log.Errorf("error when reading data from database: %s", err)
-		L.Push(lua.LNil)
-		L.Push(lua.LString("error when reading data from database: " + err.Error()))
-		return 2
+		return nil, err
 	}
-	L.Push(*data)
-	return 1
+	return *data, nil
 }
 
-func dbPut(L *lua.LState) int {
-	key := L.ToString(1)
+// dbPut stores value with an optional ttl in seconds, storing nil deletes the key
+func dbPut(L *lua.LState, prefix []byte) int {
+	key := dbKey(prefix, L.ToString(1))
 	value := L.Get(2)
-	bytesKey := []byte(key)
-	buffer := bytes.Buffer{}
-	encoder := gob.NewEncoder(&buffer)
-	if err := encoder.Encode(&value); err != nil {
-		log.Errorf("error when encode valueStore as bytes: %s", err)
-		L.Push(lua.LString("error when encode valueStore as bytes: " + err.Error()))
-		return 1
+	ttl := L.OptInt64(3, 0)
+	var err error
+	if value == lua.LNil {
+		err = template.DeleteValue(key)
+	} else {
+		err = template.PutValue(key, luaToGo(value), ttl)
 	}
-	if err := db.Put(append([]byte("gypsum-userDB-lua-"), bytesKey...), buffer.Bytes(), nil); err != nil {
+	if err != nil {
 		log.Errorf("error when put value to database: %s", err)
 		L.Push(lua.LString("error when put value to database: " + err.Error()))
 		return 1
 	}
 	return 0
 }
+
+func dbDelete(L *lua.LState, prefix []byte) int {
+	if err := template.DeleteValue(dbKey(prefix, L.ToString(1))); err != nil {
+		log.Errorf("error when delete value from database: %s", err)
+		L.Push(lua.LString("error when delete value from database: " + err.Error()))
+		return 1
+	}
+	return 0
+}
+
+// dbIncr adds delta (1 by default) to the number atomically, returns the result
+func dbIncr(L *lua.LState, prefix []byte) int {
+	key := dbKey(prefix, L.ToString(1))
+	delta := L.OptNumber(2, 1)
+	value, err := template.IncrValue(key, luaToGo(delta))
+	if err != nil {
+		log.Errorf("error when increase value in database: %s", err)
+		L.Push(lua.LNil)
+		L.Push(lua.LString("error when increase value in database: " + err.Error()))
+		return 2
+	}
+	L.Push(goToLua(L, value))
+	return 1
+}
+
+func dbKeys(L *lua.LState, prefix []byte) int {
+	keyPrefix := L.OptString(1, "")
+	keys, err := template.ListKeys(dbKey(prefix, keyPrefix))
+	if err != nil {
+		log.Errorf("error when list keys in database: %s", err)
+		L.Push(lua.LNil)
+		L.Push(lua.LString("error when list keys in database: " + err.Error()))
+		return 2
+	}
+	list := L.NewTable()
+	for _, key := range keys {
+		list.Append(lua.LString(keyPrefix + key))
+	}
+	L.Push(list)
+	return 1
+}
+
+// luaToGo converts lua values to values that can be stored,
+// tables with only sequential integer keys become lists, other tables become maps
+func luaToGo(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 {
+			list := make([]interface{}, 0, n)
+			isList := true
+			v.ForEach(func(k, _ lua.LValue) {
+				if _, ok := k.(lua.LNumber); !ok {
+					isList = false
+				}
+			})
+			if isList {
+				for i := 1; i <= n; i++ {
+					list = append(list, luaToGo(v.RawGetInt(i)))
+				}
+				return list
+			}
+		}
+		m := make(map[string]interface{})
+		v.ForEach(func(k, item lua.LValue) {
+			m[k.String()] = luaToGo(item)
+		})
+		return m
+	default:
+		return nil
+	}
+}
+
+func goToLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range v {
+			t.Append(goToLua(L, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, item := range v {
+			L.SetField(t, k, goToLua(L, item))
+		}
+		return t
+	default:
+		return lua.LNil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"reflect"
 	"time"
 
 	"github.com/cjoudrey/gluahttp"
@@ -13,12 +14,17 @@ import (
 	zero "github.com/wdvxdr1123/ZeroBot"
 	"github.com/yuin/gopher-lua"
 	luaJson "layeh.com/gopher-json"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 type tagLuaNode struct {
 	wrapper *pongo2.NodeWrapper
 }
 
+// LuaNodeType is the type of nodes compiled from `lua`, the code in them may call `pass`
+var LuaNodeType = reflect.TypeOf(&tagLuaNode{})
+
 func (node tagLuaNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
 	b := bytes.NewBuffer(make([]byte, 0, 1024)) // 1 KiB
 	if err := node.wrapper.Execute(ctx, b); err != nil {
@@ -38,9 +44,29 @@ func (node tagLuaNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.Templ
 		}
 
 		L.PreloadModule("bot", botModLoaderFunc(metaEvent))
-		L.PreloadModule("database", dbLoader)
+		dbPrefix := []byte(sharedPrefix)
+		if namespace, ok := ctx.Public["_db"].([]byte); ok {
+			dbPrefix = dbKey(namespace, "lua-")
+		}
+		L.PreloadModule("database", dbLoaderFunc(dbPrefix))
+		if varsPrefix, ok := ctx.Public["_vars"].([]byte); ok {
+			L.PreloadModule("vars", varsLoaderFunc(varsPrefix, metaEvent))
+		}
 		L.PreloadModule("json", luaJson.Loader)
-		L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+		L.PreloadModule("random", randomLoader)
+		box, ok := ctx.Public["_sandbox"].(*sandbox.Sandbox)
+		if !ok {
+			box = defaultSandbox
+		}
+		restrictFiles(L, box)
+		client := box.Client()
+		L.PreloadModule("http", gluahttp.NewHttpModuleWithDo(func(req *http.Request) (*http.Response, error) {
+			// requests are cancelled with the execution
+			if execCtx := L.Context(); execCtx != nil {
+				req = req.WithContext(execCtx)
+			}
+			return client.Do(req)
+		}).Loader)
 		var luaEvent lua.LValue
 		event, ok := ctx.Public["json_event"]
 		if !ok {
@@ -74,17 +100,44 @@ func (node tagLuaNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.Templ
 				}
 			}
 		}
+		luaParam := L.NewTable()
+		if param, ok := ctx.Public["param"].(map[string]interface{}); ok {
+			for k, i := range param {
+				switch v := i.(type) {
+				case string:
+					L.SetField(luaParam, k, lua.LString(v))
+				case int64:
+					L.SetField(luaParam, k, lua.LNumber(v))
+				case []int64:
+					list := L.NewTable()
+					for _, id := range v {
+						list.Append(lua.LNumber(id))
+					}
+					L.SetField(luaParam, k, list)
+				default:
+					log.Warnf("unknown type in param: %#v", v)
+				}
+			}
+		}
 		L.SetGlobal("write", L.NewFunction(Writer(writer, false)))
 		L.SetGlobal("write_safe", L.NewFunction(Writer(writer, true)))
 		L.SetGlobal("sleep", L.NewFunction(luaSleep))
 		L.SetGlobal("res", L.NewFunction(resFunc))
+		L.SetGlobal("text_image", L.NewFunction(luaTextImage))
+		passed, _ := ctx.Public["_pass"].(*bool)
+		L.SetGlobal("pass", L.NewFunction(luaPass(passed)))
 		L.SetGlobal("event", luaEvent)
 		L.SetGlobal("state", luaState)
+		L.SetGlobal("param", luaParam)
 		ctx.Public["_lua"] = L
 	}
-	timeoutContext, cancel := context.WithTimeout(context.Background(), 300*time.Second)
-	defer cancel()
-	L.SetContext(timeoutContext)
+	if execCtx, ok := ctx.Public["_ctx"].(context.Context); ok {
+		L.SetContext(execCtx)
+	} else {
+		timeoutContext, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+		defer cancel()
+		L.SetContext(timeoutContext)
+	}
 	if err := L.DoString(s); err != nil {
 		return ctx.Error(fmt.Sprintf("lua execution error: %s", err), nil)
 	}
@@ -0,0 +1,47 @@
+package luatag
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// modules can be loaded with `require`, standard libraries are loaded already and can be required as well
+var modules = map[string]bool{
+	"bot": true, "database": true, "vars": true, "json": true, "random": true, "http": true,
+	"string": true, "table": true, "math": true, "os": true, "io": true, "coroutine": true,
+	"channel": true, "debug": true, "package": true,
+}
+
+// ModuleExists reports whether `require(name)` can find the module
+func ModuleExists(name string) bool {
+	return modules[name]
+}
+
+// CheckSyntax compiles lua code without running it,
+// line is the line of error starting from 1, or 0 if the error is at the end of code
+func CheckSyntax(source string) (line int, message string, ok bool) {
+	chunk, err := parse.Parse(strings.NewReader(source), "<lua>")
+	if err != nil {
+		if e, isParseErr := err.(*parse.Error); isParseErr {
+			message := e.Message
+			if e.Token != "" {
+				message = fmt.Sprintf("%s near '%s'", e.Message, e.Token)
+			}
+			if e.Pos.Line == parse.EOF {
+				return 0, message, false
+			}
+			return e.Pos.Line, message, false
+		}
+		return 0, err.Error(), false
+	}
+	if _, err := lua.Compile(chunk, "<lua>"); err != nil {
+		if e, isCompileErr := err.(*lua.CompileError); isCompileErr {
+			return e.Line, e.Message, false
+		}
+		return 0, err.Error(), false
+	}
+	return 0, "", true
+}
@@ -0,0 +1,120 @@
+package luatag
+
+import (
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// randomLoader loads `random` module, `random.seed(...)` returns a table of the same functions
+// whose results are the same as templates' `rng(...)` with the same keys
+func randomLoader(L *lua.LState) int {
+	mod := L.NewTable()
+	L.SetFuncs(mod, randomFuncs(nil))
+	L.SetField(mod, "seed", L.NewFunction(func(L *lua.LState) int {
+		keys := make([]interface{}, L.GetTop())
+		for i := range keys {
+			keys[i] = luaToGo(L.Get(i + 1))
+		}
+		t := L.NewTable()
+		L.SetFuncs(t, randomFuncs(template.SeededRandom(keys...)))
+		L.Push(t)
+		return 1
+	}))
+	L.Push(mod)
+	return 1
+}
+
+// randomFuncs returns functions using r, or unseeded functions if r is nil
+func randomFuncs(r *template.Random) map[string]lua.LGFunction {
+	random := func() *template.Random {
+		if r == nil {
+			return template.NewRandom()
+		}
+		return r
+	}
+	return map[string]lua.LGFunction{
+		"int": func(L *lua.LState) int {
+			min, max := 0, 99
+			switch L.GetTop() {
+			case 0:
+			case 1:
+				max = L.CheckInt(1)
+			default:
+				min, max = L.CheckInt(1), L.CheckInt(2)
+			}
+			L.Push(lua.LNumber(random().Int(min, max)))
+			return 1
+		},
+		"float": func(L *lua.LState) int {
+			L.Push(lua.LNumber(random().Float()))
+			return 1
+		},
+		"choice": func(L *lua.LState) int {
+			choice := random().Choice(luaList(L.CheckTable(1)))
+			if choice == nil {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(choice.(lua.LValue))
+			}
+			return 1
+		},
+		"weighted_choice": func(L *lua.LState) int {
+			list := luaList(L.CheckTable(1))
+			weightList := luaList(L.CheckTable(2))
+			weights := make([]float64, len(weightList))
+			for i, w := range weightList {
+				n, ok := w.(lua.LNumber)
+				if !ok {
+					L.ArgError(2, "weights should be numbers")
+					return 0
+				}
+				weights[i] = float64(n)
+			}
+			choice, err := random().WeightedChoice(list, weights)
+			if err != nil {
+				L.ArgError(2, err.Error())
+				return 0
+			}
+			if choice == nil {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(choice.(lua.LValue))
+			}
+			return 1
+		},
+		"shuffle": func(L *lua.LState) int {
+			t := L.NewTable()
+			for _, item := range random().Shuffle(luaList(L.CheckTable(1))) {
+				t.Append(item.(lua.LValue))
+			}
+			L.Push(t)
+			return 1
+		},
+		"line": func(L *lua.LState) int {
+			L.Push(lua.LString(random().Line(L.CheckString(1))))
+			return 1
+		},
+		"dice": func(L *lua.LState) int {
+			result, err := random().Dice(L.CheckString(1))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(result.Total))
+			L.Push(lua.LString(result.Text))
+			return 2
+		},
+	}
+}
+
+// luaList reads the sequence part of table
+func luaList(t *lua.LTable) []interface{} {
+	n := t.Len()
+	list := make([]interface{}, n)
+	for i := range list {
+		list[i] = t.RawGetInt(i + 1)
+	}
+	return list
+}
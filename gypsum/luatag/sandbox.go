@@ -0,0 +1,83 @@
+package luatag
+
+import (
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+)
+
+var defaultSandbox *sandbox.Sandbox
+
+// SetDefaultSandbox sets the sandbox of lua outside of plugins
+func SetDefaultSandbox(box *sandbox.Sandbox) {
+	defaultSandbox = box
+}
+
+// restrictFiles makes files outside of the sandbox unreachable,
+// files in sandbox are read-only, commands and environment variables are unreachable.
+func restrictFiles(L *lua.LState, box *sandbox.Sandbox) {
+	base := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	checkPathArg(L, base, "dofile", box, nil)
+	checkPathArg(L, base, "loadfile", box, nil)
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		checkPathArg(L, io, "open", box, func(L *lua.LState) {
+			mode := L.OptString(2, "r")
+			if !strings.HasPrefix(mode, "r") || strings.Contains(mode, "+") {
+				L.RaiseError("files can only be opened in read mode")
+			}
+		})
+		checkPathArg(L, io, "lines", box, nil)
+		checkPathArg(L, io, "input", box, nil)
+		checkPathArg(L, io, "output", box, func(L *lua.LState) {
+			if L.Get(1).Type() == lua.LTString {
+				L.RaiseError("files can only be opened in read mode")
+			}
+		})
+		for _, name := range []string{"popen", "tmpfile"} {
+			L.SetField(io, name, lua.LNil)
+		}
+	}
+	if os, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		for _, name := range []string{"execute", "exit", "getenv", "setenv", "remove", "rename", "tmpname"} {
+			L.SetField(os, name, lua.LNil)
+		}
+	}
+	if pkg, ok := L.GetGlobal("package").(*lua.LTable); ok {
+		// `require` finds modules in sandbox only
+		paths := make([]string, len(box.BaseDirs()))
+		for i, dir := range box.BaseDirs() {
+			paths[i] = filepath.Join(dir, "?.lua")
+		}
+		L.SetField(pkg, "path", lua.LString(strings.Join(paths, ";")))
+		L.SetField(pkg, "cpath", lua.LString(""))
+	}
+}
+
+// checkPathArg wraps the function so that its first argument, if it is a string or a number, must be a path in sandbox.
+// numbers are checked as well, since lua functions convert them to strings.
+// the original function is called with the resolved path, so a symlink changed after the check is not followed.
+func checkPathArg(L *lua.LState, table *lua.LTable, name string, box *sandbox.Sandbox, check func(L *lua.LState)) {
+	original, ok := L.GetField(table, name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	L.SetField(table, name, L.NewFunction(func(L *lua.LState) int {
+		if check != nil {
+			check(L)
+		}
+		if arg := L.Get(1); arg.Type() == lua.LTString || arg.Type() == lua.LTNumber {
+			path, err := box.Path(lua.LVAsString(arg))
+			if err != nil {
+				L.RaiseError("%s: %s", name, err)
+			}
+			L.Replace(1, lua.LString(path))
+		}
+		top := L.GetTop()
+		L.Insert(original, 1)
+		L.Call(top, lua.MultRet)
+		return L.GetTop()
+	}))
+}
@@ -5,6 +5,8 @@ import (
 
 	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
 	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/template"
 )
 
 func Writer(w interface{ WriteString(string) (int, error) }, safe bool) func(*lua.LState) int {
@@ -28,9 +30,46 @@ func Writer(w interface{ WriteString(string) (int, error) }, safe bool) func(*lu
 	}
 }
 
+// luaTextImage renders text into an image and returns its CQ code, or nil and error message
+func luaTextImage(L *lua.LState) int {
+	text := L.CheckString(1)
+	var options interface{}
+	if table, ok := L.Get(2).(*lua.LTable); ok {
+		options = luaToGo(table)
+	}
+	code, err := template.TextImageCode(text, options, false)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(code))
+	return 1
+}
+
+// luaPass is the same as `{% pass %}`, it does nothing if the execution cannot pass
+func luaPass(passed *bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if passed != nil {
+			*passed = true
+		}
+		return 0
+	}
+}
+
 func luaSleep(L *lua.LState) int {
 	arg := L.ToNumber(1)
 	duration := time.Duration(float64(arg) * float64(time.Second))
-	time.Sleep(duration)
+	ctx := L.Context()
+	if ctx == nil {
+		time.Sleep(duration)
+		return 0
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
 	return 0
 }
@@ -0,0 +1,53 @@
+package luatag
+
+import (
+	zero "github.com/wdvxdr1123/ZeroBot"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// varsLoaderFunc loads `vars` module, the variables are shared with templates.
+// `vars.user`, `vars.group` and `vars.member` are nil if the event does not have the scope
+func varsLoaderFunc(prefix []byte, event *zero.Event) lua.LGFunction {
+	return func(L *lua.LState) int {
+		scope := func(s []byte) *lua.LTable {
+			t := L.NewTable()
+			L.SetFuncs(t, dbFuncs(dbKey(prefix, string(s))))
+			return t
+		}
+		var userID, groupID int64
+		if event != nil {
+			userID, groupID = event.UserID, event.GroupID
+		}
+		mod := L.NewTable()
+		if userID != 0 {
+			L.SetField(mod, "user", scope(template.UserScope(userID)))
+		}
+		if groupID != 0 {
+			L.SetField(mod, "group", scope(template.GroupScope(groupID)))
+		}
+		if userID != 0 && groupID != 0 {
+			L.SetField(mod, "member", scope(template.MemberScope(groupID, userID)))
+		}
+		L.SetField(mod, "of_user", L.NewFunction(func(L *lua.LState) int {
+			L.Push(scope(template.UserScope(L.CheckInt64(1))))
+			return 1
+		}))
+		L.SetField(mod, "of_group", L.NewFunction(func(L *lua.LState) int {
+			L.Push(scope(template.GroupScope(L.CheckInt64(1))))
+			return 1
+		}))
+		L.SetField(mod, "of_member", L.NewFunction(func(L *lua.LState) int {
+			group := L.OptInt64(2, groupID)
+			if group == 0 {
+				L.ArgError(2, "no group id is given and the event is not in a group")
+				return 0
+			}
+			L.Push(scope(template.MemberScope(group, L.CheckInt64(1))))
+			return 1
+		}))
+		L.Push(mod)
+		return 1
+	}
+}
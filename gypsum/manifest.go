@@ -0,0 +1,474 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// ManifestSchemaVersion is the version of plugin manifest layout,
+// it should be increased when the manifest is changed incompatibly
+const ManifestSchemaVersion = 1
+
+const (
+	manifestFileName       = "gypsum-plugin.json"
+	legacyManifestFileName = "gypsum-plugin.dat"
+	templatesDir           = "templates"
+)
+
+var (
+	errNoManifest        = errors.New("zipfile has no gypsum metadata")
+	errUnsupportedSchema = errors.New("unsupported manifest schema version")
+)
+
+// Manifest is the human-readable description of a plugin, saved as gypsum-plugin.json in plugin archive.
+// templates of rules, triggers, jobs and snippets are saved as separate files beside it.
+type Manifest struct {
+	SchemaVersion int    `json:"schema_version"`
+	GypsumVersion string `json:"gypsum_version"`
+	GypsumCommit  string `json:"gypsum_commit"`
+	Description   string `json:"description,omitempty"`
+	ManifestGroup
+}
+
+type ManifestGroup struct {
+	DisplayName   string         `json:"display_name"`
+	PluginName    string         `json:"plugin_name"`
+	PluginVersion int64          `json:"plugin_version"`
+	Parameters    []Parameter    `json:"parameters,omitempty"`
+	Items         []ManifestItem `json:"items"`
+	// values of parameters are given by user when importing, and never exported
+	parameterValues map[string]string
+}
+
+// ManifestItem holds exactly one of Rule, Trigger, Job, Resource, Snippet and Group according to ItemType.
+// Template is the path of template file in archive, if it is empty, the inline template is used.
+type ManifestItem struct {
+	ItemType    ItemType       `json:"item_type"`
+	DisplayName string         `json:"display_name"`
+	Template    string         `json:"template,omitempty"`
+	Rule        *Rule          `json:"rule,omitempty"`
+	Trigger     *Trigger       `json:"trigger,omitempty"`
+	Job         *Job           `json:"job,omitempty"`
+	Resource    *Resource      `json:"resource,omitempty"`
+	Snippet     *Snippet       `json:"snippet,omitempty"`
+	Group       *ManifestGroup `json:"group,omitempty"`
+}
+
+func (mi *ManifestItem) record() (UserRecord, bool) {
+	switch mi.ItemType {
+	case RuleItem:
+		return mi.Rule, mi.Rule != nil
+	case TriggerItem:
+		return mi.Trigger, mi.Trigger != nil
+	case SchedulerItem:
+		return mi.Job, mi.Job != nil
+	case ResourceItem:
+		return mi.Resource, mi.Resource != nil
+	case SnippetItem:
+		return mi.Snippet, mi.Snippet != nil
+	default:
+		return nil, false
+	}
+}
+
+func (mi *ManifestItem) setRecord(record UserRecord) {
+	switch r := record.(type) {
+	case *Rule:
+		mi.Rule = r
+	case *Trigger:
+		mi.Trigger = r
+	case *Job:
+		mi.Job = r
+	case *Resource:
+		mi.Resource = r
+	case *Snippet:
+		mi.Snippet = r
+	}
+}
+
+// templatePointer returns the field holding template of the item, or nil if the item has no template
+func (mi *ManifestItem) templatePointer() *string {
+	switch {
+	case mi.Rule != nil:
+		return &mi.Rule.Response
+	case mi.Trigger != nil:
+		return &mi.Trigger.Response
+	case mi.Job != nil:
+		return &mi.Job.Action
+	case mi.Snippet != nil:
+		return &mi.Snippet.Content
+	default:
+		return nil
+	}
+}
+
+func manifestEntryName(index int, displayName string) string {
+	return fmt.Sprintf("%02d-%s", index+1, helper.ReplaceFilename(displayName, "_"))
+}
+
+// toManifestGroup copies items of the group, templates are moved into templateFiles keyed by their path
+func (g *Group) toManifestGroup(name string, version int64, templateDir string, templateFiles map[string]string) ManifestGroup {
+	mg := ManifestGroup{
+		DisplayName:   g.DisplayName,
+		PluginName:    name,
+		PluginVersion: version,
+		Parameters:    g.Parameters,
+		Items:         make([]ManifestItem, 0, len(g.Items)),
+	}
+	for i, item := range g.Items {
+		mi := ManifestItem{
+			ItemType:    item.ItemType,
+			DisplayName: item.DisplayName,
+		}
+		switch item.ItemType {
+		case GroupItem:
+			subGroup, ok := groups[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			subManifest := subGroup.toManifestGroup(subGroup.PluginName, subGroup.PluginVersion, path.Join(templateDir, manifestEntryName(i, item.DisplayName)), templateFiles)
+			mi.Group = &subManifest
+		case RuleItem:
+			r, ok := rules[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			rule := *r
+			mi.Rule = &rule
+		case TriggerItem:
+			t, ok := triggers[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			trigger := *t
+			mi.Trigger = &trigger
+		case SchedulerItem:
+			j, ok := jobs[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			job := *j
+			mi.Job = &job
+		case ResourceItem:
+			r, ok := resources[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			resource := *r
+			mi.Resource = &resource
+		case SnippetItem:
+			s, ok := snippets[item.ItemID]
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			snippet := *s
+			mi.Snippet = &snippet
+		default:
+			log.Warnf("unknown type: %s", item.ItemType)
+			continue
+		}
+		if tmpl := mi.templatePointer(); tmpl != nil {
+			mi.Template = path.Join(templateDir, manifestEntryName(i, item.DisplayName)+".tmpl")
+			templateFiles[mi.Template] = *tmpl
+			*tmpl = ""
+		}
+		mg.Items = append(mg.Items, mi)
+	}
+	return mg
+}
+
+// writeManifestArchive writes manifest and templates of the group into plugin zipfile, resources are not included
+func writeManifestArchive(zipWriter archiveWriter, g *Group, name string, version int64, description string) error {
+	templateFiles := make(map[string]string)
+	manifest := Manifest{
+		SchemaVersion: ManifestSchemaVersion,
+		GypsumVersion: BuildVersion,
+		GypsumCommit:  BuildCommit,
+		Description:   description,
+		ManifestGroup: g.toManifestGroup(name, version, templatesDir, templateFiles),
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := zipWriter.Create(manifestFileName)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(manifestBytes); err != nil {
+		return err
+	}
+	// keep files in stable order, so that archives of same plugin can be compared
+	fileNames := make([]string, 0, len(templateFiles))
+	for fileName := range templateFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		f, err := zipWriter.Create(fileName)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, templateFiles[fileName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readManifest reads manifest from plugin zipfile, archives of legacy gob format are converted to manifest
+func readManifest(files map[string]*zip.File) (*Manifest, error) {
+	if f, ok := files[manifestFileName]; ok {
+		fr, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer fr.Close()
+		manifest := &Manifest{}
+		if err := json.NewDecoder(fr).Decode(manifest); err != nil {
+			return nil, err
+		}
+		if manifest.SchemaVersion < 1 || manifest.SchemaVersion > ManifestSchemaVersion {
+			return nil, fmt.Errorf("%w: %d, this gypsum supports up to %d", errUnsupportedSchema, manifest.SchemaVersion, ManifestSchemaVersion)
+		}
+		if err := manifest.loadTemplates(files); err != nil {
+			return nil, err
+		}
+		return manifest, nil
+	}
+	if f, ok := files[legacyManifestFileName]; ok {
+		fr, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer fr.Close()
+		ga := &GroupArchive{}
+		if err := gob.NewDecoder(fr).Decode(ga); err != nil {
+			return nil, err
+		}
+		return &Manifest{
+			SchemaVersion: 0,
+			GypsumVersion: ga.GypsumVersion,
+			GypsumCommit:  ga.GypsumCommit,
+			ManifestGroup: ga.toManifestGroup(),
+		}, nil
+	}
+	return nil, errNoManifest
+}
+
+func (mg *ManifestGroup) loadTemplates(files map[string]*zip.File) error {
+	for i := range mg.Items {
+		item := &mg.Items[i]
+		if item.ItemType == GroupItem {
+			if item.Group == nil {
+				return fmt.Errorf("group item %s has no content", item.DisplayName)
+			}
+			if err := item.Group.loadTemplates(files); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := item.record(); !ok {
+			return fmt.Errorf("%s item %s has no content", item.ItemType, item.DisplayName)
+		}
+		if item.Template == "" {
+			continue
+		}
+		tmpl := item.templatePointer()
+		if tmpl == nil {
+			return fmt.Errorf("%s item %s cannot have template", item.ItemType, item.DisplayName)
+		}
+		f, ok := files[item.Template]
+		if !ok {
+			return fmt.Errorf("template file not found: %s", item.Template)
+		}
+		fr, err := f.Open()
+		if err != nil {
+			return err
+		}
+		content := new(strings.Builder)
+		_, err = io.Copy(content, fr)
+		_ = fr.Close()
+		if err != nil {
+			return err
+		}
+		*tmpl = content.String()
+	}
+	return nil
+}
+
+func (ga *GroupArchive) toManifestGroup() ManifestGroup {
+	mg := ManifestGroup{
+		DisplayName:   ga.DisplayName,
+		PluginName:    ga.PluginName,
+		PluginVersion: ga.PluginVersion,
+		Items:         make([]ManifestItem, 0, len(ga.ArchiveItems)),
+	}
+	for _, item := range ga.ArchiveItems {
+		mi := ManifestItem{
+			ItemType:    item.ItemType,
+			DisplayName: item.DisplayName,
+		}
+		if item.ItemType == GroupItem {
+			subArchive, err := GroupArchiveFromBytes(item.ItemBytes)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			subManifest := subArchive.toManifestGroup()
+			mi.Group = &subManifest
+		} else {
+			record, err := UserRecordFromBytes(item.ItemType, item.ItemBytes)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			mi.setRecord(record)
+		}
+		mg.Items = append(mg.Items, mi)
+	}
+	return mg
+}
+
+// checkTemplates compiles all templates in manifest without installing it,
+// snippets in manifest are used before installed ones
+func (mg *ManifestGroup) checkTemplates() error {
+	manifestSnippets := make(map[string]string)
+	mg.collectSnippets(manifestSnippets)
+	set := pongo2.NewSet("upgrade-check", manifestSnippetLoader{snippets: manifestSnippets})
+	set.Globals = pongo2.Globals
+	return mg.checkTemplatesWith(set, "")
+}
+
+func (mg *ManifestGroup) collectSnippets(snippets map[string]string) {
+	for _, item := range mg.Items {
+		switch {
+		case item.ItemType == SnippetItem && item.Snippet != nil:
+			if _, ok := snippets[item.Snippet.Name]; !ok {
+				snippets[item.Snippet.Name] = item.Snippet.Content
+			}
+		case item.ItemType == GroupItem && item.Group != nil:
+			item.Group.collectSnippets(snippets)
+		}
+	}
+}
+
+func (mg *ManifestGroup) checkTemplatesWith(set *pongo2.TemplateSet, prefix string) error {
+	for _, item := range mg.Items {
+		path := prefix + "/" + item.DisplayName
+		var err error
+		switch {
+		case item.ItemType == RuleItem && item.Rule != nil:
+			if item.Rule.MatcherType == Regex && len(item.Rule.Patterns) != 0 {
+				err = checkRegex(item.Rule.Patterns[0])
+			}
+			if err == nil {
+				_, err = set.FromString(item.Rule.Response)
+			}
+		case item.ItemType == TriggerItem && item.Trigger != nil:
+			_, err = set.FromString(item.Trigger.Response)
+		case item.ItemType == SchedulerItem && item.Job != nil:
+			if _, err = cron.ParseStandard(item.Job.CronSpec); err == nil {
+				_, err = set.FromString(item.Job.Action)
+			}
+		case item.ItemType == SnippetItem && item.Snippet != nil:
+			_, err = set.FromString(item.Snippet.Content)
+		case item.ItemType == GroupItem && item.Group != nil:
+			err = item.Group.checkTemplatesWith(set, path)
+			if err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// restore saves all items in manifest (including sub groups) into database, and returns the group itself,
+// the returned group is not saved, caller should register it to parent group.
+func (mg *ManifestGroup) restore(newGroupID uint64) *Group {
+	g := &Group{
+		DisplayName:     mg.DisplayName,
+		PluginName:      mg.PluginName,
+		PluginVersion:   mg.PluginVersion,
+		Items:           make([]Item, 0, len(mg.Items)),
+		ParentGroup:     0,
+		Parameters:      mg.Parameters,
+		ParameterValues: mg.parameterValues,
+	}
+	restored := make([]*Item, len(mg.Items))
+	// snippets are restored first, so that templates using them can be compiled
+	for _, snippetsFirst := range []bool{true, false} {
+		for i, item := range mg.Items {
+			if (item.ItemType == SnippetItem) != snippetsFirst {
+				continue
+			}
+			var idx uint64
+			var sum string
+			var err error
+			if item.ItemType == GroupItem {
+				idx, err = item.Group.restoreAsChild(newGroupID)
+			} else {
+				record, ok := item.record()
+				if !ok {
+					log.Warnf("unknown type: %s", item.ItemType)
+					continue
+				}
+				sum = recordSum(record)
+				idx, err = restoreUserRecord(record, newGroupID)
+			}
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			restored[i] = &Item{
+				ItemType:     item.ItemType,
+				DisplayName:  item.DisplayName,
+				ItemID:       idx,
+				InstalledSum: sum,
+			}
+		}
+	}
+	for _, item := range restored {
+		if item != nil {
+			g.Items = append(g.Items, *item)
+		}
+	}
+	return g
+}
+
+func (mg *ManifestGroup) restoreAsChild(parentID uint64) (uint64, error) {
+	itemCursor++
+	cursor := itemCursor
+	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
+		return 0, err
+	}
+	group := mg.restore(cursor)
+	group.ParentGroup = parentID
+	groups[cursor] = group
+	if err := group.SaveToDB(cursor); err != nil {
+		return 0, err
+	}
+	return cursor, nil
+}
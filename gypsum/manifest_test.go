@@ -0,0 +1,247 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// useTestDB loads empty data from a database in a temporary directory
+func useTestDB(t *testing.T) {
+	initTestTemplating()
+	if Config == nil {
+		Config = &ConfigType{}
+	}
+	var err error
+	if db, err = leveldb.OpenFile(t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	itemCursor = 0
+	loadGroups()
+	loadSnippets()
+	loadRules()
+	loadTriggers()
+	loadJobs()
+	resources = make(map[uint64]*Resource)
+}
+
+// addTestItem adds the record into group like the api does
+func addTestItem(t *testing.T, groupID uint64, itemType ItemType, displayName string, record UserRecord) uint64 {
+	id, err := restoreUserRecord(record, groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups[groupID].Items = append(groups[groupID].Items, Item{ItemType: itemType, DisplayName: displayName, ItemID: id})
+	return id
+}
+
+// addTestGroup adds an empty group into parent
+func addTestGroup(t *testing.T, parentID uint64, displayName string) uint64 {
+	itemCursor++
+	groups[itemCursor] = &Group{DisplayName: displayName, Items: []Item{}, ParentGroup: parentID}
+	groups[parentID].Items = append(groups[parentID].Items, Item{ItemType: GroupItem, DisplayName: displayName, ItemID: itemCursor})
+	return itemCursor
+}
+
+// newTestPlugin builds a plugin group with every kind of items that have templates
+func newTestPlugin(t *testing.T) uint64 {
+	pluginID := addTestGroup(t, 0, "greeting")
+	addTestItem(t, pluginID, SnippetItem, "footer", &Snippet{DisplayName: "footer", Name: "footer", Content: "-- {{ 1|add:1 }}"})
+	addTestItem(t, pluginID, RuleItem, "hello", &Rule{
+		DisplayName: "hello",
+		Active:      true,
+		MessageType: MessageType(3),
+		MatcherType: Keyword,
+		Patterns:    []string{"hello"},
+		Response:    `hello{% include "snippets/footer" %}`,
+		Priority:    50,
+		Block:       true,
+	})
+	addTestItem(t, pluginID, TriggerItem, "welcome", &Trigger{
+		DisplayName: "welcome",
+		Active:      true,
+		TriggerType: []string{"group_increase"},
+		Response:    "welcome {{ event.user_id }}",
+	})
+	subID := addTestGroup(t, pluginID, "night")
+	addTestItem(t, subID, SchedulerItem, "good night", &Job{
+		DisplayName: "good night",
+		Active:      false,
+		GroupsID:    []int64{123},
+		CronSpec:    "0 22 * * *",
+		Action:      "good night",
+	})
+	return pluginID
+}
+
+func zipFiles(t *testing.T, write func(w *zip.Writer) error) map[string]*zip.File {
+	buffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buffer)
+	if err := write(zipWriter); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]*zip.File, len(zipReader.File))
+	for _, file := range zipReader.File {
+		files[file.Name] = file
+	}
+	return files
+}
+
+// checkRestored compares items of the restored group with the original group, ignoring ids
+func checkRestored(t *testing.T, original, restored *Group) {
+	if restored.DisplayName != original.DisplayName || len(restored.Items) != len(original.Items) {
+		t.Fatalf("restored group %q has %d items, want %q with %d items", restored.DisplayName, len(restored.Items), original.DisplayName, len(original.Items))
+	}
+	for i, item := range original.Items {
+		got := restored.Items[i]
+		if got.ItemType != item.ItemType || got.DisplayName != item.DisplayName {
+			t.Fatalf("item %d: got %s %q, want %s %q", i, got.ItemType, got.DisplayName, item.ItemType, item.DisplayName)
+		}
+		if got.ItemID == item.ItemID {
+			t.Fatalf("item %q is not restored as a new item", item.DisplayName)
+		}
+		if item.ItemType == GroupItem {
+			checkRestored(t, groups[item.ItemID], groups[got.ItemID])
+			continue
+		}
+		want, _ := findItem(item.ItemType, item.ItemID)
+		record, ok := findItem(got.ItemType, got.ItemID)
+		if !ok {
+			t.Fatalf("restored item %q is not saved", got.DisplayName)
+		}
+		wantCopy := reflect.ValueOf(want).Elem()
+		gotCopy := reflect.ValueOf(record).Elem()
+		for f := 0; f < wantCopy.NumField(); f++ {
+			if wantCopy.Type().Field(f).Name == "ParentGroup" {
+				continue
+			}
+			if wantCopy.Field(f).Kind() == reflect.Slice && wantCopy.Field(f).Len() == 0 && gotCopy.Field(f).Len() == 0 {
+				// gob does not tell nil from empty
+				continue
+			}
+			if !reflect.DeepEqual(wantCopy.Field(f).Interface(), gotCopy.Field(f).Interface()) {
+				t.Fatalf("item %q field %s: got %#v, want %#v", item.DisplayName, wantCopy.Type().Field(f).Name,
+					gotCopy.Field(f).Interface(), wantCopy.Field(f).Interface())
+			}
+		}
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	useTestDB(t)
+	pluginID := newTestPlugin(t)
+	files := zipFiles(t, func(w *zip.Writer) error {
+		return writeManifestArchive(w, groups[pluginID], "greeting", 3, "says hello")
+	})
+	if _, ok := files[manifestFileName]; !ok {
+		t.Fatalf("archive has no %s", manifestFileName)
+	}
+	if _, ok := files["templates/02-hello.tmpl"]; !ok {
+		t.Fatalf("template of rule is not saved as a file, files: %v", files)
+	}
+	if _, ok := files["templates/04-night/01-good_night.tmpl"]; !ok {
+		t.Fatalf("template in sub group is not saved as a file, files: %v", files)
+	}
+	manifest, err := readManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SchemaVersion != ManifestSchemaVersion || manifest.PluginName != "greeting" ||
+		manifest.PluginVersion != 3 || manifest.Description != "says hello" {
+		t.Fatalf("wrong manifest: %+v", manifest)
+	}
+	if err := manifest.checkTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	itemCursor++
+	restored := manifest.restore(itemCursor)
+	checkRestored(t, groups[pluginID], restored)
+	if restored.PluginName != "greeting" || restored.PluginVersion != 3 {
+		t.Fatalf("plugin information is lost: %+v", restored)
+	}
+}
+
+func TestLegacyManifestImport(t *testing.T) {
+	useTestDB(t)
+	pluginID := newTestPlugin(t)
+	files := zipFiles(t, func(w *zip.Writer) error {
+		return writeLegacyArchive(w, groups[pluginID], "greeting", 2)
+	})
+	manifest, err := readManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SchemaVersion != 0 || manifest.PluginName != "greeting" || manifest.PluginVersion != 2 {
+		t.Fatalf("wrong manifest: %+v", manifest)
+	}
+	itemCursor++
+	restored := manifest.restore(itemCursor)
+	checkRestored(t, groups[pluginID], restored)
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	useTestDB(t)
+	write := func(manifest string, templates ...string) map[string]*zip.File {
+		return zipFiles(t, func(w *zip.Writer) error {
+			f, err := w.Create(manifestFileName)
+			if err != nil {
+				return err
+			}
+			if _, err = f.Write([]byte(manifest)); err != nil {
+				return err
+			}
+			for _, name := range templates {
+				if _, err = w.Create(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if _, err := readManifest(map[string]*zip.File{}); err != errNoManifest {
+		t.Fatalf("archive without manifest: got %v", err)
+	}
+	if _, err := readManifest(write(`{"schema_version":99,"items":[]}`)); !errors.Is(err, errUnsupportedSchema) {
+		t.Fatalf("newer schema: got %v", err)
+	}
+	if _, err := readManifest(write(`{"schema_version":1,"items":[{"item_type":"rule","display_name":"a","template":"templates/a.tmpl","rule":{}}]}`)); err == nil ||
+		!strings.Contains(err.Error(), "template file not found") {
+		t.Fatalf("missing template: got %v", err)
+	}
+	if _, err := readManifest(write(`{"schema_version":1,"items":[{"item_type":"rule","display_name":"a"}]}`)); err == nil {
+		t.Fatal("item without content is accepted")
+	}
+	if _, err := readManifest(write(`{"schema_version":1,"items":[{"item_type":"resource","display_name":"a","template":"templates/a.tmpl","resource":{}}]}`, "templates/a.tmpl")); err == nil {
+		t.Fatal("template of resource is accepted")
+	}
+}
+
+func TestManifestCheckTemplates(t *testing.T) {
+	useTestDB(t)
+	manifest := &ManifestGroup{Items: []ManifestItem{
+		{ItemType: SnippetItem, DisplayName: "footer", Snippet: &Snippet{Name: "footer", Content: "bye"}},
+		{ItemType: RuleItem, DisplayName: "ok", Rule: &Rule{Response: `{% include "snippets/footer" %}`}},
+	}}
+	if err := manifest.checkTemplates(); err != nil {
+		t.Fatalf("snippets of the plugin should be found: %s", err)
+	}
+	manifest.Items = append(manifest.Items, ManifestItem{ItemType: TriggerItem, DisplayName: "broken", Trigger: &Trigger{Response: "{% if %}"}})
+	if err := manifest.checkTemplates(); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("broken template: got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package gypsum
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	zero "github.com/wdvxdr1123/ZeroBot"
+	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
+)
+
+// OutboundPolicy decides how long replies are sent.
+// in config, 0 turns a feature off; in rules, 0 uses the value in config, and negative turns it off.
+type OutboundPolicy struct {
+	MaxLength        int   `json:"max_length,omitempty"`        // characters per message
+	ChunkInterval    int64 `json:"chunk_interval,omitempty"`    // milliseconds between split messages
+	ForwardThreshold int   `json:"forward_threshold,omitempty"` // characters above which a group reply is sent as forward message
+}
+
+// outboundPolicy merges the policy of item into the policy in config
+func outboundPolicy(override *OutboundPolicy) OutboundPolicy {
+	p := Config.Outbound
+	if override != nil {
+		if override.MaxLength != 0 {
+			p.MaxLength = override.MaxLength
+		}
+		if override.ChunkInterval != 0 {
+			p.ChunkInterval = override.ChunkInterval
+		}
+		if override.ForwardThreshold != 0 {
+			p.ForwardThreshold = override.ForwardThreshold
+		}
+	}
+	if p.MaxLength < 0 {
+		p.MaxLength = 0
+	}
+	if p.ChunkInterval < 0 {
+		p.ChunkInterval = 0
+	}
+	if p.ForwardThreshold < 0 {
+		p.ForwardThreshold = 0
+	}
+	return p
+}
+
+// deliver sends message according to policy, groupID is 0 if the message is not sent to a group.
+// waiting between chunks stops when ctx is done, the error of ctx is returned and remaining chunks are not sent
+func (p OutboundPolicy) deliver(ctx context.Context, msg string, groupID int64, send func(msg string)) error {
+	if p.ForwardThreshold > 0 && groupID != 0 && utf8.RuneCountInString(msg) > p.ForwardThreshold {
+		nickname := "gypsum"
+		if len(zero.BotConfig.NickName) != 0 {
+			nickname = zero.BotConfig.NickName[0]
+		}
+		chunks := splitMessage(msg, p.MaxLength)
+		forward := make(zeroMessage.Message, len(chunks))
+		for i, chunk := range chunks {
+			forward[i] = zeroMessage.CustomNode(nickname, zero.BotConfig.SelfID, chunk)
+		}
+		zero.SendGroupForwardMessage(groupID, forward)
+		return nil
+	}
+	for i, chunk := range splitMessage(msg, p.MaxLength) {
+		if i != 0 && p.ChunkInterval > 0 {
+			timer := time.NewTimer(time.Duration(p.ChunkInterval) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		send(chunk)
+	}
+	return nil
+}
+
+// splitMessage splits message into chunks no longer than maxLength characters.
+// it splits on line boundaries if possible, and never breaks CQ codes.
+func splitMessage(msg string, maxLength int) []string {
+	if maxLength <= 0 || utf8.RuneCountInString(msg) <= maxLength {
+		return []string{msg}
+	}
+	chunks := make([]string, 0)
+	var current strings.Builder
+	currentLength := 0
+	flush := func() {
+		if chunk := strings.TrimSpace(current.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+		currentLength = 0
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		lineLength := utf8.RuneCountInString(line)
+		if currentLength != 0 && currentLength+1+lineLength <= maxLength {
+			current.WriteByte('\n')
+			current.WriteString(line)
+			currentLength += 1 + lineLength
+			continue
+		}
+		flush()
+		if lineLength <= maxLength {
+			current.WriteString(line)
+			currentLength = lineLength
+			continue
+		}
+		// the line itself is too long
+		for _, token := range messageTokens(line) {
+			tokenLength := utf8.RuneCountInString(token)
+			if currentLength != 0 && currentLength+tokenLength > maxLength {
+				flush()
+			}
+			current.WriteString(token)
+			currentLength += tokenLength
+		}
+	}
+	flush()
+	return chunks
+}
+
+// messageTokens splits text into CQ codes and single characters
+func messageTokens(text string) []string {
+	tokens := make([]string, 0, len(text))
+	for len(text) > 0 {
+		if strings.HasPrefix(text, "[CQ:") {
+			if end := strings.IndexByte(text, ']'); end != -1 {
+				tokens = append(tokens, text[:end+1])
+				text = text[end+1:]
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(text)
+		tokens = append(tokens, text[:size])
+		text = text[size:]
+	}
+	return tokens
+}
@@ -0,0 +1,60 @@
+package gypsum
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitMessage(t *testing.T) {
+	cases := []struct {
+		name      string
+		msg       string
+		maxLength int
+		want      []string
+	}{
+		{"no limit", "hello\nworld", 0, []string{"hello\nworld"}},
+		{"short", "hello", 5, []string{"hello"}},
+		{"lines", "aaa\nbbb\nccc", 7, []string{"aaa\nbbb", "ccc"}},
+		{"line boundaries first", "aaaa\nbbbb\ncc", 8, []string{"aaaa", "bbbb\ncc"}},
+		{"long line", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"cjk", "你好世界再见", 4, []string{"你好世界", "再见"}},
+		{"cjk lines", "你好世界\n再见\n再见", 5, []string{"你好世界", "再见\n再见"}},
+		{"cq code", "abcd[CQ:face,id=1]", 16, []string{"abcd", "[CQ:face,id=1]"}},
+		{"cq code longer than limit", "ab[CQ:image,file=xxxxxxxx]cd", 5, []string{"ab", "[CQ:image,file=xxxxxxxx]", "cd"}},
+		{"unclosed cq code", "[CQ:ab", 3, []string{"[CQ", ":ab"}},
+		{"blank chunks", "a\n\n\nb", 1, []string{"a", "b"}},
+		{"spaces trimmed", "abc def", 4, []string{"abc", "def"}},
+	}
+	for _, c := range cases {
+		if got := splitMessage(c.msg, c.maxLength); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: splitMessage(%q, %d) = %q, want %q", c.name, c.msg, c.maxLength, got, c.want)
+		}
+	}
+}
+
+func TestDeliverStopsWhenCancelled(t *testing.T) {
+	policy := OutboundPolicy{MaxLength: 1, ChunkInterval: 50}
+	sent := make([]string, 0)
+	if err := policy.deliver(context.Background(), "abc", 0, func(msg string) {
+		sent = append(sent, msg)
+	}); err != nil || strings.Join(sent, "") != "abc" {
+		t.Fatalf("got %q, %v", sent, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sent = sent[:0]
+	start := time.Now()
+	err := OutboundPolicy{MaxLength: 1, ChunkInterval: 60000}.deliver(ctx, "abc", 0, func(msg string) {
+		sent = append(sent, msg)
+		cancel()
+	})
+	if err != context.Canceled || strings.Join(sent, "") != "a" {
+		t.Fatalf("got %q, %v", sent, err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("waiting between chunks is not cancelled")
+	}
+}
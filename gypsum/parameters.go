@@ -0,0 +1,448 @@
+package gypsum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+type ParameterType string
+
+const (
+	GroupIDsParameter ParameterType = "group_ids"
+	UserIDParameter   ParameterType = "user_id"
+	StringParameter   ParameterType = "string"
+	SecretParameter   ParameterType = "secret" // like string, but never shown after set
+)
+
+// Parameter is declared by a group, its value is set when the group is imported,
+// and can be referenced by items in the group and its sub groups.
+type Parameter struct {
+	Name        string        `json:"name"`
+	Type        ParameterType `json:"type"`
+	DisplayName string        `json:"display_name"`
+	Description string        `json:"description,omitempty"`
+	Optional    bool          `json:"optional,omitempty"`
+}
+
+const secretMask = "******"
+
+var parameterNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkParameters(parameters []Parameter) error {
+	names := make(map[string]bool, len(parameters))
+	for _, p := range parameters {
+		if !parameterNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("invalid parameter name: %q", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicated parameter: %s", p.Name)
+		}
+		names[p.Name] = true
+		switch p.Type {
+		case GroupIDsParameter, UserIDParameter, StringParameter, SecretParameter:
+		default:
+			return fmt.Errorf("unknown type of parameter %s: %s", p.Name, p.Type)
+		}
+	}
+	return nil
+}
+
+// parseParameterValue converts value from json to the form saved in database
+func parseParameterValue(p Parameter, value interface{}) (string, error) {
+	switch p.Type {
+	case GroupIDsParameter:
+		var list []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			list = v
+		case string:
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+		default:
+			return "", fmt.Errorf("parameter %s should be a list of group id", p.Name)
+		}
+		ids := make([]string, 0, len(list))
+		for _, item := range list {
+			id, err := parseID(item)
+			if err != nil {
+				return "", fmt.Errorf("parameter %s: %s", p.Name, err)
+			}
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		return strings.Join(ids, ","), nil
+	case UserIDParameter:
+		id, err := parseID(value)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s: %s", p.Name, err)
+		}
+		return strconv.FormatInt(id, 10), nil
+	default:
+		s, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("parameter %s should be a string", p.Name)
+		}
+		return s, nil
+	}
+}
+
+func parseID(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		if v != float64(int64(v)) || v <= 0 {
+			return 0, fmt.Errorf("invalid id: %v", v)
+		}
+		return int64(v), nil
+	case string:
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || id <= 0 {
+			return 0, fmt.Errorf("invalid id: %q", v)
+		}
+		return id, nil
+	default:
+		return 0, fmt.Errorf("invalid id: %v", v)
+	}
+}
+
+// typedValue converts saved value to the form used in templates and lua
+func (p Parameter) typedValue(value string) interface{} {
+	switch p.Type {
+	case GroupIDsParameter:
+		return splitIDs(value)
+	case UserIDParameter:
+		id, _ := strconv.ParseInt(value, 10, 64)
+		return id
+	default:
+		return value
+	}
+}
+
+func splitIDs(value string) []int64 {
+	ids := make([]int64, 0)
+	for _, s := range strings.Split(value, ",") {
+		if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// lookupParameter finds parameter from the group up to root group, the nearest declaration is used
+func lookupParameter(groupID uint64, name string) (p Parameter, value string, ok bool) {
+	for depth := 0; depth < 64; depth++ {
+		g, exists := groups[groupID]
+		if !exists {
+			return
+		}
+		for _, declared := range g.Parameters {
+			if declared.Name == name {
+				value, ok = g.ParameterValues[name]
+				return declared, value, ok
+			}
+		}
+		if groupID == 0 {
+			return
+		}
+		groupID = g.ParentGroup
+	}
+	return
+}
+
+// groupParameters collects values of all parameters visible in the group
+func groupParameters(groupID uint64) map[string]interface{} {
+	params := make(map[string]interface{})
+	for depth := 0; depth < 64; depth++ {
+		g, exists := groups[groupID]
+		if !exists {
+			break
+		}
+		for _, p := range g.Parameters {
+			if _, shadowed := params[p.Name]; shadowed {
+				continue
+			}
+			if value, ok := g.ParameterValues[p.Name]; ok {
+				params[p.Name] = p.typedValue(value)
+			}
+		}
+		if groupID == 0 {
+			break
+		}
+		groupID = g.ParentGroup
+	}
+	return params
+}
+
+// resolveIDs merges static ids and ids from parameter.
+// ok is false when the parameter is referenced but not set, and nothing should be matched then.
+func resolveIDs(static []int64, groupID uint64, paramName string) (ids []int64, ok bool) {
+	if paramName == "" {
+		return static, true
+	}
+	p, value, set := lookupParameter(groupID, paramName)
+	if !set || value == "" {
+		return static, len(static) != 0
+	}
+	ids = append(make([]int64, 0, len(static)), static...)
+	switch p.Type {
+	case GroupIDsParameter, UserIDParameter:
+		ids = append(ids, splitIDs(value)...)
+	}
+	return ids, true
+}
+
+// paramIDsRule is like groupsRule or usersRule, but ids are read from parameter every time,
+// so that the change of parameter takes effect immediately.
+func paramIDsRule(static []int64, parentID func() uint64, paramName string, idsRule func([]int64) zero.Rule) zero.Rule {
+	if paramName == "" {
+		return idsRule(static)
+	}
+	return func(event *zero.Event, state zero.State) bool {
+		ids, ok := resolveIDs(static, parentID(), paramName)
+		if !ok {
+			return false
+		}
+		return idsRule(ids)(event, state)
+	}
+}
+
+// fillParameterValues parses values for parameters declared in the manifest tree,
+// values are matched by name, and unknown names are rejected.
+func (mg *ManifestGroup) fillParameterValues(values map[string]interface{}) error {
+	declared := make(map[string]bool)
+	if err := mg.fillParameterValuesRecursive(values, declared); err != nil {
+		return err
+	}
+	for name := range values {
+		if !declared[name] {
+			return fmt.Errorf("plugin has no parameter named %s", name)
+		}
+	}
+	return nil
+}
+
+func (mg *ManifestGroup) fillParameterValuesRecursive(values map[string]interface{}, declared map[string]bool) error {
+	if err := checkParameters(mg.Parameters); err != nil {
+		return err
+	}
+	mg.parameterValues = make(map[string]string)
+	for _, p := range mg.Parameters {
+		declared[p.Name] = true
+		if v, ok := values[p.Name]; ok {
+			parsed, err := parseParameterValue(p, v)
+			if err != nil {
+				return err
+			}
+			mg.parameterValues[p.Name] = parsed
+		}
+	}
+	for _, item := range mg.Items {
+		if item.ItemType == GroupItem && item.Group != nil {
+			if err := item.Group.fillParameterValuesRecursive(values, declared); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missingParameters lists required parameters without value, parameters in `existing` are treated as set
+func (mg *ManifestGroup) missingParameters(existing map[string]bool) []Parameter {
+	missing := make([]Parameter, 0)
+	seen := make(map[string]bool)
+	var walk func(*ManifestGroup)
+	walk = func(g *ManifestGroup) {
+		for _, p := range g.Parameters {
+			if _, ok := g.parameterValues[p.Name]; ok || p.Optional || existing[p.Name] || seen[p.Name] {
+				continue
+			}
+			seen[p.Name] = true
+			missing = append(missing, p)
+		}
+		for _, item := range g.Items {
+			if item.ItemType == GroupItem && item.Group != nil {
+				walk(item.Group)
+			}
+		}
+	}
+	walk(mg)
+	return missing
+}
+
+// parameterValueNames lists names of all parameters set in the group and its sub groups
+func (g *Group) parameterValueNames() map[string]bool {
+	names := make(map[string]bool)
+	for name := range g.ParameterValues {
+		names[name] = true
+	}
+	g.walkItems(func(item Item) {
+		if item.ItemType != GroupItem {
+			return
+		}
+		if subGroup, ok := groups[item.ItemID]; ok {
+			for name := range subGroup.ParameterValues {
+				names[name] = true
+			}
+		}
+	})
+	return names
+}
+
+// maskedParameterValues converts values for showing to user, secrets are masked
+func (g *Group) maskedParameterValues() map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, p := range g.Parameters {
+		value, ok := g.ParameterValues[p.Name]
+		if !ok {
+			continue
+		}
+		if p.Type == SecretParameter {
+			values[p.Name] = secretMask
+			continue
+		}
+		values[p.Name] = p.typedValue(value)
+	}
+	return values
+}
+
+type groupParametersPatch struct {
+	Parameters *[]Parameter           `json:"parameters"`
+	Values     map[string]interface{} `json:"values"`
+}
+
+func getGroupParameters(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("gid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	g, ok := groups[groupID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	parameters := g.Parameters
+	if parameters == nil {
+		parameters = []Parameter{}
+	}
+	c.JSON(200, gin.H{
+		"parameters": parameters,
+		"values":     g.maskedParameterValues(),
+	})
+}
+
+func modifyGroupParameters(c *gin.Context) {
+	groupID, err := strconv.ParseUint(c.Param("gid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	g, ok := groups[groupID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	var patch groupParametersPatch
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	parameters := g.Parameters
+	if patch.Parameters != nil {
+		parameters = *patch.Parameters
+		if err := checkParameters(parameters); err != nil {
+			c.JSON(422, gin.H{
+				"code":    4020,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	newValues := make(map[string]string)
+	for _, p := range parameters {
+		// keep values of parameters whose type is not changed
+		for _, old := range g.Parameters {
+			if old.Name == p.Name && old.Type == p.Type {
+				if value, ok := g.ParameterValues[p.Name]; ok {
+					newValues[p.Name] = value
+				}
+			}
+		}
+	}
+	for name, value := range patch.Values {
+		var declared *Parameter
+		for i := range parameters {
+			if parameters[i].Name == name {
+				declared = &parameters[i]
+			}
+		}
+		if declared == nil {
+			c.JSON(422, gin.H{
+				"code":    4020,
+				"message": fmt.Sprintf("group has no parameter named %s", name),
+			})
+			return
+		}
+		if value == nil {
+			delete(newValues, name)
+			continue
+		}
+		parsed, err := parseParameterValue(*declared, value)
+		if err != nil {
+			c.JSON(422, gin.H{
+				"code":    4020,
+				"message": err.Error(),
+			})
+			return
+		}
+		newValues[name] = parsed
+	}
+	g.Parameters = parameters
+	g.ParameterValues = newValues
+	if err := g.SaveToDB(groupID); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
+
+// parseParameterValues reads values of parameters submitted along with plugin
+func parseParameterValues(raw []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if len(raw) == 0 {
+		return values, nil
+	}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, errors.New("parameters should be a json object: " + err.Error())
+	}
+	return values, nil
+}
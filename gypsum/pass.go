@@ -0,0 +1,155 @@
+package gypsum
+
+import (
+	"reflect"
+	"regexp"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/flosch/pongo2"
+	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/luatag"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// PassResponse is returned by handlers when the template declines to handle the event with `pass`,
+// items with lower priority are still matched even if the item blocks
+const PassResponse zero.Response = 0xff
+
+// passedKey is the key in context of the flag set by `pass`
+const passedKey = "_pass"
+
+// claimedEventKey is the key in state where the event being matched is kept
+const claimedEventKey = "_claimed_event"
+
+// claimedEvents are events handled by blocking items, keyed by their addresses.
+// for items that may pass, blocking is done here instead of by ZeroBot,
+// since ZeroBot decides it before the template is executed.
+// addresses do not keep events alive, an event is forgotten by its finalizer once ZeroBot has done with it,
+// so its address cannot be reused by another event while it is stored
+var claimedEvents sync.Map
+
+func eventKey(event *zero.Event) uintptr {
+	return uintptr(unsafe.Pointer(event))
+}
+
+func claimEvent(event *zero.Event) {
+	if _, loaded := claimedEvents.LoadOrStore(eventKey(event), struct{}{}); !loaded {
+		runtime.SetFinalizer(event, func(event *zero.Event) {
+			claimedEvents.Delete(eventKey(event))
+		})
+	}
+}
+
+var (
+	tokenType       = reflect.TypeOf(&pongo2.Token{})
+	templateSetType = reflect.TypeOf(&pongo2.TemplateSet{})
+	luaPassPattern  = regexp.MustCompile(`\bpass\b`)
+)
+
+// mayPass tells whether the compiled template may use `pass`, in a tag or in lua code.
+// snippets loaded by `include`, `import` and `extends` are compiled into the template, so they are checked as well,
+// only snippets included by a variable name are unknown, they are assumed to pass.
+// items that never pass are blocked by ZeroBot so that matchers of other plugins are blocked as well,
+// items that may pass are only blocked for gypsum items
+func mayPass(tmpl *pongo2.Template) bool {
+	w := passWalker{visited: make(map[passVisit]bool)}
+	return w.walk(reflect.ValueOf(tmpl), false)
+}
+
+type passVisit struct {
+	addr  uintptr
+	typ   reflect.Type
+	inLua bool
+}
+
+// passWalker looks for `pass` in compiled nodes by reflection, since pongo2 does not export them
+type passWalker struct {
+	visited map[passVisit]bool
+}
+
+func (w *passWalker) walk(v reflect.Value, inLua bool) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return false
+		}
+		switch v.Type() {
+		case template.PassNodeType:
+			return true
+		case luatag.LuaNodeType:
+			inLua = true
+		case tokenType:
+			token := v.Elem()
+			return inLua && token.FieldByName("Typ").Int() == int64(pongo2.TokenHTML) &&
+				luaPassPattern.MatchString(token.FieldByName("Val").String())
+		case templateSetType:
+			return false
+		}
+		visit := passVisit{addr: v.Pointer(), typ: v.Type(), inLua: inLua}
+		if w.visited[visit] {
+			return false
+		}
+		w.visited[visit] = true
+		return w.walk(v.Elem(), inLua)
+	case reflect.Interface:
+		return w.walk(v.Elem(), inLua)
+	case reflect.Struct:
+		if v.Type().String() == "pongo2.tagIncludeNode" && v.FieldByName("lazy").Bool() {
+			return true
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if w.walk(v.Field(i), inLua) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if w.walk(v.Index(i), inLua) {
+				return true
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if w.walk(iter.Value(), inLua) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unclaimedRule skips events that are handled by a blocking item,
+// it keeps the event in state so that the handler can claim it
+func unclaimedRule(event *zero.Event, state zero.State) bool {
+	if _, claimed := claimedEvents.Load(eventKey(event)); claimed {
+		return false
+	}
+	state[claimedEventKey] = event
+	return true
+}
+
+// blockable claims the event after handling if block is true, unless the template passes
+func blockable(block bool, handler zero.Handler) zero.Handler {
+	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
+		claimed, _ := state[claimedEventKey].(*zero.Event)
+		delete(state, claimedEventKey)
+		response := handler(matcher, event, state)
+		if response == PassResponse {
+			return zero.FinishResponse
+		}
+		if block && claimed != nil {
+			claimEvent(claimed)
+		}
+		return response
+	}
+}
+
+// passed tells whether `pass` is used in the execution
+func passed(ctx pongo2.Context) bool {
+	p, ok := ctx[passedKey].(*bool)
+	return ok && *p
+}
@@ -0,0 +1,156 @@
+package gypsum
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flosch/pongo2"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+var testTemplatingInitialized sync.Once
+
+// initTestTemplating registers functions and tags like gypsum does at start
+func initTestTemplating() {
+	testTemplatingInitialized.Do(func() {
+		if Config == nil {
+			Config = &ConfigType{}
+		}
+		Config.ResourceShare = "file"
+		if err := initTemplating(); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func compileTestTemplate(t *testing.T, src string) *pongo2.Template {
+	initTestTemplating()
+	tmpl, err := templateSet.FromString(src)
+	if err != nil {
+		t.Fatalf("compile %q: %s", src, err)
+	}
+	return tmpl
+}
+
+func TestMayPass(t *testing.T) {
+	snippets = map[uint64]*Snippet{
+		1: {Name: "passing", Content: "{% if event.user_id %}{% pass %}{% endif %}"},
+		2: {Name: "greeting", Content: "hello, pass the salt"},
+		3: {Name: "nested", Content: `{% include "snippets/passing" %}`},
+		4: {Name: "macros", Content: "{% macro skip() export %}{% pass %}{% endmacro %}"},
+		5: {Name: "lua", Content: "{% lua %}if true then pass() end{% endlua %}"},
+	}
+	defer func() { snippets = nil }()
+	cases := []struct {
+		src  string
+		want bool
+	}{
+		{"hello", false},
+		{"your password is wrong, pass the salt", false},
+		{"{% pass %}", true},
+		{"{% if 1 > 2 %}{% pass %}{% else %}no{% endif %}", true},
+		{"{% for i in range(3) %}{{ i }}{% endfor %}{% pass %}", true},
+		{"{% lua %}write('pass')\npass()\n{% endlua %}", true},
+		{"{% lua %}write('password'){% endlua %}", false},
+		{"{% lua %}local passed = 1{% endlua %}pass", false},
+		{`{% include "snippets/greeting" %}`, false},
+		{`{% include "snippets/passing" %}`, true},
+		{`{% include "snippets/nested" %}`, true},
+		{`{% import "snippets/macros" skip %}`, true},
+		{`{% include "snippets/lua" %}`, true},
+		{`{% include name %}`, true},
+	}
+	for _, c := range cases {
+		if got := mayPass(compileTestTemplate(t, c.src)); got != c.want {
+			t.Errorf("mayPass(%q) = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+// dispatch matches the event like ZeroBot does, and returns names of matchers handling it
+func dispatch(event zero.Event, matchers []*zero.Matcher, names []string) []string {
+	handled := make([]string, 0)
+loop:
+	for i, matcher := range matchers {
+		state := zero.State{}
+		for _, rule := range matcher.Rules {
+			if !rule(&event, state) {
+				continue loop
+			}
+		}
+		matcher.Handler(matcher, event, state)
+		handled = append(handled, names[i])
+		if matcher.Block {
+			break
+		}
+	}
+	return handled
+}
+
+func gypsumMatcher(block, mayPass, passes bool) *zero.Matcher {
+	return &zero.Matcher{
+		Rules: []zero.Rule{unclaimedRule},
+		Block: block && !mayPass,
+		Handler: blockable(block, func(_ *zero.Matcher, _ zero.Event, _ zero.State) zero.Response {
+			if passes {
+				return PassResponse
+			}
+			return zero.FinishResponse
+		}),
+	}
+}
+
+func foreignMatcher() *zero.Matcher {
+	return &zero.Matcher{
+		Handler: func(_ *zero.Matcher, _ zero.Event, _ zero.State) zero.Response {
+			return zero.FinishResponse
+		},
+	}
+}
+
+func TestBlockAndPass(t *testing.T) {
+	cases := []struct {
+		name     string
+		matchers []*zero.Matcher
+		want     string
+	}{
+		{"never passes", []*zero.Matcher{gypsumMatcher(true, false, false), gypsumMatcher(false, false, false), foreignMatcher()}, "first"},
+		{"may pass but blocks", []*zero.Matcher{gypsumMatcher(true, true, false), gypsumMatcher(false, false, false), foreignMatcher()}, "first foreign"},
+		{"passes", []*zero.Matcher{gypsumMatcher(true, true, true), gypsumMatcher(false, false, false), foreignMatcher()}, "first second foreign"},
+		{"not blocking", []*zero.Matcher{gypsumMatcher(false, true, false), gypsumMatcher(false, false, false), foreignMatcher()}, "first second foreign"},
+	}
+	for _, c := range cases {
+		got := dispatch(zero.Event{PostType: "message"}, c.matchers, []string{"first", "second", "foreign"})
+		if joined := strings.Join(got, " "); joined != c.want {
+			t.Errorf("%s: handled by %q, want %q", c.name, joined, c.want)
+		}
+	}
+}
+
+func countClaimedEvents() int {
+	n := 0
+	claimedEvents.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestClaimedEventForgotten(t *testing.T) {
+	dispatch(zero.Event{PostType: "message"}, []*zero.Matcher{gypsumMatcher(true, true, false)}, []string{"first"})
+	if countClaimedEvents() == 0 {
+		t.Fatal("event is not claimed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		if countClaimedEvents() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("claimed event is not forgotten after it is collected")
+}
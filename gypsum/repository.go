@@ -0,0 +1,497 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const repositoryIndexFile = "index.json"
+
+var errPluginNotInRepository = errors.New("plugin not found in repositories")
+
+// RepositoryIndex lists plugins in a repository, saved as index.json in repository directory
+type RepositoryIndex struct {
+	Name    string            `json:"name"`
+	Plugins []RepositoryEntry `json:"plugins"`
+}
+
+// RepositoryEntry describes one version of a plugin, a plugin may have several versions in one index.
+// File is the path of package relative to index, or an absolute http url.
+type RepositoryEntry struct {
+	Name        string `json:"name"`
+	Version     int64  `json:"version"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description,omitempty"`
+	File        string `json:"file"`
+	Sha256Sum   string `json:"sha256"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// repositoryPlugin is an entry found in one of the configured repositories
+type repositoryPlugin struct {
+	RepositoryEntry
+	Repository       string `json:"repository"`
+	InstalledVersion int64  `json:"installed_version,omitempty"`
+}
+
+var repositoryClient = &http.Client{Timeout: 60 * time.Second}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// indexLocation converts repository source to the location of its index file,
+// a source can be a local directory, a local index file, or an http url of either.
+func indexLocation(source string) string {
+	if isRemoteSource(source) {
+		if strings.HasSuffix(source, ".json") {
+			return source
+		}
+		return strings.TrimSuffix(source, "/") + "/" + repositoryIndexFile
+	}
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		return filepath.Join(source, repositoryIndexFile)
+	}
+	return source
+}
+
+func fetchRepositoryIndex(source string) (*RepositoryIndex, error) {
+	location := indexLocation(source)
+	var reader io.ReadCloser
+	if isRemoteSource(location) {
+		resp, err := repositoryClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: %s", location, resp.Status)
+		}
+		reader = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		reader = f
+	}
+	defer reader.Close()
+	index := &RepositoryIndex{}
+	if err := json.NewDecoder(io.LimitReader(reader, 16<<20)).Decode(index); err != nil {
+		return nil, fmt.Errorf("cannot decode index of %s: %s", source, err)
+	}
+	return index, nil
+}
+
+// openRepositoryPackage opens the package file of entry in the repository
+func openRepositoryPackage(source string, entry RepositoryEntry) (io.ReadCloser, error) {
+	location := indexLocation(source)
+	if isRemoteSource(location) {
+		base, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(entry.File)
+		if err != nil {
+			return nil, err
+		}
+		packageURL := base.ResolveReference(ref)
+		if packageURL.Scheme != "http" && packageURL.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported package url: %s", entry.File)
+		}
+		resp, err := repositoryClient.Get(packageURL.String())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: %s", packageURL, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	file := filepath.Clean(filepath.FromSlash(entry.File))
+	if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("package path must be inside repository: %s", entry.File)
+	}
+	return os.Open(filepath.Join(filepath.Dir(location), file))
+}
+
+// searchRepositories finds plugins whose name, display name or description contains the keyword,
+// only the latest version of each plugin is listed. errors of unavailable repositories are returned separately.
+func searchRepositories(keyword string) ([]repositoryPlugin, map[string]string) {
+	keyword = strings.ToLower(keyword)
+	latest := make(map[string]repositoryPlugin)
+	failures := make(map[string]string)
+	for _, source := range Config.Repositories {
+		index, err := fetchRepositoryIndex(source)
+		if err != nil {
+			log.Warnf("repository %s is unavailable: %s", source, err)
+			failures[source] = err.Error()
+			continue
+		}
+		for _, entry := range index.Plugins {
+			if keyword != "" &&
+				!strings.Contains(strings.ToLower(entry.Name), keyword) &&
+				!strings.Contains(strings.ToLower(entry.DisplayName), keyword) &&
+				!strings.Contains(strings.ToLower(entry.Description), keyword) {
+				continue
+			}
+			// earlier repository wins if versions are equal
+			if found, ok := latest[entry.Name]; ok && found.Version >= entry.Version {
+				continue
+			}
+			latest[entry.Name] = repositoryPlugin{
+				RepositoryEntry: entry,
+				Repository:      source,
+			}
+		}
+	}
+	plugins := make([]repositoryPlugin, 0, len(latest))
+	for _, p := range latest {
+		if groupID, installed := findPluginGroup(p.Name); installed {
+			p.InstalledVersion = groups[groupID].PluginVersion
+		}
+		plugins = append(plugins, p)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins, failures
+}
+
+// findRepositoryPlugin finds the plugin of given version in repositories, version 0 means the latest one
+func findRepositoryPlugin(name string, version int64) (repositoryPlugin, error) {
+	var found repositoryPlugin
+	ok := false
+	for _, source := range Config.Repositories {
+		index, err := fetchRepositoryIndex(source)
+		if err != nil {
+			log.Warnf("repository %s is unavailable: %s", source, err)
+			continue
+		}
+		for _, entry := range index.Plugins {
+			if entry.Name != name || (version != 0 && entry.Version != version) {
+				continue
+			}
+			if ok && found.Version >= entry.Version {
+				continue
+			}
+			found = repositoryPlugin{
+				RepositoryEntry: entry,
+				Repository:      source,
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return found, errPluginNotInRepository
+	}
+	return found, nil
+}
+
+// downloadRepositoryPlugin saves the package into a temp file and checks its hash
+func downloadRepositoryPlugin(p repositoryPlugin) (*os.File, int64, error) {
+	reader, err := openRepositoryPackage(p.Repository, p.RepositoryEntry)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	file, sum, size, err := receiveFile(reader, Config.MaxPluginSize<<20)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), p.Sha256Sum) {
+		discardTempFile(file)
+		return nil, 0, fmt.Errorf("sha256 of %s %d does not match the index", p.Name, p.Version)
+	}
+	return file, size, nil
+}
+
+// BuildRepositoryIndex scans plugin packages in the directory and writes index.json,
+// descriptions are kept from the old index if the package does not have one.
+func BuildRepositoryIndex(dir string) (int, error) {
+	oldDescriptions := make(map[string]string)
+	if old, err := fetchRepositoryIndex(dir); err == nil {
+		for _, entry := range old.Plugins {
+			oldDescriptions[entry.File] = entry.Description
+		}
+	}
+	index := RepositoryIndex{
+		Name:    filepath.Base(dir),
+		Plugins: make([]RepositoryEntry, 0),
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".gypsum") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry, err := repositoryEntryOf(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		entry.File = filepath.ToSlash(rel)
+		if entry.Description == "" {
+			entry.Description = oldDescriptions[entry.File]
+		}
+		index.Plugins = append(index.Plugins, entry)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(index.Plugins, func(i, j int) bool {
+		if index.Plugins[i].Name != index.Plugins[j].Name {
+			return index.Plugins[i].Name < index.Plugins[j].Name
+		}
+		return index.Plugins[i].Version > index.Plugins[j].Version
+	})
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(index.Plugins), os.WriteFile(filepath.Join(dir, repositoryIndexFile), indexBytes, 0644)
+}
+
+func repositoryEntryOf(path string) (RepositoryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return RepositoryEntry{}, err
+	}
+	zipReader, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	files := make(map[string]*zip.File, len(zipReader.File))
+	for _, file := range zipReader.File {
+		files[file.Name] = file
+	}
+	manifest, err := readManifest(files)
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	if manifest.PluginName == "" {
+		return RepositoryEntry{}, errors.New("plugin has no name")
+	}
+	return RepositoryEntry{
+		Name:        manifest.PluginName,
+		Version:     manifest.PluginVersion,
+		DisplayName: manifest.DisplayName,
+		Description: manifest.Description,
+		Sha256Sum:   hex.EncodeToString(h.Sum(nil)),
+		Size:        info.Size(),
+	}, nil
+}
+
+type installedPlugin struct {
+	GroupID       uint64 `json:"group_id"`
+	PluginName    string `json:"plugin_name"`
+	PluginVersion int64  `json:"plugin_version"`
+	DisplayName   string `json:"display_name"`
+	LatestVersion int64  `json:"latest_version,omitempty"`
+}
+
+func getInstalledPlugins(c *gin.Context) {
+	plugins := make([]installedPlugin, 0)
+	for id, g := range groups {
+		if !isPluginInstallation(id) {
+			continue
+		}
+		plugins = append(plugins, installedPlugin{
+			GroupID:       id,
+			PluginName:    g.PluginName,
+			PluginVersion: g.PluginVersion,
+			DisplayName:   g.DisplayName,
+		})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].GroupID < plugins[j].GroupID })
+	if c.Query("check_updates") == "true" {
+		available, _ := searchRepositories("")
+		latest := make(map[string]int64, len(available))
+		for _, p := range available {
+			latest[p.Name] = p.Version
+		}
+		for i := range plugins {
+			plugins[i].LatestVersion = latest[plugins[i].PluginName]
+		}
+	}
+	c.JSON(200, plugins)
+}
+
+func searchPlugins(c *gin.Context) {
+	plugins, failures := searchRepositories(c.Query("q"))
+	c.JSON(200, gin.H{
+		"plugins":  plugins,
+		"failures": failures,
+	})
+}
+
+type pluginRequest struct {
+	Name           string                 `json:"name"`
+	Version        int64                  `json:"version"`
+	GroupID        uint64                 `json:"group_id"`
+	Target         uint64                 `json:"target"`
+	SideBySide     bool                   `json:"side_by_side"`
+	AllowDowngrade bool                   `json:"allow_downgrade"`
+	DryRun         bool                   `json:"dry_run"`
+	Parameters     map[string]interface{} `json:"parameters"`
+}
+
+func installPlugin(c *gin.Context) {
+	installFromRepository(c, false)
+}
+
+func upgradePlugin(c *gin.Context) {
+	installFromRepository(c, true)
+}
+
+func installFromRepository(c *gin.Context, upgrade bool) {
+	var req pluginRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	p, err := findRepositoryPlugin(req.Name, req.Version)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    4030,
+			"message": err.Error(),
+		})
+		return
+	}
+	archiveFile, archiveSize, err := downloadRepositoryPlugin(p)
+	if err != nil {
+		if err == errFileTooLarge {
+			c.JSON(413, gin.H{
+				"code":    6001,
+				"message": fmt.Sprintf("plugin is larger than %d MiB", Config.MaxPluginSize),
+			})
+			return
+		}
+		c.JSON(502, gin.H{
+			"code":    4031,
+			"message": fmt.Sprintf("cannot download plugin: %s", err),
+		})
+		return
+	}
+	defer discardTempFile(archiveFile)
+	opts := importOptions{
+		Mode:           "auto",
+		Target:         req.Target,
+		AllowDowngrade: req.AllowDowngrade,
+		DryRun:         req.DryRun,
+		Values:         req.Parameters,
+	}
+	if opts.Values == nil {
+		opts.Values = map[string]interface{}{}
+	}
+	if upgrade {
+		opts.Mode = "upgrade"
+	} else if req.SideBySide {
+		opts.Mode = "install"
+	}
+	status, result := importPlugin(req.GroupID, archiveFile, archiveSize, opts)
+	result["repository"] = p.Repository
+	c.JSON(status, result)
+}
+
+type pluginUninstallRequest struct {
+	Name       string `json:"name"`
+	Target     uint64 `json:"target"`
+	DeleteData bool   `json:"delete_data"`
+}
+
+func uninstallPlugin(c *gin.Context) {
+	var req pluginUninstallRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	installations := pluginInstallations(req.Name)
+	var groupID uint64
+	switch {
+	case req.Target != 0:
+		for _, id := range installations {
+			if id == req.Target {
+				groupID = id
+			}
+		}
+	case len(installations) == 1:
+		groupID = installations[0]
+	case len(installations) > 1:
+		c.JSON(409, gin.H{
+			"code":          4032,
+			"message":       "plugin is installed more than once, specify target",
+			"installations": installations,
+		})
+		return
+	}
+	if groupID == 0 {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "plugin not installed",
+		})
+		return
+	}
+	resourceFiles := groups[groupID].resourceFiles()
+	if err := DeleteFromParent(groups[groupID].ParentGroup, groupID); err != nil {
+		log.Errorf("error when delete group %d from parent group: %s", groupID, err)
+	}
+	if err := removeUserRecord(GroupItem, groupID); err != nil {
+		log.Error(err)
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	deleteUnusedResourceFiles(resourceFiles)
+	if req.DeleteData {
+		if err := deletePluginData(groupID); err != nil {
+			log.Error(err)
+			c.JSON(500, gin.H{
+				"code":    3000,
+				"message": fmt.Sprintf("error when delete plugin data: %s", err),
+			})
+			return
+		}
+	}
+	c.JSON(200, gin.H{
+		"code":     0,
+		"message":  "ok",
+		"group_id": groupID,
+	})
+}
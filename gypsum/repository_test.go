@@ -0,0 +1,88 @@
+package gypsum
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/yuudi/gypsum/gypsum/storage"
+)
+
+func TestPluginInstallations(t *testing.T) {
+	useTestDB(t)
+	setPlugin := func(groupID uint64, name string) {
+		groups[groupID].PluginName = name
+	}
+	greeting := addTestGroup(t, 0, "greeting")
+	setPlugin(greeting, "greeting")
+	sub := addTestGroup(t, greeting, "sub")
+	setPlugin(sub, "greeting")
+	// another plugin installed inside the group of greeting
+	dice := addTestGroup(t, sub, "dice")
+	setPlugin(dice, "dice")
+	diceSub := addTestGroup(t, dice, "dice sub")
+	setPlugin(diceSub, "dice")
+	folder := addTestGroup(t, 0, "folder")
+	secondGreeting := addTestGroup(t, folder, "greeting again")
+	setPlugin(secondGreeting, "greeting")
+
+	if got, want := pluginInstallations("greeting"), []uint64{greeting, secondGreeting}; !reflect.DeepEqual(got, want) {
+		t.Errorf("installations of greeting: got %v, want %v", got, want)
+	}
+	if got, want := pluginInstallations("dice"), []uint64{dice}; !reflect.DeepEqual(got, want) {
+		t.Errorf("installations of dice: got %v, want %v", got, want)
+	}
+	if got := pluginInstallations(""); len(got) != 0 {
+		t.Errorf("groups without plugin are listed: %v", got)
+	}
+	if id, ok := findPluginGroup("dice"); !ok || id != dice {
+		t.Errorf("findPluginGroup(dice) = %d, %v", id, ok)
+	}
+	if isPluginInstallation(0) || isPluginInstallation(folder) || isPluginInstallation(sub) || isPluginInstallation(diceSub) {
+		t.Error("sub groups are taken as installations")
+	}
+}
+
+func TestDeleteUnusedResourceFiles(t *testing.T) {
+	useTestDB(t)
+	var err error
+	if resStorage, err = storage.NewLocalStorage(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { resStorage = nil }()
+	put := func(name string) {
+		if err := resStorage.Put(name, bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		ok, err := resStorage.Exists(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	pluginID := addTestGroup(t, 0, "plugin")
+	subID := addTestGroup(t, pluginID, "sub")
+	resources[100] = &Resource{FileName: "only", Ext: ".png", Sha256Sum: "aaaa", ParentGroup: subID}
+	resources[101] = &Resource{FileName: "shared", Ext: ".png", Sha256Sum: "bbbb", ParentGroup: pluginID}
+	resources[102] = &Resource{FileName: "shared copy", Ext: ".png", Sha256Sum: "bbbb", ParentGroup: 0}
+	groups[subID].Items = append(groups[subID].Items, Item{ItemType: ResourceItem, DisplayName: "only.png", ItemID: 100})
+	groups[pluginID].Items = append(groups[pluginID].Items, Item{ItemType: ResourceItem, DisplayName: "shared.png", ItemID: 101})
+	put("aaaa.png")
+	put("bbbb.png")
+
+	files := groups[pluginID].resourceFiles()
+	if want := []string{"aaaa.png", "bbbb.png"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("resource files: got %v, want %v", files, want)
+	}
+	delete(resources, 100)
+	delete(resources, 101)
+	deleteUnusedResourceFiles(files)
+	if exists("aaaa.png") {
+		t.Error("unused file is kept")
+	}
+	if !exists("bbbb.png") {
+		t.Error("file used by another resource is deleted")
+	}
+}
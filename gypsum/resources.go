@@ -3,15 +3,20 @@ package gypsum
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -19,17 +24,27 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/util"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/helper/mediainfo"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type Resource struct {
-	FileName    string `json:"file_name"`
-	Ext         string `json:"ext"`
-	Sha256Sum   string `json:"sha256_sum"`
-	ParentGroup uint64 `json:"-"`
+	FileName    string  `json:"file_name"`
+	Ext         string  `json:"ext"`
+	Sha256Sum   string  `json:"sha256_sum"`
+	Size        int64   `json:"size"`
+	MIME        string  `json:"mime"`
+	UploadTime  int64   `json:"upload_time"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	ParentGroup uint64  `json:"-"`
 }
 
 var resources map[uint64]*Resource
-var resDir string // absolute path of resource directory
+var resStorage storage.Storage
+
+const tempDir = "gypsum_data/tmp"
 
 func (r *Resource) ToBytes() ([]byte, error) {
 	buffer := bytes.Buffer{}
@@ -50,23 +65,18 @@ func ResourceFromBytes(b []byte) (*Resource, error) {
 }
 
 func loadResources() {
-	pwd, err := os.Getwd()
-	if err != nil {
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		panic(err)
 	}
-	resDir = path.Join(pwd, "resources")
-	if resourceDir, err := os.Stat(resDir); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.Mkdir(resDir, 0644); err != nil {
-				panic(err)
-			}
-		} else {
-			panic(err)
-		}
-	} else {
-		if !resourceDir.IsDir() {
-			panic("resource directory exists and is not directory")
-		}
+	var err error
+	switch Config.ResourceStorage {
+	case "s3":
+		resStorage, err = storage.NewS3Storage(Config.S3)
+	default:
+		resStorage, err = storage.NewLocalStorage("resources")
+	}
+	if err != nil {
+		panic(err)
 	}
 	resources = make(map[uint64]*Resource)
 	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-resources-")), nil)
@@ -86,6 +96,78 @@ func loadResources() {
 		}
 		resources[key] = r
 	}
+	// resources uploaded by old version have no metadata
+	for key, r := range resources {
+		if r.MIME != "" {
+			continue
+		}
+		if err = r.fillMediaInfo(); err != nil {
+			log.Warnf("无法读取资源%d的信息：%s", key, err)
+			continue
+		}
+		if err = r.SaveToDB(key); err != nil {
+			log.Errorf("error when write database: %s", err)
+		}
+	}
+}
+
+func (r *Resource) setMediaInfo(info mediainfo.Info) {
+	r.MIME = info.MIME
+	r.Width = info.Width
+	r.Height = info.Height
+	r.Duration = info.Duration
+}
+
+// fillMediaInfo reads the resource file from storage and fills the metadata
+func (r *Resource) fillMediaInfo() error {
+	var info mediainfo.Info
+	var probeErr error
+	if p, ok := resStorage.LocalPath(r.Sha256Sum + r.Ext); ok {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r.Size = stat.Size()
+		if r.UploadTime == 0 {
+			r.UploadTime = stat.ModTime().Unix()
+		}
+		info, probeErr = mediainfo.Probe(f)
+	} else {
+		// files in remote storage are not downloaded as a whole, only the header is read except for mp3
+		size, err := resStorage.Size(r.Sha256Sum + r.Ext)
+		if err != nil {
+			return err
+		}
+		reader, err := resStorage.Get(r.Sha256Sum + r.Ext)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		r.Size = size
+		info, probeErr = mediainfo.ProbeReader(reader)
+	}
+	if probeErr != nil {
+		log.Warnf("error when probing resource %s: %s", r.Sha256Sum, probeErr)
+	}
+	r.setMediaInfo(info)
+	return nil
+}
+
+// resourceMIMEByURI finds out the MIME type if uri is generated by `res`,
+// file names of resources are their sha256 sums and extensions, in local paths, http links and presigned urls
+func resourceMIMEByURI(uri string) (string, bool) {
+	filename := filepath.Base(strings.SplitN(uri, "?", 2)[0])
+	for _, r := range resources {
+		if r.MIME != "" && filename == r.Sha256Sum+r.Ext {
+			return r.MIME, true
+		}
+	}
+	return "", false
 }
 
 func (r *Resource) SaveToDB(idx uint64) error {
@@ -109,44 +191,117 @@ func resourcePathFunc(shareType string) func(string) string {
 }
 
 func resourcePathFile(filename string) string {
-	p, err := filepath.Abs(path.Join(resDir, filename))
-	if err != nil {
-		return ""
+	if p, ok := resStorage.LocalPath(filename); ok {
+		return p
+	}
+	// remote storage, let onebot fetch it directly
+	if u, ok := resStorage.PresignedURL(filename, time.Duration(Config.ResourceSignTTL)*time.Second); ok {
+		return u
 	}
-	return p
+	log.Errorf("resource %s is neither local nor able to be presigned, please use ResourceShare = \"http\"", filename)
+	return ""
 }
 
 func resourcePathHttp(filename string) string {
-	signBytes := sha256.Sum256(append([]byte(filename), coldSalt...))
-	sign := hex.EncodeToString(signBytes[:])
-	return Config.HttpBackRef + "/contents/resources/" + filename + "?sign=" + sign
+	if Config.ResourceSign == "expiring" {
+		expire := time.Now().Unix() + Config.ResourceSignTTL
+		return Config.HttpBackRef + "/contents/resources/" + filename + "?expire=" + strconv.FormatInt(expire, 10) + "&sign=" + expiringSign(filename, expire)
+	}
+	return Config.HttpBackRef + "/contents/resources/" + filename + "?sign=" + permanentSign(filename)
+}
+
+// permanentSign never expires until coldSalt is rotated
+func permanentSign(filename string) string {
+	signBytes := sha256.Sum256(append([]byte(filename), getColdSalt()...))
+	return hex.EncodeToString(signBytes[:])
+}
+
+// expiringSign expires at given time, or when gypsum restarts (hotSalt is refreshed), or when coldSalt is rotated
+func expiringSign(filename string, expire int64) string {
+	signBytes := sha256.Sum256(append(append(append([]byte(filename), helper.U64ToBytes(uint64(expire))...), hotSalt...), getColdSalt()...))
+	return hex.EncodeToString(signBytes[:])
 }
 
 func serveResource(c *gin.Context) {
-	// 这种做法会导致onebot无法缓存文件，所以放弃
-	//filename := c.Params.ByName("filename")
-	//expireStr := c.Query("expire")
-	//sign := c.Query("sign")
-	//expire, err := strconv.ParseInt(expireStr, 10, 64)
-	//if err != nil {
-	//	c.String(400, "400 Bad Request: expire must be integer")
-	//	return
-	//}
-	//if time.Now().Unix() > expire {
-	//	c.String(403, "403 Forbidden: sign expired")
-	//	return
-	//}
-	//signedBytes := sha256.Sum256(append(append([]byte(filename), U64ToBytes(uint64(expire))...), hotSalt...))
-	//signed := hex.EncodeToString(signedBytes[:])
+	// 永久签名可以让 onebot 缓存文件，过期签名可以防止链接泄露后被长期使用，由配置文件选择
 	filename := c.Params.ByName("filename")
 	sign := c.Query("sign")
-	signedBytes := sha256.Sum256(append([]byte(filename), coldSalt...))
-	signed := hex.EncodeToString(signedBytes[:])
-	if sign != signed {
+	var signed string
+	// the presigned url of remote storage should not outlive the signature
+	ttl := Config.ResourceSignTTL
+	if Config.ResourceSign == "expiring" {
+		expireStr := c.Query("expire")
+		expire, err := strconv.ParseInt(expireStr, 10, 64)
+		if err != nil {
+			c.String(400, "400 Bad Request: expire must be integer")
+			return
+		}
+		if time.Now().Unix() > expire {
+			c.String(403, "403 Forbidden: sign expired")
+			return
+		}
+		signed = expiringSign(filename, expire)
+		if remaining := expire - time.Now().Unix(); remaining < ttl {
+			ttl = remaining
+		}
+	} else {
+		signed = permanentSign(filename)
+	}
+	if subtle.ConstantTimeCompare([]byte(sign), []byte(signed)) != 1 {
 		c.String(403, "403 Forbidden: sign error")
 		return
 	}
-	c.File(path.Join(resDir, filename))
+	if ttl < 1 {
+		ttl = 1
+	}
+	if u, ok := resStorage.PresignedURL(filename, time.Duration(ttl)*time.Second); ok {
+		c.Redirect(302, u)
+		return
+	}
+	serveStorageFile(c, filename, "")
+}
+
+// serveStorageFile writes file in storage to response, as attachment if attachmentName is not empty
+func serveStorageFile(c *gin.Context, filename, attachmentName string) {
+	if p, ok := resStorage.LocalPath(filename); ok {
+		if attachmentName == "" {
+			c.File(p)
+		} else {
+			c.FileAttachment(p, attachmentName)
+		}
+		return
+	}
+	reader, err := resStorage.Get(filename)
+	if err != nil {
+		if err == storage.ErrNotExist {
+			c.String(404, "404: resource not found")
+			return
+		}
+		log.Error(err)
+		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+		return
+	}
+	defer reader.Close()
+	extraHeaders := map[string]string{}
+	if attachmentName != "" {
+		extraHeaders["Content-Disposition"] = "attachment; filename*=utf-8''" + url.PathEscape(attachmentName)
+	}
+	c.DataFromReader(200, -1, mime.TypeByExtension(path.Ext(filename)), reader, extraHeaders)
+}
+
+func revokeResourceSigns(c *gin.Context) {
+	if err := rotateColdSalt(); err != nil {
+		log.Error(err)
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
 }
 
 func (r *Resource) GetParentID() uint64 {
@@ -167,6 +322,38 @@ func (r *Resource) NewParent(selfID, parentID uint64) error {
 	return err
 }
 
+// resourceFiles lists stored files of resources in the group and its sub groups
+func (g *Group) resourceFiles() []string {
+	files := make([]string, 0)
+	g.walkItems(func(item Item) {
+		if item.ItemType != ResourceItem {
+			return
+		}
+		if r, ok := resources[item.ItemID]; ok {
+			files = append(files, r.Sha256Sum+r.Ext)
+		}
+	})
+	return files
+}
+
+// deleteUnusedResourceFiles deletes the stored files that no resource refers to,
+// resources with same content share one file, so the file is kept while any of them remains
+func deleteUnusedResourceFiles(files []string) {
+	used := make(map[string]bool, len(resources))
+	for _, r := range resources {
+		used[r.Sha256Sum+r.Ext] = true
+	}
+	for _, file := range files {
+		if used[file] {
+			continue
+		}
+		used[file] = true // deleted once only
+		if err := resStorage.Delete(file); err != nil {
+			log.Errorf("error when delete resource file %s: %s", file, err)
+		}
+	}
+}
+
 func resourceIDByHash(sum string) (uint64, bool) {
 	if len(sum) != 64 {
 		return 0, false
@@ -234,11 +421,119 @@ func downloadResource(c *gin.Context) {
 		return
 	}
 	c.Header("ETag", r.Sha256Sum)
-	c.FileAttachment(path.Join(resDir, r.Sha256Sum+r.Ext), r.FileName+r.Ext)
+	serveStorageFile(c, r.Sha256Sum+r.Ext, r.FileName+r.Ext)
+}
+
+var errFileTooLarge = errors.New("file is too large")
+
+// receiveFile saves content to a temporary file while hashing it, so that large files never stay in memory.
+// the returned file is at its beginning, and should be released by discardTempFile
+func receiveFile(reader io.Reader, limit int64) (file *os.File, sum [32]byte, size int64, err error) {
+	file, err = os.CreateTemp(tempDir, "upload-*")
+	if err != nil {
+		return
+	}
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(file, hash), io.LimitReader(reader, limit+1))
+	if err == nil && size > limit {
+		err = errFileTooLarge
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		discardTempFile(file)
+		file = nil
+		return
+	}
+	copy(sum[:], hash.Sum(nil))
+	return
+}
+
+func discardTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
 }
 
 func uploadResource(c *gin.Context) {
-	fileFullName := c.Param("name")
+	parentID, ok := uploadParentID(c)
+	if !ok {
+		return
+	}
+	status, result := saveUploadedResource(parentID, c.Param("name"), c.Request.Body)
+	c.JSON(status, result)
+}
+
+// uploadResources accepts multipart form with several files, each file gets its own result
+func uploadResources(c *gin.Context) {
+	parentID, ok := uploadParentID(c)
+	if !ok {
+		return
+	}
+	multipartReader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(415, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("request is not multipart form: %s", err),
+		})
+		return
+	}
+	results := make([]gin.H, 0)
+	for {
+		part, err := multipartReader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(400, gin.H{
+				"code":    6000,
+				"message": fmt.Sprintf("error when reading request body: %s", err),
+				"results": results,
+			})
+			return
+		}
+		if part.FileName() == "" {
+			// not a file field
+			_ = part.Close()
+			continue
+		}
+		status, result := saveUploadedResource(parentID, part.FileName(), part)
+		_ = part.Close()
+		result["file_name"] = part.FileName()
+		result["status"] = status
+		results = append(results, result)
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+		"results": results,
+	})
+}
+
+func uploadParentID(c *gin.Context) (uint64, bool) {
+	parentStr := c.Param("gid")
+	if len(parentStr) == 0 {
+		return 0, true
+	}
+	parentID, err := strconv.ParseUint(parentStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return 0, false
+	}
+	if _, ok := groups[parentID]; !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "group not found",
+		})
+		return 0, false
+	}
+	return parentID, true
+}
+
+func saveUploadedResource(parentID uint64, fileFullName string, body io.Reader) (int, gin.H) {
 	nameSplit := strings.Split(fileFullName, ".")
 	var fileName, ext string
 	if len(nameSplit) == 1 {
@@ -248,67 +543,72 @@ func uploadResource(c *gin.Context) {
 		ext = "." + nameSplit[len(nameSplit)-1]
 		fileName = fileFullName[:len(fileFullName)-len(ext)]
 	}
-	parentStr := c.Param("gid")
-	var parentID uint64
-	if len(parentStr) == 0 {
-		parentID = 0
-	} else {
-		var err error
-		parentID, err = strconv.ParseUint(parentStr, 10, 64)
-		if err != nil {
-			c.JSON(404, gin.H{
-				"code":    1000,
-				"message": "no such group",
-			})
-			return
-		}
-	}
 	parentGroup, ok := groups[parentID]
 	if !ok {
-		c.JSON(404, gin.H{
+		return 404, gin.H{
 			"code":    1000,
 			"message": "group not found",
-		})
-		return
+		}
 	}
-	bodyReader := c.Request.Body
-	body, err := io.ReadAll(bodyReader)
+	tempFile, hashBytes, size, err := receiveFile(body, Config.MaxResourceSize<<20)
 	if err != nil {
-		c.JSON(500, gin.H{
+		if err == errFileTooLarge {
+			return 413, gin.H{
+				"code":    6001,
+				"message": fmt.Sprintf("file is larger than %d MiB", Config.MaxResourceSize),
+			}
+		}
+		return 500, gin.H{
 			"code":    6000,
 			"message": fmt.Sprintf("error when reading request body: %s", err),
-		})
-		return
+		}
 	}
-	hashBytes := sha256.Sum256(body)
+	defer discardTempFile(tempFile)
 	hashHex := hex.EncodeToString(hashBytes[:])
 	// check if resource already exist
 	idx, err := db.Get(append([]byte("gypsum-resources_hash-"), hashBytes[:]...), nil)
 	if err == nil {
 		// already exist
-		c.JSON(200, gin.H{
+		return 200, gin.H{
 			"code":        1,
 			"message":     "already exist",
 			"resource_id": helper.ToUint(idx),
-		})
-		return
+		}
 	} else {
 		if err != leveldb.ErrNotFound {
 			// error other than "ErrNotFound"
-			c.JSON(500, gin.H{
+			return 500, gin.H{
 				"code":    3000,
 				"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-			})
-			return
+			}
 		}
 	}
 	// not exist, go on
-	if err := os.WriteFile(path.Join(resDir, hashHex+ext), body, 0444); err != nil {
-		c.JSON(500, gin.H{
+	info, err := mediainfo.Probe(tempFile)
+	if err != nil {
+		log.Warnf("error when probing resource %s: %s", hashHex, err)
+	}
+	var warning string
+	if !mediainfo.MatchExtension(info.MIME, ext) {
+		// images and audios are sent by onebot according to extension, so the extension is corrected
+		if proper := mediainfo.MediaExtension(info.MIME); proper != "" {
+			warning = fmt.Sprintf("extension %s does not match the content type %s, it is changed to %s", ext, info.MIME, proper)
+			ext = proper
+		} else {
+			warning = fmt.Sprintf("extension %s does not match the content type %s", ext, info.MIME)
+		}
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		return 500, gin.H{
+			"code":    6000,
+			"message": fmt.Sprintf("error when reading file: %s", err),
+		}
+	}
+	if err := resStorage.Put(hashHex+ext, tempFile, size); err != nil {
+		return 500, gin.H{
 			"code":    6000,
 			"message": fmt.Sprintf("error when writing file: %s", err),
-		})
-		return
+		}
 	}
 	// save info data
 	itemCursor++
@@ -320,53 +620,53 @@ func uploadResource(c *gin.Context) {
 	})
 	if err := parentGroup.SaveToDB(parentID); err != nil {
 		log.Error(err)
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
 	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
 	resource := Resource{
 		FileName:    fileName,
 		Ext:         ext,
 		Sha256Sum:   hashHex,
+		Size:        size,
+		UploadTime:  time.Now().Unix(),
 		ParentGroup: parentID,
 	}
+	resource.setMediaInfo(info)
 	v, err := resource.ToBytes()
 	if err != nil {
-		c.JSON(400, gin.H{
+		return 400, gin.H{
 			"code":    2000,
 			"message": fmt.Sprintf("converting error: %s", err),
-		})
-		return
+		}
 	}
 	if err = db.Put(append([]byte("gypsum-resources-"), helper.U64ToBytes(cursor)...), v, nil); err != nil {
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
 	if err = db.Put(append([]byte("gypsum-resources_hash-"), hashBytes[:]...), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
+		return 500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
+		}
 	}
 	resources[cursor] = &resource
-	c.JSON(201, gin.H{
+	return 201, gin.H{
 		"code":        0,
 		"message":     "ok",
 		"resource_id": cursor,
-	})
+		"mime":        resource.MIME,
+		"warning":     warning,
+	}
 }
 
 func deleteResource(c *gin.Context) {
@@ -441,6 +741,9 @@ func renameResource(c *gin.Context) {
 	if err = ChangeNameForParent(r.ParentGroup, resourceID, np.FileName+r.Ext); err != nil {
 		log.Errorf("error when change resource %d from parent group %d: %s", resourceID, r.ParentGroup, err)
 	}
+	if err = markCustomized(r.ParentGroup, resourceID); err != nil {
+		log.Errorf("error when mark resource %d customized in parent group %d: %s", resourceID, r.ParentGroup, err)
+	}
 	if err = r.SaveToDB(resourceID); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3000,
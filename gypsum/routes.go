@@ -41,9 +41,17 @@ func initWeb() {
 	api.POST("/groups", createGroup)
 	api.POST("/groups/:gid/groups", createGroup)
 	api.PUT("/groups/:gid/items/:type/:iid", addGroupItem)
+	api.PATCH("/groups/:gid/items/:type/:iid", patchGroupItem)
 	api.GET("/groups/:gid/archive", exportGroup)
 	api.DELETE("/groups/:gid", deleteGroup)
-	api.PATCH("/groups/:gid", renameGroup)
+	api.PATCH("/groups/:gid", patchGroup)
+	api.GET("/groups/:gid/parameters", getGroupParameters)
+	api.PUT("/groups/:gid/parameters", modifyGroupParameters)
+	api.GET("/plugins", getInstalledPlugins)
+	api.GET("/plugins/search", searchPlugins)
+	api.POST("/plugins/install", installPlugin)
+	api.POST("/plugins/upgrade", upgradePlugin)
+	api.POST("/plugins/uninstall", uninstallPlugin)
 	api.GET("/rules", getRules)
 	api.GET("/rules/:rid", getRuleByID)
 	api.POST("/rules", createRule)
@@ -62,20 +70,37 @@ func initWeb() {
 	api.POST("/groups/:gid/jobs", createJob)
 	api.DELETE("/jobs/:jid", deleteJob)
 	api.PUT("/jobs/:jid", modifyJob)
+	api.GET("/snippets", getSnippets)
+	api.GET("/snippets/:sid", getSnippetByID)
+	api.POST("/snippets", createSnippet)
+	api.POST("/groups/:gid/snippets", createSnippet)
+	api.DELETE("/snippets/:sid", deleteSnippet)
+	api.PUT("/snippets/:sid", modifySnippet)
 	api.GET("/resources", getResources)
 	api.GET("/resources/:rid", getResourceByID)
 	api.GET("/resources/:rid/content", downloadResource)
+	api.POST("/resources", uploadResources)
 	api.POST("/resources/:name", uploadResource)
+	api.POST("/groups/:gid/resources", uploadResources)
 	api.POST("/groups/:gid/resources/:name", uploadResource)
 	api.DELETE("/resources/:rid", deleteResource)
 	api.PATCH("/resources/:rid", renameResource)
+	api.GET("/vars/users/:uid", getUserVars)
+	api.GET("/vars/groups/:gid", getGroupVars)
+	api.PUT("/vars", modifyScopedVar)
+	api.DELETE("/vars", deleteScopedVar)
 
 	// debug
 	api.POST("/debug", userTest)
+	api.GET("/executions", getExecutions)
+	api.DELETE("/executions/:eid", cancelExecution)
+	api.GET("/lint", getLintIssues)
+	api.POST("/lint", lintTemplate)
 
 	// admin
 	api.GET("/gypsum/update", getUpdateStatus)
 	api.PUT("/gypsum/update", requestUpdateGypsum)
+	api.DELETE("/gypsum/resource_signs", revokeResourceSigns)
 	// admin (non-auth)
 	r.GET("/api/v1/gypsum/information", getGypsumInformation)
 	r.PUT("/api/v1/gypsum/login", loginHandler)
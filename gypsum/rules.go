@@ -55,18 +55,21 @@ var messageTypeTable = map[string]MessageType{
 }
 
 type Rule struct {
-	DisplayName string      `json:"display_name"`
-	Active      bool        `json:"active"`
-	MessageType MessageType `json:"message_type"`
-	GroupsID    []int64     `json:"groups_id"`
-	UsersID     []int64     `json:"users_id"`
-	MatcherType RuleType    `json:"matcher_type"`
-	Patterns    []string    `json:"patterns"`
-	OnlyAtMe    bool        `json:"only_at_me"`
-	Response    string      `json:"response"`
-	Priority    int         `json:"priority"`
-	Block       bool        `json:"block"`
-	ParentGroup uint64      `json:"-"`
+	DisplayName string          `json:"display_name"`
+	Active      bool            `json:"active"`
+	MessageType MessageType     `json:"message_type"`
+	GroupsID    []int64         `json:"groups_id"`
+	UsersID     []int64         `json:"users_id"`
+	GroupsParam string          `json:"groups_param,omitempty"` // name of parameter holding extra groups id
+	UsersParam  string          `json:"users_param,omitempty"`  // name of parameter holding extra user id
+	MatcherType RuleType        `json:"matcher_type"`
+	Patterns    []string        `json:"patterns"`
+	OnlyAtMe    bool            `json:"only_at_me"`
+	Response    string          `json:"response"`
+	Priority    int             `json:"priority"`
+	Block       bool            `json:"block"`
+	Outbound    *OutboundPolicy `json:"outbound,omitempty"` // overrides policy in config
+	ParentGroup uint64          `json:"-"`
 }
 
 var (
@@ -143,17 +146,19 @@ func (r *Rule) Register(id uint64) error {
 	if !r.Active {
 		return nil
 	}
-	tmpl, err := pongo2.FromString(r.Response)
+	tmpl, err := templateSet.FromString(r.Response)
 	if err != nil {
 		log.Errorf("模板预处理出错：%s", err)
 		return err
 	}
-	rules := []zero.Rule{typeRule(r.MessageType)}
-	if len(r.GroupsID) != 0 {
-		rules = append(rules, groupsRule(r.GroupsID))
+	parentID := func() uint64 { return r.ParentGroup }
+	policy := outboundPolicy(r.Outbound)
+	rules := []zero.Rule{unclaimedRule, groupActiveRule(parentID), typeRule(r.MessageType)}
+	if len(r.GroupsID) != 0 || r.GroupsParam != "" {
+		rules = append(rules, paramIDsRule(r.GroupsID, parentID, r.GroupsParam, groupsRule))
 	}
-	if len(r.UsersID) != 0 {
-		rules = append(rules, usersRule(r.UsersID))
+	if len(r.UsersID) != 0 || r.UsersParam != "" {
+		rules = append(rules, paramIDsRule(r.UsersID, parentID, r.UsersParam, usersRule))
 	}
 	if r.OnlyAtMe {
 		rules = append(rules, zero.OnlyToMe)
@@ -182,26 +187,47 @@ func (r *Rule) Register(id uint64) error {
 		log.Errorf("Unknown type %#v", r.MatcherType)
 		return errors.New(fmt.Sprintf("Unknown type %#v", r.MatcherType))
 	}
-	zeroMatcher[id] = zero.OnMessage(append(rules, msgRule)...).SetPriority(r.Priority).SetBlock(r.Block).Handle(templateRuleHandler(*tmpl, zero.Send, log.Error))
+	zeroMatcher[id] = zero.OnMessage(append(rules, msgRule)...).SetPriority(r.Priority).SetBlock(r.Block && !mayPass(tmpl)).Handle(blockable(r.Block, templateRuleHandler(*tmpl, RuleItem, id, parentID, &policy, zero.Send, log.Error)))
 	return nil
 }
 
-func templateRuleHandler(tmpl pongo2.Template, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
+// policy is nil if reply should be sent as it is
+func templateRuleHandler(tmpl pongo2.Template, itemType ItemType, itemID uint64, parentID func() uint64, policy *OutboundPolicy, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
 	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
+		execCtx, finish, ok := startExecution(itemType, itemID)
+		if !ok {
+			return zero.FinishResponse
+		}
+		defer finish()
 		var luaState *lua.LState
 		defer func() {
 			if luaState != nil {
 				luaState.Close()
 			}
 		}()
-		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, luaState))
+		ctx := buildExecutionContext(execCtx, matcher, event, state, luaState, parentID)
+		reply, err := tmpl.Execute(ctx)
 		if err != nil {
 			errLogger("渲染模板出错：" + err.Error())
 			return zero.FinishResponse
 		}
+		if execCtx.Err() != nil {
+			errLogger("执行超时或被取消，不会发送回复")
+			return zero.FinishResponse
+		}
+		if passed(ctx) {
+			return PassResponse
+		}
 		reply = strings.TrimSpace(reply)
-		if reply != "" {
+		if reply == "" {
+			return zero.FinishResponse
+		}
+		if policy == nil {
 			send(event, reply)
+		} else if err := policy.deliver(execCtx, reply, event.GroupID, func(msg string) {
+			send(event, msg)
+		}); err != nil {
+			errLogger("发送回复时执行超时或被取消，其余消息不会发送")
 		}
 		return zero.FinishResponse
 	}
@@ -247,7 +273,7 @@ func checkRegex(pattern string) error {
 }
 
 func checkTemplate(template string) error {
-	_, err := pongo2.FromString(template)
+	_, err := templateSet.FromString(template)
 	return err
 }
 
@@ -398,9 +424,10 @@ func createRule(c *gin.Context) {
 	}
 	rules[cursor] = &rule
 	c.JSON(201, gin.H{
-		"code":    0,
-		"message": "ok",
-		"rule_id": cursor,
+		"code":     0,
+		"message":  "ok",
+		"rule_id":  cursor,
+		"warnings": lintWarnings(rule.Response, false),
 	})
 	return
 }
@@ -528,9 +555,13 @@ func modifyRule(c *gin.Context) {
 			log.Errorf("error when change rule %d from parent group %d: %s", ruleID, newRule.ParentGroup, err)
 		}
 	}
+	if err = markCustomized(newRule.ParentGroup, ruleID); err != nil {
+		log.Errorf("error when mark rule %d customized in parent group %d: %s", ruleID, newRule.ParentGroup, err)
+	}
 	c.JSON(200, gin.H{
-		"code":    0,
-		"message": "ok",
+		"code":     0,
+		"message":  "ok",
+		"warnings": lintWarnings(newRule.Response, false),
 	})
 	return
 }
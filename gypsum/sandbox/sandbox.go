@@ -0,0 +1,241 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Policy limits file and network access of templates and lua
+type Policy struct {
+	BaseDirs        []string // directories that can be read, relative to working directory
+	AllowedHosts    []string // hosts that can be requested, "*" for any host, "*.example.com" for subdomains
+	Timeout         int64    // seconds
+	MaxResponseSize int64    // KiB
+}
+
+// Config is the policy in config file, policies of plugins override it.
+// In policies of plugins, a missing list inherits the list of config file,
+// while an empty list allows nothing.
+type Config struct {
+	Policy
+	Plugins map[string]Policy // keyed by plugin name
+}
+
+// Merge overrides the policy with fields set in another policy,
+// lists are overridden unless they are nil, so an empty list narrows the policy to nothing
+func (p Policy) Merge(override Policy) Policy {
+	if override.BaseDirs != nil {
+		p.BaseDirs = override.BaseDirs
+	}
+	if override.AllowedHosts != nil {
+		p.AllowedHosts = override.AllowedHosts
+	}
+	if override.Timeout > 0 {
+		p.Timeout = override.Timeout
+	}
+	if override.MaxResponseSize > 0 {
+		p.MaxResponseSize = override.MaxResponseSize
+	}
+	return p
+}
+
+var (
+	ErrPathNotAllowed    = errors.New("path is outside of allowed directories")
+	ErrHostNotAllowed    = errors.New("host is not allowed")
+	ErrResponseTooLarge  = errors.New("response is too large")
+	ErrSchemeNotAllowed  = errors.New("only http and https are allowed")
+	ErrSandboxNotDefined = errors.New("sandbox is not defined")
+)
+
+// Sandbox checks file and network access according to a policy
+type Sandbox struct {
+	baseDirs []string // absolute paths with symlinks resolved
+	hosts    []string
+	timeout  time.Duration
+	maxSize  int64 // bytes
+}
+
+func New(p Policy) *Sandbox {
+	s := &Sandbox{
+		baseDirs: make([]string, 0, len(p.BaseDirs)),
+		hosts:    make([]string, len(p.AllowedHosts)),
+		timeout:  time.Duration(p.Timeout) * time.Second,
+		maxSize:  p.MaxResponseSize * 1024,
+	}
+	for _, dir := range p.BaseDirs {
+		abs, err := realPath(dir)
+		if err != nil {
+			continue
+		}
+		s.baseDirs = append(s.baseDirs, abs)
+	}
+	for i, host := range p.AllowedHosts {
+		s.hosts[i] = strings.ToLower(host)
+	}
+	return s
+}
+
+func realPath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real, nil
+	}
+	// the file does not exist, resolve its directory instead
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs, nil
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// Path checks the file and returns its real path
+func (s *Sandbox) Path(name string) (string, error) {
+	if s == nil {
+		return "", ErrSandboxNotDefined
+	}
+	abs, err := realPath(name)
+	if err != nil {
+		return "", err
+	}
+	for _, base := range s.baseDirs {
+		rel, err := filepath.Rel(base, abs)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrPathNotAllowed, name)
+}
+
+func (s *Sandbox) ReadFile(name string) ([]byte, error) {
+	p, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (s *Sandbox) ReadDir(name string) ([]os.DirEntry, error) {
+	p, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+// BaseDirs returns absolute paths of the directories that can be read
+func (s *Sandbox) BaseDirs() []string {
+	if s == nil {
+		return nil
+	}
+	return s.baseDirs
+}
+
+// HostAllowed checks the host name (without port)
+func (s *Sandbox) HostAllowed(host string) bool {
+	if s == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range s.hosts {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case pattern == host:
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns a http client that can only request allowed hosts,
+// redirects are checked as well.
+func (s *Sandbox) Client() *http.Client {
+	var timeout time.Duration
+	if s != nil {
+		timeout = s.timeout
+	}
+	return &http.Client{
+		Transport: transport{s},
+		Timeout:   timeout,
+	}
+}
+
+// Get requests the url and reads the whole body
+func (s *Sandbox) Get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("http status %d", res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
+
+type transport struct {
+	sandbox *Sandbox
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, ErrSchemeNotAllowed
+	}
+	if !t.sandbox.HostAllowed(req.URL.Hostname()) {
+		return nil, fmt.Errorf("%w: %s", ErrHostNotAllowed, req.URL.Hostname())
+	}
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.sandbox.maxSize > 0 {
+		if res.ContentLength > t.sandbox.maxSize {
+			res.Body.Close()
+			return nil, ErrResponseTooLarge
+		}
+		res.Body = &limitedBody{ReadCloser: res.Body, remaining: t.sandbox.maxSize}
+	}
+	return res, nil
+}
+
+// limitedBody fails when the body is longer than limit, instead of truncating it silently
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(root, "base")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(base, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(base, "a.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a sibling directory sharing the prefix of base
+	if err := os.Mkdir(base+"-evil", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(base, "escape"):     outside,
+		filepath.Join(base, "secret.txt"): filepath.Join(outside, "secret.txt"),
+		filepath.Join(base, "inner"):      filepath.Join(base, "sub"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+	}
+
+	box := New(Policy{BaseDirs: []string{base}})
+	allowed := map[string]string{
+		filepath.Join(base, "a.txt"): filepath.Join(base, "a.txt"),
+		base:                         base,
+		filepath.Join(base, "sub", "..", "a.txt"): filepath.Join(base, "a.txt"),
+		filepath.Join(base, "inner", "new.txt"):   filepath.Join(base, "sub", "new.txt"),
+		filepath.Join(base, "not-exist.txt"):      filepath.Join(base, "not-exist.txt"),
+	}
+	for name, want := range allowed {
+		got, err := box.Path(name)
+		if err != nil {
+			t.Errorf("Path(%q): %s", name, err)
+		} else if got != want {
+			t.Errorf("Path(%q) = %q, want %q", name, got, want)
+		}
+	}
+	denied := []string{
+		filepath.Join(base, "..", "outside", "secret.txt"),
+		filepath.Join(outside, "secret.txt"),
+		filepath.Join(base, "escape", "secret.txt"),
+		filepath.Join(base, "escape"),
+		filepath.Join(base, "secret.txt"),
+		filepath.Join(base, "escape", "not-exist.txt"),
+		filepath.Join(base+"-evil", "a.txt"),
+		root,
+	}
+	for _, name := range denied {
+		if got, err := box.Path(name); !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("Path(%q) = %q, %v, want it denied", name, got, err)
+		}
+	}
+
+	if _, err := New(Policy{}).Path(filepath.Join(base, "a.txt")); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("sandbox without base dirs allows files: %v", err)
+	}
+	var undefined *Sandbox
+	if _, err := undefined.Path(filepath.Join(base, "a.txt")); err != ErrSandboxNotDefined {
+		t.Errorf("undefined sandbox: got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	global := Policy{
+		BaseDirs:        []string{"resources"},
+		AllowedHosts:    []string{"*"},
+		Timeout:         10,
+		MaxResponseSize: 2048,
+	}
+	cases := []struct {
+		name     string
+		override Policy
+		want     Policy
+	}{
+		{"inherit", Policy{}, global},
+		{"narrow", Policy{AllowedHosts: []string{"api.example.com"}, Timeout: 3},
+			Policy{BaseDirs: []string{"resources"}, AllowedHosts: []string{"api.example.com"}, Timeout: 3, MaxResponseSize: 2048}},
+		{"none", Policy{BaseDirs: []string{}, AllowedHosts: []string{}},
+			Policy{BaseDirs: []string{}, AllowedHosts: []string{}, Timeout: 10, MaxResponseSize: 2048}},
+	}
+	for _, c := range cases {
+		if got := global.Merge(c.override); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+	if New(global.Merge(Policy{AllowedHosts: []string{}})).HostAllowed("example.com") {
+		t.Error("empty AllowedHosts of plugin does not forbid network")
+	}
+}
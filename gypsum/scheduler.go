@@ -2,6 +2,7 @@ package gypsum
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"strconv"
@@ -16,17 +17,21 @@ import (
 	lua "github.com/yuin/gopher-lua"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/template"
 )
 
 type Job struct {
-	DisplayName string  `json:"display_name"`
-	Active      bool    `json:"active"`
-	GroupsID    []int64 `json:"groups_id"`
-	UsersID     []int64 `json:"users_id"`
-	Once        bool    `json:"once"`
-	CronSpec    string  `json:"cron_spec"`
-	Action      string  `json:"action"`
-	ParentGroup uint64  `json:"-"`
+	DisplayName string          `json:"display_name"`
+	Active      bool            `json:"active"`
+	GroupsID    []int64         `json:"groups_id"`
+	UsersID     []int64         `json:"users_id"`
+	GroupsParam string          `json:"groups_param,omitempty"` // name of parameter holding extra groups id
+	UsersParam  string          `json:"users_param,omitempty"`  // name of parameter holding extra user id
+	Once        bool            `json:"once"`
+	CronSpec    string          `json:"cron_spec"`
+	Action      string          `json:"action"`
+	Outbound    *OutboundPolicy `json:"outbound,omitempty"` // overrides policy in config
+	ParentGroup uint64          `json:"-"`
 }
 
 var (
@@ -59,34 +64,47 @@ func JobFromBytes(b []byte) (*Job, error) {
 }
 
 func (j *Job) Executor() (func(), *uint64, error) {
-	tmpl, err := pongo2.FromString(j.Action)
+	tmpl, err := templateSet.FromString(j.Action)
 	if err != nil {
 		return nil, nil, err
 	}
 	jobID := ^uint64(0)
+	policy := outboundPolicy(j.Outbound)
 	return func() {
+		if !groupActive(j.ParentGroup, 0) {
+			return
+		}
+		execCtx, finish, ok := startExecution(SchedulerItem, jobID)
+		if !ok {
+			return
+		}
+		defer finish()
 		var luaState *lua.LState
 		defer func() {
 			if luaState != nil {
 				luaState.Close()
 			}
 		}()
-		msg, err := tmpl.Execute(pongo2.Context{
+		ctx := pongo2.Context{
 			"_lua": luaState,
-		})
+		}
+		ctx.Update(template.NewQuery(0).Context())
+		msg, err := tmpl.Execute(bindExecution(setNamespace(ctx, j.ParentGroup), execCtx))
 		if err != nil {
 			log.Errorf("渲染模板出错：%s", err)
 			return
 		}
+		if execCtx.Err() != nil {
+			log.Errorf("定时任务 %d 执行超时或被取消，不会发送结果", jobID)
+			return
+		}
 		msg = strings.TrimSpace(msg)
 		if msg != "" {
-			for _, friend := range j.UsersID {
-				zero.SendPrivateMessage(friend, msg)
-			}
-			for _, group := range j.GroupsID {
-				zero.SendGroupMessage(group, msg)
+			if err := j.deliver(execCtx, policy, msg); err != nil {
+				log.Errorf("定时任务 %d 发送结果时执行超时或被取消，其余消息不会发送", jobID)
+			} else {
+				log.Infof("scheduled job executed: %s", msg)
 			}
-			log.Infof("scheduled job executed: %s", msg)
 		}
 		if j.Once {
 			delete(jobs, jobID)
@@ -98,6 +116,32 @@ func (j *Job) Executor() (func(), *uint64, error) {
 	}, &jobID, nil
 }
 
+// deliver sends result of the job to its users and groups, it stops when ctx is done
+func (j *Job) deliver(ctx context.Context, policy OutboundPolicy, msg string) error {
+	usersID, _ := resolveIDs(j.UsersID, j.ParentGroup, j.UsersParam)
+	for _, friend := range usersID {
+		friend := friend
+		if err := policy.deliver(ctx, msg, 0, func(m string) {
+			zero.SendPrivateMessage(friend, m)
+		}); err != nil {
+			return err
+		}
+	}
+	groupsID, _ := resolveIDs(j.GroupsID, j.ParentGroup, j.GroupsParam)
+	for _, group := range groupsID {
+		if !groupActive(j.ParentGroup, group) {
+			continue
+		}
+		group := group
+		if err := policy.deliver(ctx, msg, group, func(m string) {
+			zero.SendGroupMessage(group, m)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (j *Job) Register(id uint64) error {
 	if !j.Active {
 		return nil
@@ -292,9 +336,10 @@ func createJob(c *gin.Context) {
 	}
 	jobs[cursor] = &job
 	c.JSON(201, gin.H{
-		"code":    0,
-		"message": "ok",
-		"job_id":  cursor,
+		"code":     0,
+		"message":  "ok",
+		"job_id":   cursor,
+		"warnings": lintWarnings(job.Action, true),
 	})
 	return
 }
@@ -406,9 +451,13 @@ func modifyJob(c *gin.Context) {
 			log.Errorf("error when change job %d from parent group %d: %s", jobID, newJob.ParentGroup, err)
 		}
 	}
+	if err = markCustomized(newJob.ParentGroup, jobID); err != nil {
+		log.Errorf("error when mark job %d customized in parent group %d: %s", jobID, newJob.ParentGroup, err)
+	}
 	c.JSON(200, gin.H{
-		"code":    0,
-		"message": "ok",
+		"code":     0,
+		"message":  "ok",
+		"warnings": lintWarnings(newJob.Action, true),
 	})
 	return
 }
@@ -0,0 +1,321 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	signatureFileName     = "gypsum-signature.json"
+	signingKeyFile        = "gypsum_signing.key"
+	trustedPublishersFile = "gypsum_trusted_publishers.txt"
+)
+
+var errNoSigningKey = errors.New("signing key not found, generate one by `gypsum key generate`")
+
+type SignatureStatus string
+
+const (
+	SignatureUnsigned  SignatureStatus = "unsigned"
+	SignatureUntrusted SignatureStatus = "untrusted" // signature is valid, but the publisher is not trusted
+	SignatureTrusted   SignatureStatus = "trusted"
+	SignatureInvalid   SignatureStatus = "invalid" // archive is modified after signed
+)
+
+type ArchiveSignature struct {
+	Status    SignatureStatus `json:"status"`
+	Publisher string          `json:"publisher,omitempty"`
+	PublicKey string          `json:"public_key,omitempty"`
+}
+
+type signatureFile struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+type Publisher struct {
+	Name      string
+	PublicKey string
+}
+
+// archiveWriter is implemented by *zip.Writer and *hashingArchiveWriter
+type archiveWriter interface {
+	Create(name string) (io.Writer, error)
+}
+
+// hashingArchiveWriter records sha256 of every file written into zipfile, so that the zipfile can be signed
+type hashingArchiveWriter struct {
+	zipWriter *zip.Writer
+	sums      map[string]hash.Hash
+}
+
+func newHashingArchiveWriter(zipWriter *zip.Writer) *hashingArchiveWriter {
+	return &hashingArchiveWriter{
+		zipWriter: zipWriter,
+		sums:      make(map[string]hash.Hash),
+	}
+}
+
+func (w *hashingArchiveWriter) Create(name string) (io.Writer, error) {
+	if _, ok := w.sums[name]; ok {
+		return nil, fmt.Errorf("duplicated file in archive: %s", name)
+	}
+	f, err := w.zipWriter.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	w.sums[name] = h
+	return io.MultiWriter(f, h), nil
+}
+
+func (w *hashingArchiveWriter) digest() []byte {
+	sums := make(map[string][]byte, len(w.sums))
+	for name, h := range w.sums {
+		sums[name] = h.Sum(nil)
+	}
+	return archiveDigest(sums)
+}
+
+// archiveDigest summarizes all files in archive, file names are sorted so that the order in zipfile does not matter
+func archiveDigest(sums map[string][]byte) []byte {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(h, "%s\n%s\n", name, hex.EncodeToString(sums[name]))
+	}
+	return h.Sum(nil)
+}
+
+// signArchive writes signature file of all files written by w
+func signArchive(w *hashingArchiveWriter, privateKey ed25519.PrivateKey) error {
+	sig := signatureFile{
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, w.digest())),
+	}
+	sigBytes, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := w.zipWriter.Create(signatureFileName)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(sigBytes)
+	return err
+}
+
+// verifyArchive checks signature of zipfile, and looks up the publisher in trusted publishers
+func verifyArchive(zipReader *zip.Reader) (ArchiveSignature, error) {
+	var sigEntry *zip.File
+	sums := make(map[string][]byte, len(zipReader.File))
+	for _, file := range zipReader.File {
+		if _, ok := sums[file.Name]; ok || (file.Name == signatureFileName && sigEntry != nil) {
+			// readers may take either one of duplicated files, so none of them can be trusted
+			return ArchiveSignature{Status: SignatureInvalid}, nil
+		}
+		if file.Name == signatureFileName {
+			sigEntry = file
+			continue
+		}
+		fr, err := file.Open()
+		if err != nil {
+			return ArchiveSignature{}, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, fr)
+		_ = fr.Close()
+		if err != nil {
+			return ArchiveSignature{}, err
+		}
+		sums[file.Name] = h.Sum(nil)
+	}
+	if sigEntry == nil {
+		return ArchiveSignature{Status: SignatureUnsigned}, nil
+	}
+	fr, err := sigEntry.Open()
+	if err != nil {
+		return ArchiveSignature{}, err
+	}
+	defer fr.Close()
+	var sig signatureFile
+	if err := json.NewDecoder(io.LimitReader(fr, 1<<16)).Decode(&sig); err != nil {
+		return ArchiveSignature{Status: SignatureInvalid}, nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize || sig.Algorithm != "ed25519" {
+		return ArchiveSignature{Status: SignatureInvalid}, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil || !ed25519.Verify(publicKey, archiveDigest(sums), signature) {
+		return ArchiveSignature{Status: SignatureInvalid, PublicKey: sig.PublicKey}, nil
+	}
+	publishers, err := TrustedPublishers()
+	if err != nil {
+		return ArchiveSignature{}, err
+	}
+	for _, p := range publishers {
+		if subtle.ConstantTimeCompare([]byte(p.PublicKey), []byte(sig.PublicKey)) == 1 {
+			return ArchiveSignature{
+				Status:    SignatureTrusted,
+				Publisher: p.Name,
+				PublicKey: sig.PublicKey,
+			}, nil
+		}
+	}
+	return ArchiveSignature{
+		Status:    SignatureUntrusted,
+		PublicKey: sig.PublicKey,
+	}, nil
+}
+
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(signingKeyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoSigningKey
+		}
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode %s", signingKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", signingKeyFile)
+	}
+	return privateKey, nil
+}
+
+// GenerateSigningKey creates a new key for signing plugins and returns its public key
+func GenerateSigningKey(force bool) (string, error) {
+	if _, err := os.Stat(signingKeyFile); err == nil && !force {
+		return "", fmt.Errorf("%s already exists", signingKeyFile)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(signingKeyFile, keyBytes, 0600); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// SigningPublicKey returns the public key of current signing key, which can be shared to others to be trusted
+func SigningPublicKey() (string, error) {
+	privateKey, err := loadSigningKey()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)), nil
+}
+
+// TrustedPublishers reads trusted publishers file, each line is a public key followed by the name of publisher
+func TrustedPublishers() ([]Publisher, error) {
+	content, err := os.ReadFile(trustedPublishersFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Publisher{}, nil
+		}
+		return nil, err
+	}
+	publishers := make([]Publisher, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		p := Publisher{PublicKey: fields[0]}
+		if len(fields) == 2 {
+			p.Name = strings.TrimSpace(fields[1])
+		}
+		publishers = append(publishers, p)
+	}
+	return publishers, scanner.Err()
+}
+
+func saveTrustedPublishers(publishers []Publisher) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString("# gypsum trusted plugin publishers\n# <public key> <name>\n")
+	for _, p := range publishers {
+		_, _ = fmt.Fprintf(buf, "%s %s\n", p.PublicKey, p.Name)
+	}
+	return os.WriteFile(trustedPublishersFile, buf.Bytes(), 0644)
+}
+
+// TrustPublisher adds a publisher to trusted publishers, the name is updated if the key is already trusted
+func TrustPublisher(name, publicKey string) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key")
+	}
+	if name == "" || strings.ContainsAny(name, "\r\n") {
+		return errors.New("invalid publisher name")
+	}
+	publishers, err := TrustedPublishers()
+	if err != nil {
+		return err
+	}
+	for i := range publishers {
+		if publishers[i].PublicKey == publicKey {
+			publishers[i].Name = name
+			return saveTrustedPublishers(publishers)
+		}
+	}
+	return saveTrustedPublishers(append(publishers, Publisher{Name: name, PublicKey: publicKey}))
+}
+
+// DistrustPublisher removes publishers by name or public key, and returns the number of removed publishers
+func DistrustPublisher(nameOrKey string) (int, error) {
+	publishers, err := TrustedPublishers()
+	if err != nil {
+		return 0, err
+	}
+	kept := make([]Publisher, 0, len(publishers))
+	for _, p := range publishers {
+		if p.Name != nameOrKey && p.PublicKey != nameOrKey {
+			kept = append(kept, p)
+		}
+	}
+	removed := len(publishers) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, saveTrustedPublishers(kept)
+}
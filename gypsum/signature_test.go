@@ -0,0 +1,184 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"testing"
+)
+
+type testEntry struct {
+	name    string
+	content string
+}
+
+// useTestDir runs the test in a temporary working directory, where trusted publishers file is read
+func useTestDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+}
+
+func newTestKey(t *testing.T) (ed25519.PrivateKey, string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey, base64.StdEncoding.EncodeToString(publicKey)
+}
+
+func writeTestArchive(t *testing.T, entries []testEntry) *zip.Reader {
+	buffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buffer)
+	for _, e := range entries {
+		f, err := zipWriter.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipReader
+}
+
+// signTestEntries signs the entries and returns them with the signature file appended
+func signTestEntries(t *testing.T, entries []testEntry, key ed25519.PrivateKey) []testEntry {
+	buffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buffer)
+	archive := newHashingArchiveWriter(zipWriter)
+	for _, e := range entries {
+		f, err := archive.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := signArchive(archive, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range zipReader.File {
+		if file.Name != signatureFileName {
+			continue
+		}
+		fr, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := io.ReadAll(fr)
+		_ = fr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(append([]testEntry{}, entries...), testEntry{signatureFileName, string(sig)})
+	}
+	t.Fatal("signature file is not written")
+	return nil
+}
+
+func TestVerifyArchive(t *testing.T) {
+	useTestDir(t)
+	key, publicKey := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+	entries := []testEntry{
+		{manifestFileName, `{"schema_version":1,"items":[]}`},
+		{"templates/01-hello.tmpl", "hello"},
+		{"resources/abc.png", "png"},
+	}
+	signed := signTestEntries(t, entries, key)
+	sig := signed[len(signed)-1]
+	cases := []struct {
+		name    string
+		entries []testEntry
+		want    SignatureStatus
+	}{
+		{"unsigned", entries, SignatureUnsigned},
+		{"signed", signed, SignatureUntrusted},
+		{"reordered", []testEntry{sig, entries[2], entries[0], entries[1]}, SignatureUntrusted},
+		{"tampered", []testEntry{entries[0], {"templates/01-hello.tmpl", "goodbye"}, entries[2], sig}, SignatureInvalid},
+		{"file added", append(append([]testEntry{}, signed...), testEntry{"templates/02-evil.tmpl", "evil"}), SignatureInvalid},
+		{"file removed", []testEntry{entries[0], entries[1], sig}, SignatureInvalid},
+		{"file renamed", []testEntry{entries[0], {"templates/01-hi.tmpl", "hello"}, entries[2], sig}, SignatureInvalid},
+		{"duplicated file", append([]testEntry{{"templates/01-hello.tmpl", "evil"}}, signed...), SignatureInvalid},
+		{"duplicated signature", append(append([]testEntry{}, signed...), sig), SignatureInvalid},
+		{"signed by other key", signTestEntries(t, entries, otherKey), SignatureUntrusted},
+		{"key replaced", append(append([]testEntry{}, entries...), testEntry{signatureFileName,
+			`{"algorithm":"ed25519","public_key":"` + publicKey + `","signature":"` +
+				base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, []byte("x"))) + `"}`}), SignatureInvalid},
+		{"unknown algorithm", append(append([]testEntry{}, entries...), testEntry{signatureFileName,
+			`{"algorithm":"rsa","public_key":"` + publicKey + `","signature":""}`}), SignatureInvalid},
+		{"broken signature file", append(append([]testEntry{}, entries...), testEntry{signatureFileName, "{"}), SignatureInvalid},
+	}
+	for _, c := range cases {
+		result, err := verifyArchive(writeTestArchive(t, c.entries))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if result.Status != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, result.Status, c.want)
+		}
+		if result.Status == SignatureUntrusted && result.Publisher != "" {
+			t.Errorf("%s: untrusted signature has publisher %q", c.name, result.Publisher)
+		}
+	}
+}
+
+func TestVerifyArchiveTrustedPublisher(t *testing.T) {
+	useTestDir(t)
+	key, publicKey := newTestKey(t)
+	_, otherPublicKey := newTestKey(t)
+	trusted := "# trusted publishers\n" + otherPublicKey + " someone else\n\n" + publicKey + " yuudi\n"
+	if err := os.WriteFile(trustedPublishersFile, []byte(trusted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries := []testEntry{{manifestFileName, `{"schema_version":1,"items":[]}`}}
+	result, err := verifyArchive(writeTestArchive(t, signTestEntries(t, entries, key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != SignatureTrusted || result.Publisher != "yuudi" || result.PublicKey != publicKey {
+		t.Fatalf("got %+v", result)
+	}
+
+	// a trusted key does not make a tampered archive trusted
+	tampered := signTestEntries(t, entries, key)
+	tampered[0].content = `{"schema_version":1,"items":[],"description":"evil"}`
+	if result, err = verifyArchive(writeTestArchive(t, tampered)); err != nil || result.Status != SignatureInvalid {
+		t.Fatalf("tampered archive: got %+v, %v", result, err)
+	}
+
+	// keys are no longer trusted once they are removed from the file
+	if err := os.WriteFile(trustedPublishersFile, []byte(otherPublicKey+" someone else\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = verifyArchive(writeTestArchive(t, signTestEntries(t, entries, key))); err != nil || result.Status != SignatureUntrusted {
+		t.Fatalf("untrusted key: got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,586 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// Snippet is a pongo2 fragment shared by templates, it is included as `snippets/<name>`
+type Snippet struct {
+	DisplayName string `json:"display_name"`
+	Name        string `json:"name"`
+	Content     string `json:"content"`
+	ParentGroup uint64 `json:"-"`
+}
+
+const snippetPathPrefix = "snippets/"
+
+var snippets map[uint64]*Snippet
+
+// templateSet compiles all templates of rules, triggers and jobs, `include`, `import` and `extends` load snippets only
+var templateSet = pongo2.NewSet("gypsum", snippetLoader{})
+
+func init() {
+	// share globals registered to default set
+	templateSet.Globals = pongo2.Globals
+}
+
+type snippetLoader struct{}
+
+// Abs keeps names as they are, snippets are always referred by `snippets/<name>`
+func (snippetLoader) Abs(_, name string) string {
+	return name
+}
+
+func (snippetLoader) Get(path string) (io.Reader, error) {
+	if !strings.HasPrefix(path, snippetPathPrefix) {
+		return nil, fmt.Errorf("cannot load %s, only %s<name> can be loaded", path, snippetPathPrefix)
+	}
+	name := path[len(snippetPathPrefix):]
+	_, s, ok := findSnippet(name)
+	if !ok {
+		return nil, fmt.Errorf("snippet not found: %s", path)
+	}
+	if snippetInCycle(name, s.Content) {
+		return nil, fmt.Errorf("snippet %s includes itself", path)
+	}
+	return strings.NewReader(s.Content), nil
+}
+
+// manifestSnippetLoader loads snippets in manifest before installed ones
+type manifestSnippetLoader struct {
+	snippets map[string]string
+}
+
+func (l manifestSnippetLoader) Abs(base, name string) string {
+	return snippetLoader{}.Abs(base, name)
+}
+
+func (l manifestSnippetLoader) Get(path string) (io.Reader, error) {
+	name := strings.TrimPrefix(path, snippetPathPrefix)
+	content, ok := l.snippets[name]
+	if !ok || name == path {
+		return snippetLoader{}.Get(path)
+	}
+	lookup := func(ref string) (string, bool) {
+		if content, ok := l.snippets[ref]; ok {
+			return content, true
+		}
+		if _, s, ok := findSnippet(ref); ok {
+			return s.Content, true
+		}
+		return "", false
+	}
+	if snippetInCycleWith(name, content, lookup) {
+		return nil, fmt.Errorf("snippet %s includes itself", path)
+	}
+	return strings.NewReader(content), nil
+}
+
+var snippetReferencePattern = regexp.MustCompile(`["']` + snippetPathPrefix + `([^"']+)["']`)
+
+// snippetInCycle tells whether the snippet would include itself if its content were given content,
+// pongo2 loads included templates recursively when compiling, a cycle never ends.
+func snippetInCycle(name, content string) bool {
+	return snippetInCycleWith(name, content, func(ref string) (string, bool) {
+		_, s, ok := findSnippet(ref)
+		if !ok {
+			return "", false
+		}
+		return s.Content, true
+	})
+}
+
+// snippetInCycleWith is snippetInCycle with snippets found by lookup
+func snippetInCycleWith(name, content string, lookup func(name string) (string, bool)) bool {
+	visited := make(map[string]bool)
+	var reaches func(content string) bool
+	reaches = func(content string) bool {
+		for _, match := range snippetReferencePattern.FindAllStringSubmatch(content, -1) {
+			ref := match[1]
+			if ref == name {
+				return true
+			}
+			if visited[ref] {
+				continue
+			}
+			visited[ref] = true
+			if refContent, ok := lookup(ref); ok && reaches(refContent) {
+				return true
+			}
+		}
+		return false
+	}
+	return reaches(content)
+}
+
+// findSnippet finds snippet by name, the earliest created one is used if the name is duplicated
+func findSnippet(name string) (uint64, *Snippet, bool) {
+	var found uint64
+	ok := false
+	for id, s := range snippets {
+		if s.Name == name && (!ok || id < found) {
+			found, ok = id, true
+		}
+	}
+	if !ok {
+		return 0, nil, false
+	}
+	return found, snippets[found], true
+}
+
+func checkSnippet(name, content string, selfID uint64) (int, gin.H) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n\"'") {
+		return 422, gin.H{
+			"code":    2050,
+			"message": "snippet name must not be empty or contain spaces and quotes",
+		}
+	}
+	if id, _, exists := findSnippet(name); exists && id != selfID {
+		return 409, gin.H{
+			"code":       2051,
+			"message":    "snippet name is already used",
+			"snippet_id": id,
+		}
+	}
+	if snippetInCycle(name, content) {
+		return 422, gin.H{
+			"code":    2052,
+			"message": "snippet includes itself",
+		}
+	}
+	return 0, nil
+}
+
+// snippetConflicts reports snippets in manifest whose names are used by other snippets, either installed ones or
+// others in the manifest. installed snippets in group installedID are not conflicts, since they are to be upgraded,
+// installedID is 0 if the plugin is installed as a new group.
+// findSnippet only finds one snippet by name, so a plugin with conflicting snippets cannot be imported.
+func (mg *ManifestGroup) snippetConflicts(installedID uint64) []ItemDiff {
+	upgraded := make(map[uint64]bool)
+	if g, ok := groups[installedID]; ok && installedID != 0 {
+		g.walkItems(func(item Item) {
+			if item.ItemType == SnippetItem {
+				upgraded[item.ItemID] = true
+			}
+		})
+	}
+	conflicts := make([]ItemDiff, 0)
+	names := make(map[string]bool)
+	var walk func(mg *ManifestGroup, prefix string)
+	walk = func(mg *ManifestGroup, prefix string) {
+		for _, item := range mg.Items {
+			path := prefix + "/" + item.DisplayName
+			switch {
+			case item.ItemType == GroupItem && item.Group != nil:
+				walk(item.Group, path)
+			case item.ItemType == SnippetItem && item.Snippet != nil:
+				conflict := names[item.Snippet.Name]
+				names[item.Snippet.Name] = true
+				for id, s := range snippets {
+					if s.Name == item.Snippet.Name && !upgraded[id] {
+						conflict = true
+					}
+				}
+				if conflict {
+					conflicts = append(conflicts, ItemDiff{
+						Path:     path,
+						ItemType: SnippetItem,
+						Change:   ItemConflict,
+					})
+				}
+			}
+		}
+	}
+	walk(mg, "")
+	return conflicts
+}
+
+type dependentFailure struct {
+	ItemType ItemType `json:"item_type"`
+	ItemID   uint64   `json:"item_id"`
+	Error    string   `json:"error"`
+}
+
+// recompileSnippetDependents registers again all templates using snippets, since snippets are loaded when compiling.
+// items failed to compile keep running the last compiled version.
+func recompileSnippetDependents() []dependentFailure {
+	failures := make([]dependentFailure, 0)
+	fail := func(itemType ItemType, id uint64, err error) {
+		log.Errorf("snippet changed, but %s %d cannot be compiled: %s", itemType, id, err)
+		failures = append(failures, dependentFailure{
+			ItemType: itemType,
+			ItemID:   id,
+			Error:    err.Error(),
+		})
+	}
+	for _, id := range sortedIDs(rules) {
+		r := rules[id]
+		if !r.Active || !strings.Contains(r.Response, snippetPathPrefix) {
+			continue
+		}
+		if err := checkTemplate(r.Response); err != nil {
+			fail(RuleItem, id, err)
+			continue
+		}
+		if matcher, ok := zeroMatcher[id]; ok {
+			matcher.Delete()
+			delete(zeroMatcher, id)
+		}
+		if err := r.Register(id); err != nil {
+			fail(RuleItem, id, err)
+		}
+	}
+	for _, id := range sortedIDs(triggers) {
+		t := triggers[id]
+		if !t.Active || !strings.Contains(t.Response, snippetPathPrefix) {
+			continue
+		}
+		if err := checkTemplate(t.Response); err != nil {
+			fail(TriggerItem, id, err)
+			continue
+		}
+		if matcher, ok := zeroTrigger[id]; ok {
+			matcher.Delete()
+			delete(zeroTrigger, id)
+		}
+		if err := t.Register(id); err != nil {
+			fail(TriggerItem, id, err)
+		}
+	}
+	for _, id := range sortedIDs(jobs) {
+		j := jobs[id]
+		if !j.Active || !strings.Contains(j.Action, snippetPathPrefix) {
+			continue
+		}
+		if err := checkTemplate(j.Action); err != nil {
+			fail(SchedulerItem, id, err)
+			continue
+		}
+		if entry, ok := entries[id]; ok {
+			scheduler.Remove(entry)
+			delete(entries, id)
+		}
+		if err := j.Register(id); err != nil {
+			fail(SchedulerItem, id, err)
+		}
+	}
+	return failures
+}
+
+// sortedIDs returns keys of rules, triggers or jobs in order, so that failures are reported stably
+func sortedIDs(items interface{}) []uint64 {
+	ids := make([]uint64, 0)
+	switch m := items.(type) {
+	case map[uint64]*Rule:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[uint64]*Trigger:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[uint64]*Job:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[uint64]*Snippet:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[uint64]*Resource:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *Snippet) ToBytes() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(s); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func SnippetFromBytes(b []byte) (*Snippet, error) {
+	s := &Snippet{}
+	buffer := bytes.Buffer{}
+	buffer.Write(b)
+	decoder := gob.NewDecoder(&buffer)
+	err := decoder.Decode(s)
+	return s, err
+}
+
+func loadSnippets() {
+	snippets = make(map[uint64]*Snippet)
+	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-snippets-")), nil)
+	defer func() {
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			log.Errorf("载入数据错误：%s", err)
+		}
+	}()
+	for iter.Next() {
+		key := helper.ToUint(iter.Key()[16:])
+		value := iter.Value()
+		s, e := SnippetFromBytes(value)
+		if e != nil {
+			log.Errorf("无法加载片段%d：%s", key, e)
+			continue
+		}
+		snippets[key] = s
+	}
+}
+
+func (s *Snippet) SaveToDB(idx uint64) error {
+	v, err := s.ToBytes()
+	if err != nil {
+		return err
+	}
+	return db.Put(append([]byte("gypsum-snippets-"), helper.U64ToBytes(idx)...), v, nil)
+}
+
+func (s *Snippet) GetParentID() uint64 {
+	return s.ParentGroup
+}
+
+func (s *Snippet) GetDisplayName() string {
+	return s.DisplayName
+}
+
+func (s *Snippet) NewParent(selfID, parentID uint64) error {
+	s.ParentGroup = parentID
+	return s.SaveToDB(selfID)
+}
+
+func getSnippets(c *gin.Context) {
+	c.JSON(200, snippets)
+}
+
+func getSnippetByID(c *gin.Context) {
+	snippetIDStr := c.Param("sid")
+	snippetID, err := strconv.ParseUint(snippetIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such snippet",
+		})
+		return
+	}
+	s, ok := snippets[snippetID]
+	if ok {
+		c.JSON(200, s)
+		return
+	}
+	c.JSON(404, gin.H{
+		"code":    1000,
+		"message": "no such snippet",
+	})
+}
+
+func createSnippet(c *gin.Context) {
+	var snippet Snippet
+	if err := c.BindJSON(&snippet); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	parentStr := c.Param("gid")
+	var parentID uint64
+	if len(parentStr) == 0 {
+		parentID = 0
+	} else {
+		var err error
+		parentID, err = strconv.ParseUint(parentStr, 10, 64)
+		if err != nil {
+			c.JSON(404, gin.H{
+				"code":    1000,
+				"message": "no such group",
+			})
+			return
+		}
+	}
+	parentGroup, ok := groups[parentID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "group not found",
+		})
+		return
+	}
+	snippet.ParentGroup = parentID
+	if status, result := checkSnippet(snippet.Name, snippet.Content, 0); result != nil {
+		c.JSON(status, result)
+		return
+	}
+	if err := checkTemplate(snippet.Content); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2041,
+			"message": fmt.Sprintf("template error: %s", err),
+		})
+		return
+	}
+	// save
+	itemCursor++
+	cursor := itemCursor
+	parentGroup.Items = append(parentGroup.Items, Item{
+		ItemType:    SnippetItem,
+		DisplayName: snippet.DisplayName,
+		ItemID:      cursor,
+	})
+	if err := parentGroup.SaveToDB(parentID); err != nil {
+		log.Error(err)
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
+		log.Error(err)
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	if err := snippet.SaveToDB(cursor); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	snippets[cursor] = &snippet
+	// templates may have been waiting for this snippet
+	failures := recompileSnippetDependents()
+	c.JSON(201, gin.H{
+		"code":              0,
+		"message":           "ok",
+		"snippet_id":        cursor,
+		"dependents_failed": failures,
+	})
+	return
+}
+
+func deleteSnippet(c *gin.Context) {
+	snippetIDStr := c.Param("sid")
+	snippetID, err := strconv.ParseUint(snippetIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such snippet",
+		})
+		return
+	}
+	snippet, ok := snippets[snippetID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such snippet",
+		})
+		return
+	}
+	// remove self from parent
+	if err := DeleteFromParent(snippet.ParentGroup, snippetID); err != nil {
+		log.Errorf("error when delete snippet %d from parent group %d: %s", snippetID, snippet.ParentGroup, err)
+	}
+	// remove self from database
+	delete(snippets, snippetID)
+	if err := db.Delete(append([]byte("gypsum-snippets-"), helper.U64ToBytes(snippetID)...), nil); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	failures := recompileSnippetDependents()
+	c.JSON(200, gin.H{
+		"code":              0,
+		"message":           "deleted",
+		"dependents_failed": failures,
+	})
+	return
+}
+
+func modifySnippet(c *gin.Context) {
+	snippetIDStr := c.Param("sid")
+	snippetID, err := strconv.ParseUint(snippetIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such snippet",
+		})
+		return
+	}
+	oldSnippet, ok := snippets[snippetID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such snippet",
+		})
+		return
+	}
+	var newSnippet Snippet
+	if err := c.BindJSON(&newSnippet); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	if status, result := checkSnippet(newSnippet.Name, newSnippet.Content, snippetID); result != nil {
+		c.JSON(status, result)
+		return
+	}
+	if err := checkTemplate(newSnippet.Content); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2041,
+			"message": fmt.Sprintf("template error: %s", err),
+		})
+		return
+	}
+	newSnippet.ParentGroup = oldSnippet.ParentGroup
+	if err := newSnippet.SaveToDB(snippetID); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	snippets[snippetID] = &newSnippet
+	if newSnippet.DisplayName != oldSnippet.DisplayName {
+		if err = ChangeNameForParent(newSnippet.ParentGroup, snippetID, newSnippet.DisplayName); err != nil {
+			log.Errorf("error when change snippet %d from parent group %d: %s", snippetID, newSnippet.ParentGroup, err)
+		}
+	}
+	if err = markCustomized(newSnippet.ParentGroup, snippetID); err != nil {
+		log.Errorf("error when mark snippet %d customized in parent group %d: %s", snippetID, newSnippet.ParentGroup, err)
+	}
+	failures := recompileSnippetDependents()
+	c.JSON(200, gin.H{
+		"code":              0,
+		"message":           "ok",
+		"dependents_failed": failures,
+	})
+	return
+}
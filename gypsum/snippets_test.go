@@ -0,0 +1,43 @@
+package gypsum
+
+import (
+	"testing"
+)
+
+func TestSnippetConflicts(t *testing.T) {
+	useTestDB(t)
+	installedID := addTestGroup(t, 0, "installed")
+	addTestItem(t, installedID, SnippetItem, "footer", &Snippet{Name: "footer", Content: "bye"})
+	otherID := addTestGroup(t, 0, "other")
+	addTestItem(t, otherID, SnippetItem, "header", &Snippet{Name: "header", Content: "hi"})
+
+	snippetItem := func(displayName, name string) ManifestItem {
+		return ManifestItem{ItemType: SnippetItem, DisplayName: displayName, Snippet: &Snippet{Name: name}}
+	}
+	manifest := &ManifestGroup{Items: []ManifestItem{
+		snippetItem("footer", "footer"),
+		snippetItem("fresh", "fresh"),
+		{ItemType: GroupItem, DisplayName: "sub", Group: &ManifestGroup{Items: []ManifestItem{
+			snippetItem("header", "header"),
+			snippetItem("fresh again", "fresh"),
+		}}},
+	}}
+	paths := func(diffs []ItemDiff) string {
+		s := ""
+		for _, d := range diffs {
+			if d.Change != ItemConflict || d.ItemType != SnippetItem {
+				t.Fatalf("unexpected diff %+v", d)
+			}
+			s += d.Path + ";"
+		}
+		return s
+	}
+	// installed as a new group, footer is used by the installed one
+	if got, want := paths(manifest.snippetConflicts(0)), "/footer;/sub/header;/sub/fresh again;"; got != want {
+		t.Fatalf("install: got %s, want %s", got, want)
+	}
+	// footer is upgraded in place
+	if got, want := paths(manifest.snippetConflicts(installedID)), "/sub/header;/sub/fresh again;"; got != want {
+		t.Fatalf("upgrade: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if s, err := os.Stat(absDir); err != nil {
+		if os.IsNotExist(err) {
+			if err = os.Mkdir(absDir, 0755); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	} else {
+		if !s.IsDir() {
+			return nil, &os.PathError{Op: "stat", Path: absDir, Err: os.ErrExist}
+		}
+	}
+	return &LocalStorage{dir: absDir}, nil
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s *LocalStorage) Put(name string, reader io.Reader, _ int64) error {
+	// write to temporary file first, so that a broken upload never leaves a half file
+	tmp, err := os.CreateTemp(s.dir, ".uploading-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0444); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LocalStorage) Size(name string) (int64, error) {
+	stat, err := os.Stat(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotExist
+		}
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) LocalPath(name string) (string, bool) {
+	return s.path(name), true
+}
+
+func (s *LocalStorage) PresignedURL(_ string, _ time.Duration) (string, bool) {
+	return "", false
+}
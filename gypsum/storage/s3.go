@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // prefix of object keys, e.g. "gypsum/"
+	PathStyle bool   // use endpoint/bucket/key instead of bucket.endpoint/key, minio requires it
+}
+
+// S3Storage stores files in a s3-compatible object storage, requests are signed with AWS signature version 4
+type S3Storage struct {
+	config S3Config
+	scheme string
+	host   string
+	client *http.Client
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("s3 bucket is not set")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("s3 endpoint must start with http:// or https://")
+	}
+	host := u.Host
+	if !config.PathStyle {
+		host = config.Bucket + "." + host
+	}
+	return &S3Storage{
+		config: config,
+		scheme: u.Scheme,
+		host:   host,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3Storage) objectPath(name string) string {
+	key := s.config.Prefix + name
+	if s.config.PathStyle {
+		return "/" + s.config.Bucket + "/" + key
+	}
+	return "/" + key
+}
+
+func (s *S3Storage) newRequest(method, name string, body io.Reader, size int64) (*http.Request, error) {
+	p := s.objectPath(name)
+	req, err := http.NewRequest(method, s.scheme+"://"+s.host+uriEncode(p, false), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	s.signHeader(req, p, now)
+	return req, nil
+}
+
+func (s *S3Storage) do(req *http.Request) (*http.Response, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return nil, ErrNotExist
+		}
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("s3 error response status %d: %s", res.StatusCode, msg)
+	}
+	return res, nil
+}
+
+func (s *S3Storage) Put(name string, reader io.Reader, size int64) error {
+	req, err := s.newRequest("PUT", name, reader, size)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Exists(name string) (bool, error) {
+	req, err := s.newRequest("HEAD", name, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		if err == ErrNotExist {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, res.Body.Close()
+}
+
+func (s *S3Storage) Size(name string) (int64, error) {
+	req, err := s.newRequest("HEAD", name, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.ContentLength < 0 {
+		return 0, errors.New("s3 response has no Content-Length")
+	}
+	return res.ContentLength, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	req, err := s.newRequest("DELETE", name, nil, 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		if err == ErrNotExist {
+			return nil
+		}
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3Storage) LocalPath(_ string) (string, bool) {
+	return "", false
+}
+
+func (s *S3Storage) PresignedURL(name string, expire time.Duration) (string, bool) {
+	return s.presignedURL(name, expire, time.Now().UTC()), true
+}
+
+func (s *S3Storage) presignedURL(name string, expire time.Duration, now time.Time) string {
+	p := s.objectPath(name)
+	amzDate := now.Format("20060102T150405Z")
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.config.AccessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expire/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		uriEncode(p, false),
+		canonicalQuery(query),
+		"host:" + s.host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := s.signature(now, canonicalRequest)
+	return s.scheme + "://" + s.host + uriEncode(p, false) + "?" + canonicalQuery(query) + "&X-Amz-Signature=" + signature
+}
+
+func (s *S3Storage) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+func (s *S3Storage) signHeader(req *http.Request, p string, t time.Time) {
+	headers := map[string]string{
+		"host": s.host,
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalHeaders strings.Builder
+	for _, k := range keys {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(keys, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(p, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, s.scope(t), signedHeaders, s.signature(t, canonicalRequest),
+	))
+}
+
+func (s *S3Storage) signature(t time.Time, canonicalRequest string) string {
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes string as AWS required, slash is kept when encodeSlash is false
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotExist = errors.New("file does not exist in storage")
+
+// Storage saves resource files, files are named by their sha256 sum with extension
+type Storage interface {
+	Put(name string, reader io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	Exists(name string) (bool, error)
+	// Size returns the size of the file in bytes without reading it, err is ErrNotExist if the file does not exist
+	Size(name string) (int64, error)
+	Delete(name string) error
+	// LocalPath returns absolute path of the file, ok is false if the storage is not on local disk
+	LocalPath(name string) (p string, ok bool)
+	// PresignedURL returns an url that can be accessed directly, ok is false if the storage does not support it
+	PresignedURL(name string, expire time.Duration) (u string, ok bool)
+}
@@ -3,9 +3,17 @@ package template
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
 )
@@ -21,95 +29,473 @@ type ValueType int
 const (
 	IntValueType ValueType = iota
 	StrValueType
+	FloatValueType
+	BoolValueType
+	JSONValueType // lists and maps
 )
 
 type StoredValue struct {
-	ValueType ValueType
-	IntValue  int
-	StrValue  string
+	ValueType  ValueType
+	IntValue   int
+	StrValue   string
+	FloatValue float64
+	BoolValue  bool
+	Expire     int64 // unix seconds, 0 if the value never expires
 }
 
-func DatabaseGet(key interface{}, defaultValue ...interface{}) interface{} {
-	if len(defaultValue) > 1 {
-		log.Warn("too many arguments for calling db_get")
-	}
-	var bytesKey []byte
-	switch k := key.(type) {
+var ErrNotNumber = errors.New("value is not a number")
+
+// writeLock makes read-modify-write operations atomic
+var writeLock sync.Mutex
+
+// NewStoredValue converts value to be stored, lists and maps are stored as json
+func NewStoredValue(value interface{}) (*StoredValue, error) {
+	switch v := value.(type) {
 	case string:
-		bytesKey = []byte(k)
+		return &StoredValue{ValueType: StrValueType, StrValue: v}, nil
 	case int:
-		bytesKey = helper.U64ToBytes(uint64(k))
+		return &StoredValue{ValueType: IntValueType, IntValue: v}, nil
+	case int64:
+		return &StoredValue{ValueType: IntValueType, IntValue: int(v)}, nil
+	case int32:
+		return &StoredValue{ValueType: IntValueType, IntValue: int(v)}, nil
+	case float64:
+		return &StoredValue{ValueType: FloatValueType, FloatValue: v}, nil
+	case float32:
+		return &StoredValue{ValueType: FloatValueType, FloatValue: float64(v)}, nil
+	case bool:
+		return &StoredValue{ValueType: BoolValueType, BoolValue: v}, nil
+	case nil:
+		return nil, errors.New("cannot store nil")
 	default:
-		log.Errorf("cannot use %#v (%T) as database key", key, key)
-		return nil
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot store %#v (%T): %s", value, value, err)
+		}
+		return &StoredValue{ValueType: JSONValueType, StrValue: string(encoded)}, nil
+	}
+}
+
+// Value returns the stored value, integers in lists and maps are int64
+func (v *StoredValue) Value() (interface{}, error) {
+	switch v.ValueType {
+	case IntValueType:
+		return v.IntValue, nil
+	case StrValueType:
+		return v.StrValue, nil
+	case FloatValueType:
+		return v.FloatValue, nil
+	case BoolValueType:
+		return v.BoolValue, nil
+	case JSONValueType:
+		decoder := json.NewDecoder(bytes.NewReader([]byte(v.StrValue)))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		return normalizeNumbers(value), nil
+	default:
+		return nil, fmt.Errorf("unknown value type from StoredValue: %v", v.ValueType)
+	}
+}
+
+func (v *StoredValue) expired(now int64) bool {
+	return v.Expire != 0 && v.Expire <= now
+}
+
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalizeNumbers(v[k])
+		}
+	}
+	return value
+}
+
+func decodeStoredValue(data []byte) (*StoredValue, error) {
+	var stored StoredValue
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func encodeStoredValue(stored *StoredValue) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(stored); err != nil {
+		return nil, err
 	}
-	bytesData, err := db.Get(append([]byte("gypsum-userDB-p-"), bytesKey...), nil)
+	return buffer.Bytes(), nil
+}
+
+// GetValue reads value of the key, found is false if the key does not exist or is expired
+func GetValue(key []byte) (value interface{}, found bool, err error) {
+	data, err := db.Get(key, nil)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
-			if len(defaultValue) == 0 {
-				log.Warnf("cannot find key in database: %v", key)
-				return nil
-			} else {
-				return defaultValue[0]
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	stored, err := decodeStoredValue(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if stored.expired(time.Now().Unix()) {
+		return nil, false, nil
+	}
+	value, err = stored.Value()
+	return value, err == nil, err
+}
+
+// PutValue stores value of the key, ttl is in seconds, 0 for never expire
+func PutValue(key []byte, value interface{}, ttl int64) error {
+	stored, err := NewStoredValue(value)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		stored.Expire = time.Now().Unix() + ttl
+	}
+	data, err := encodeStoredValue(stored)
+	if err != nil {
+		return err
+	}
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	return db.Put(key, data, nil)
+}
+
+func DeleteValue(key []byte) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	return db.Delete(key, nil)
+}
+
+// IncrValue adds delta to the number atomically, missing keys are seen as 0.
+// the expiry of the value is kept.
+func IncrValue(key []byte, delta interface{}) (interface{}, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	stored := &StoredValue{ValueType: IntValueType}
+	data, err := db.Get(key, nil)
+	switch err {
+	case nil:
+		if existing, err := decodeStoredValue(data); err != nil {
+			return nil, err
+		} else if !existing.expired(time.Now().Unix()) {
+			stored = existing
+		}
+	case leveldb.ErrNotFound:
+	default:
+		return nil, err
+	}
+	switch d := delta.(type) {
+	case float64, float32:
+		f, _ := helper.AnyToFloat(d)
+		switch stored.ValueType {
+		case IntValueType:
+			stored.FloatValue = float64(stored.IntValue) + f
+			stored.ValueType = FloatValueType
+		case FloatValueType:
+			stored.FloatValue += f
+		default:
+			return nil, ErrNotNumber
+		}
+	default:
+		i, err := helper.AnyToInt(d)
+		if err != nil {
+			return nil, fmt.Errorf("cannot increase by %#v", delta)
+		}
+		switch stored.ValueType {
+		case IntValueType:
+			stored.IntValue += i
+		case FloatValueType:
+			stored.FloatValue += float64(i)
+		default:
+			return nil, ErrNotNumber
+		}
+	}
+	data, err = encodeStoredValue(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Put(key, data, nil); err != nil {
+		return nil, err
+	}
+	return stored.Value()
+}
+
+// ListKeys lists keys beginning with prefix, the prefix is removed from returned keys.
+// expired values and keys that are not strings (e.g. integers) are not listed.
+func ListKeys(prefix []byte) ([]string, error) {
+	now := time.Now().Unix()
+	keys := make([]string, 0)
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()[len(prefix):]
+		if len(key) == 0 || !utf8.Valid(key) {
+			continue
+		}
+		if stored, err := decodeStoredValue(iter.Value()); err == nil && stored.expired(now) {
+			continue
+		}
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	return keys, iter.Error()
+}
+
+// Entry is a value listed with its key
+type Entry struct {
+	Key    []byte
+	Value  interface{}
+	Expire int64
+}
+
+// ListEntries lists values with keys beginning with prefix, the prefix is kept in keys.
+// expired values and values that cannot be read are not listed.
+func ListEntries(prefix []byte) ([]Entry, error) {
+	now := time.Now().Unix()
+	entries := make([]Entry, 0)
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		stored, err := decodeStoredValue(iter.Value())
+		if err != nil || stored.expired(now) {
+			continue
+		}
+		value, err := stored.Value()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:    append([]byte{}, iter.Key()...),
+			Value:  value,
+			Expire: stored.Expire,
+		})
+	}
+	return entries, iter.Error()
+}
+
+// NormalizeNumbers converts json.Number in decoded json to int64 or float64
+func NormalizeNumbers(value interface{}) interface{} {
+	return normalizeNumbers(value)
+}
+
+// CleanExpired deletes expired values under the prefixes
+func CleanExpired(prefixes ...[]byte) (int, error) {
+	cleaned := 0
+	for _, prefix := range prefixes {
+		n, err := cleanExpired(prefix, func(data []byte, now int64) bool {
+			stored, err := decodeStoredValue(data)
+			return err == nil && stored.expired(now)
+		})
+		cleaned += n
+		if err != nil {
+			return cleaned, err
+		}
+	}
+	return cleaned, nil
+}
+
+// cleanExpired deletes values under prefix that are expired according to isExpired
+func cleanExpired(prefix []byte, isExpired func(data []byte, now int64) bool) (int, error) {
+	now := time.Now().Unix()
+	cleaned := 0
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	expired := make([][]byte, 0)
+	for iter.Next() {
+		if isExpired(iter.Value(), now) {
+			expired = append(expired, append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return cleaned, err
+	}
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	for _, key := range expired {
+		// the value may be renewed after iteration
+		if data, err := db.Get(key, nil); err == nil && isExpired(data, now) {
+			if err := db.Delete(key, nil); err == nil {
+				cleaned++
 			}
 		}
-		log.Error(err)
+	}
+	return cleaned, nil
+}
+
+// Database stores values under a key prefix, every plugin has its own prefix
+type Database struct {
+	prefix []byte
+}
+
+// NewDatabase creates a Database that stores values under prefix
+func NewDatabase(prefix []byte) *Database {
+	return &Database{prefix: prefix}
+}
+
+// Sub returns the database under a sub prefix
+func (d *Database) Sub(prefix []byte) *Database {
+	return NewDatabase(append(d.key(), prefix...))
+}
+
+// Functions returns functions of the database, so that it can be used like `user_vars.get(key)` in templates
+func (d *Database) Functions() map[string]interface{} {
+	return map[string]interface{}{
+		"get":    d.Get,
+		"put":    d.Put,
+		"delete": d.Delete,
+		"incr":   d.Incr,
+		"keys":   d.Keys,
+	}
+}
+
+// shared is the namespace accessible to all rules, and the one used before plugins had their own
+var shared = NewDatabase([]byte("gypsum-userDB-p-"))
+
+func DatabaseGet(key interface{}, defaultValue ...interface{}) interface{} {
+	return shared.Get(key, defaultValue...)
+}
+
+func DatabasePut(key, value interface{}, ttl ...interface{}) *int {
+	return shared.Put(key, value, ttl...)
+}
+
+func DatabaseDelete(key interface{}) *int {
+	return shared.Delete(key)
+}
+
+func DatabaseIncr(key interface{}, delta ...interface{}) interface{} {
+	return shared.Incr(key, delta...)
+}
+
+func DatabaseKeys(prefix ...string) []string {
+	return shared.Keys(prefix...)
+}
+
+func (d *Database) Get(key interface{}, defaultValue ...interface{}) interface{} {
+	if len(defaultValue) > 1 {
+		log.Warn("too many arguments for calling db_get")
+	}
+	bytesKey, ok := d.fullKey(key)
+	if !ok {
 		return nil
 	}
-	var data StoredValue
-	buffer := bytes.Buffer{}
-	buffer.Write(bytesData)
-	decoder := gob.NewDecoder(&buffer)
-	if err := decoder.Decode(&data); err != nil {
+	value, found, err := GetValue(bytesKey)
+	if err != nil {
 		log.Errorf("error when reading data from database: %s", err)
 		return nil
 	}
-	switch data.ValueType {
-	case IntValueType:
-		return data.IntValue
-	case StrValueType:
-		return data.StrValue
-	default:
-		log.Errorf("Unknown value type from StoredValue: %v", data.ValueType)
-		return nil
+	if !found {
+		if len(defaultValue) == 0 {
+			log.Warnf("cannot find key in database: %v", key)
+			return nil
+		}
+		return defaultValue[0]
 	}
+	return value
 }
 
-func DatabasePut(key, value interface{}) *int {
-	var bytesKey []byte
-	switch k := key.(type) {
-	case string:
-		bytesKey = []byte(k)
-	case int:
-		bytesKey = helper.U64ToBytes(uint64(k))
-	default:
-		log.Errorf("cannot use %#v (%T) as database key", key, key)
+// Put stores the value, the optional ttl is in seconds.
+// storing nil deletes the key.
+func (d *Database) Put(key, value interface{}, ttl ...interface{}) *int {
+	bytesKey, ok := d.fullKey(key)
+	if !ok {
 		return nil
 	}
-	var valueStore *StoredValue
-	switch value.(type) {
-	case string:
-		valueStore = &StoredValue{
-			ValueType: StrValueType,
-			StrValue:  value.(string),
-		}
-	case int:
-		valueStore = &StoredValue{
-			ValueType: IntValueType,
-			IntValue:  value.(int),
+	if value == nil {
+		return d.Delete(key)
+	}
+	var seconds int64
+	if len(ttl) != 0 {
+		var err error
+		if seconds, err = helper.AnyToInt64(ttl[0]); err != nil {
+			log.Errorf("cannot use %#v as ttl", ttl[0])
+			return nil
 		}
-	default:
-		log.Errorf("cannot store %#v (%T) to database", value, value)
 	}
-	buffer := bytes.Buffer{}
-	encoder := gob.NewEncoder(&buffer)
-	if err := encoder.Encode(valueStore); err != nil {
-		log.Errorf("error when encode valueStore as bytes: %s", err)
-		return nil
+	if err := PutValue(bytesKey, value, seconds); err != nil {
+		log.Errorf("error when put value to database: %s", err)
 	}
-	if err := db.Put(append([]byte("gypsum-userDB-p-"), bytesKey...), buffer.Bytes(), nil); err != nil {
-		log.Errorf("error when put value to database %s", err)
+	return nil
+}
+
+func (d *Database) Delete(key interface{}) *int {
+	bytesKey, ok := d.fullKey(key)
+	if !ok {
 		return nil
 	}
+	if err := DeleteValue(bytesKey); err != nil {
+		log.Errorf("error when delete value from database: %s", err)
+	}
 	return nil
 }
+
+// Incr adds delta (1 by default) to the number and returns the result
+func (d *Database) Incr(key interface{}, delta ...interface{}) interface{} {
+	bytesKey, ok := d.fullKey(key)
+	if !ok {
+		return nil
+	}
+	var by interface{} = 1
+	if len(delta) != 0 {
+		by = delta[0]
+	}
+	value, err := IncrValue(bytesKey, by)
+	if err != nil {
+		log.Errorf("error when increase value in database: %s", err)
+		return nil
+	}
+	return value
+}
+
+// Keys lists string keys beginning with prefix
+func (d *Database) Keys(prefix ...string) []string {
+	p := d.key()
+	if len(prefix) != 0 {
+		p = append(p, prefix[0]...)
+	}
+	keys, err := ListKeys(p)
+	if err != nil {
+		log.Errorf("error when list keys in database: %s", err)
+	}
+	if len(prefix) != 0 {
+		for i := range keys {
+			keys[i] = prefix[0] + keys[i]
+		}
+	}
+	return keys
+}
+
+func (d *Database) fullKey(key interface{}) ([]byte, bool) {
+	switch k := key.(type) {
+	case string:
+		return append(d.key(), k...), true
+	case int:
+		return append(d.key(), helper.U64ToBytes(uint64(k))...), true
+	default:
+		log.Errorf("cannot use %#v (%T) as database key", key, key)
+		return nil, false
+	}
+}
+
+func (d *Database) key() []byte {
+	// copy prefix, so that appending to it never shares underlying array
+	return append(make([]byte, 0, len(d.prefix)+16), d.prefix...)
+}
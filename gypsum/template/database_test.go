@@ -0,0 +1,191 @@
+package template
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func useTestDB(t *testing.T) {
+	testDB, err := leveldb.OpenFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDB(testDB)
+	t.Cleanup(func() {
+		_ = testDB.Close()
+		SetDB(nil)
+	})
+}
+
+// putExpired stores a value that expired a while ago
+func putExpired(t *testing.T, key string, value interface{}) {
+	stored, err := NewStoredValue(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Expire = time.Now().Unix() - 10
+	data, err := encodeStoredValue(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte(key), data, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expireOf(t *testing.T, key string) int64 {
+	data, err := db.Get([]byte(key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := decodeStoredValue(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored.Expire
+}
+
+func TestIncrValue(t *testing.T) {
+	useTestDB(t)
+	cases := []struct {
+		key   string
+		delta interface{}
+		want  interface{}
+	}{
+		{"counter", 1, 1},
+		{"counter", 2, 3},
+		{"counter", int64(-5), -2},
+		{"counter", "4", 2},
+		{"counter", 0.5, 2.5},
+		{"counter", 1, 3.5},
+		{"float", float32(0.25), 0.25},
+	}
+	for _, c := range cases {
+		got, err := IncrValue([]byte(c.key), c.delta)
+		if err != nil {
+			t.Fatalf("incr %s by %#v: %s", c.key, c.delta, err)
+		}
+		if got != c.want {
+			t.Fatalf("incr %s by %#v: got %#v, want %#v", c.key, c.delta, got, c.want)
+		}
+	}
+	if value, found, err := GetValue([]byte("counter")); err != nil || !found || value != 3.5 {
+		t.Fatalf("stored value: got %#v, %v, %v", value, found, err)
+	}
+
+	if err := PutValue([]byte("name"), "gypsum", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IncrValue([]byte("name"), 1); err != ErrNotNumber {
+		t.Fatalf("incr string: got %v", err)
+	}
+	if _, err := IncrValue([]byte("name"), 0.5); err != ErrNotNumber {
+		t.Fatalf("incr string by float: got %v", err)
+	}
+	if _, err := IncrValue([]byte("counter"), "abc"); err == nil {
+		t.Fatal("incr by a string that is not a number")
+	}
+}
+
+func TestIncrValueConcurrently(t *testing.T) {
+	useTestDB(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := IncrValue([]byte("counter"), 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := GetValue([]byte("counter")); value != 50 {
+		t.Fatalf("got %#v, want 50", value)
+	}
+}
+
+func TestValueTTL(t *testing.T) {
+	useTestDB(t)
+	before := time.Now().Unix()
+	if err := PutValue([]byte("limited"), 1, 100); err != nil {
+		t.Fatal(err)
+	}
+	expire := expireOf(t, "limited")
+	if expire < before+100 || expire > time.Now().Unix()+100 {
+		t.Fatalf("expire %d is not 100 seconds later", expire)
+	}
+	if _, err := IncrValue([]byte("limited"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := expireOf(t, "limited"); got != expire {
+		t.Fatalf("incr changes expire from %d to %d", expire, got)
+	}
+	if err := PutValue([]byte("limited"), 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := expireOf(t, "limited"); got != 0 {
+		t.Fatalf("put without ttl keeps expire %d", got)
+	}
+
+	putExpired(t, "expired", 41)
+	if _, found, err := GetValue([]byte("expired")); err != nil || found {
+		t.Fatalf("expired value is found: %v, %v", found, err)
+	}
+	if keys, err := ListKeys([]byte("")); err != nil || len(keys) != 1 || keys[0] != "limited" {
+		t.Fatalf("keys: got %v, %v", keys, err)
+	}
+	// an expired counter restarts from 0 and never expires
+	if value, err := IncrValue([]byte("expired"), 1); err != nil || value != 1 {
+		t.Fatalf("incr expired value: got %#v, %v", value, err)
+	}
+	if got := expireOf(t, "expired"); got != 0 {
+		t.Fatalf("restarted counter keeps expire %d", got)
+	}
+
+	putExpired(t, "p-a", "a")
+	putExpired(t, "q-b", "b")
+	if err := PutValue([]byte("p-c"), "c", 100); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CleanExpired([]byte("p-")); err != nil || n != 1 {
+		t.Fatalf("clean: got %d, %v", n, err)
+	}
+	if _, err := db.Get([]byte("p-a"), nil); err != leveldb.ErrNotFound {
+		t.Fatalf("expired value is not cleaned: %v", err)
+	}
+	for _, key := range []string{"q-b", "p-c"} {
+		if _, err := db.Get([]byte(key), nil); err != nil {
+			t.Fatalf("%s should be kept: %v", key, err)
+		}
+	}
+}
+
+func TestDatabaseNamespace(t *testing.T) {
+	useTestDB(t)
+	a := NewDatabase([]byte("a-"))
+	b := NewDatabase([]byte("b-"))
+	a.Put("score", 10)
+	b.Put("score", 20, 100)
+	a.Incr("score")
+	a.Put("sub-score", 30)
+	if got := a.Get("score"); got != 11 {
+		t.Fatalf("a: got %#v", got)
+	}
+	if got := b.Get("score"); got != 20 {
+		t.Fatalf("b: got %#v", got)
+	}
+	if got := a.Keys(); len(got) != 2 || got[0] != "score" || got[1] != "sub-score" {
+		t.Fatalf("keys of a: got %v", got)
+	}
+	if got := a.Keys("sub-"); len(got) != 1 || got[0] != "sub-score" {
+		t.Fatalf("keys of a with prefix: got %v", got)
+	}
+	a.Put("score", nil)
+	if got := a.Get("score", "gone"); got != "gone" {
+		t.Fatalf("putting nil does not delete: %#v", got)
+	}
+}
@@ -0,0 +1,113 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+	zero "github.com/wdvxdr1123/ZeroBot"
+	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
+)
+
+type forwardMessageNode struct {
+	name    pongo2.IEvaluator
+	uin     pongo2.IEvaluator
+	wrapper *pongo2.NodeWrapper
+}
+
+type tagForwardNode struct {
+	groupID pongo2.IEvaluator // nil for the group of event
+	nodes   []*forwardMessageNode
+}
+
+func (node *tagForwardNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
+	var groupID int64
+	if node.groupID != nil {
+		v, err := node.groupID.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		groupID = int64(v.Integer())
+	} else if event, ok := ctx.Public["_event"].(*zero.Event); ok {
+		groupID = event.GroupID
+	}
+	forward := make(zeroMessage.Message, 0, len(node.nodes))
+	contents := make([]string, 0, len(node.nodes))
+	for _, n := range node.nodes {
+		name, err := n.name.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		uin, err := n.uin.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		var content = &strings.Builder{}
+		if err := n.wrapper.Execute(ctx, content); err != nil {
+			return err
+		}
+		text := strings.TrimSpace(content.String())
+		if len(text) == 0 {
+			continue
+		}
+		forward = append(forward, zeroMessage.CustomNode(name.String(), fmt.Sprint(uin.Interface()), text))
+		contents = append(contents, text)
+	}
+	if len(forward) == 0 {
+		return nil
+	}
+	if groupID == 0 {
+		// forward message can only be sent to groups, write contents as usual
+		log.Warn("forward: not in a group, contents are sent as normal message")
+		_, err := writer.WriteString(strings.Join(contents, "\n"))
+		if err != nil {
+			return ctx.Error(err.Error(), nil)
+		}
+		return nil
+	}
+	zero.SendGroupForwardMessage(groupID, forward)
+	return nil
+}
+
+// TagForwardParser parses `{% forward [group_id] %}{% node name uin %}...{% endforward %}`
+func TagForwardParser(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
+	forwardNode := &tagForwardNode{}
+	if arguments.Remaining() > 0 {
+		groupID, err := arguments.ParseExpression()
+		if err != nil {
+			return nil, err
+		}
+		forwardNode.groupID = groupID
+	}
+	if arguments.Remaining() > 0 {
+		return nil, arguments.Error("forward takes at most one argument: group id", nil)
+	}
+	// contents before the first node are ignored
+	wrapper, nodeArgs, err := doc.WrapUntilTag("node", "endforward", "end_forward")
+	if err != nil {
+		return nil, err
+	}
+	for wrapper.Endtag == "node" {
+		n := &forwardMessageNode{}
+		if n.name, err = nodeArgs.ParseExpression(); err != nil {
+			return nil, err
+		}
+		if n.uin, err = nodeArgs.ParseExpression(); err != nil {
+			return nil, err
+		}
+		if nodeArgs.Remaining() > 0 {
+			return nil, nodeArgs.Error("node takes exactly two arguments: name and uin", nil)
+		}
+		n.wrapper, nodeArgs, err = doc.WrapUntilTag("node", "endforward", "end_forward")
+		if err != nil {
+			return nil, err
+		}
+		wrapper = n.wrapper
+		forwardNode.nodes = append(forwardNode.nodes, n)
+	}
+	if len(forwardNode.nodes) == 0 {
+		return nil, arguments.Error("forward requires at least one node", start)
+	}
+	return forwardNode, nil
+}
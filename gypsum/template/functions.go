@@ -1,12 +1,10 @@
 package template
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
-	"net/http"
-	"os"
 	"path"
 	"strings"
 	"time"
@@ -16,6 +14,8 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/helper/mediainfo"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 func At(qq ...interface{}) *pongo2.Value {
@@ -36,6 +36,22 @@ func atqq(qq interface{}) string {
 	}
 }
 
+var resourceMIME func(uri string) (string, bool)
+
+// SetResourceMIMEFunc sets the function to find out MIME type of a gypsum resource from its uri
+func SetResourceMIMEFunc(fn func(string) (string, bool)) {
+	resourceMIME = fn
+}
+
+func checkResourceType(function, src string, accept func(string) bool) {
+	if resourceMIME == nil {
+		return
+	}
+	if m, ok := resourceMIME(src); ok && !accept(m) {
+		log.Warnf("function %s: resource %s is %s, it may not be sent correctly", function, src, m)
+	}
+}
+
 func Image(src string, args ...int) *pongo2.Value {
 	// onenot can handle it well :)
 	var cache int
@@ -48,6 +64,7 @@ func Image(src string, args ...int) *pongo2.Value {
 		log.Warn("function image: too many arguments")
 		cache = args[0]
 	}
+	checkResourceType("image", src, mediainfo.IsImage)
 	return pongo2.AsSafeValue(fmt.Sprintf("[CQ:image,cache=%d,file=%s] ", cache, src))
 }
 
@@ -60,20 +77,40 @@ func Record(src string, args ...int) *pongo2.Value {
 	case 1:
 		cache = args[0]
 	default:
-		log.Warn("function image: too many arguments")
+		log.Warn("function record: too many arguments")
 		cache = args[0]
 	}
+	checkResourceType("record", src, mediainfo.IsAudio)
 	return pongo2.AsSafeValue(fmt.Sprintf("[CQ:record,cache=%d,file=%s] ", cache, src))
 }
 
-func Sleep(duration interface{}) string {
-	seconds, err := helper.AnyToFloat(duration)
-	if err != nil {
-		log.Warnf("error: cannot accept %#v as interger", duration)
-		return "ERROR"
+// Reply quotes the message, it should be put at the beginning of message
+func Reply(messageID interface{}) *pongo2.Value {
+	switch messageID.(type) {
+	case int, int32, int64, uint, uint32, uint64, string:
+		return pongo2.AsSafeValue(fmt.Sprintf("[CQ:reply,id=%v]", messageID))
+	default:
+		log.Warnf("error: cannot accept %#v as message id", messageID)
+		return pongo2.AsValue(nil)
+	}
+}
+
+// Sleep returns `sleep` that wakes up when the execution is cancelled
+func Sleep(ctx context.Context) func(duration interface{}) string {
+	return func(duration interface{}) string {
+		seconds, err := helper.AnyToFloat(duration)
+		if err != nil {
+			log.Warnf("error: cannot accept %#v as interger", duration)
+			return "ERROR"
+		}
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		return ""
 	}
-	time.Sleep(time.Duration(seconds * float64(time.Second)))
-	return ""
 }
 
 func RandomInt(input ...interface{}) (int, error) {
@@ -106,30 +143,24 @@ func RandomInt(input ...interface{}) (int, error) {
 	return rand.Intn(max) + min, nil
 }
 
-func FileGetContents(filename string) string {
-	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
-		res, err := http.Get(filename)
-		if err != nil {
-			log.Error("模板解析错误", err)
-			return ""
-		}
-		if res.StatusCode >= 400 {
-			log.Error("模板解析错误，网络请求返回值", res.StatusCode)
-			return ""
+// FileGetContents returns `file_get_contents` that reads files and urls allowed by sandbox
+func FileGetContents(ctx context.Context, box *sandbox.Sandbox) func(filename string) string {
+	return func(filename string) string {
+		if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+			content, err := box.Get(ctx, filename)
+			if err != nil {
+				log.Error("模板解析错误，读取网络资源", err)
+				return ""
+			}
+			return string(content)
 		}
-		content, err := io.ReadAll(res.Body)
+		content, err := box.ReadFile(filename)
 		if err != nil {
-			log.Error("模板解析错误，读取网络资源", err)
+			log.Error("模板解析错误，读取文件", err)
 			return ""
 		}
 		return string(content)
 	}
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		log.Error("模板解析错误，读取文件", err)
-		return ""
-	}
-	return string(content)
 }
 
 func ParseJson(jsonBody string) interface{} {
@@ -142,20 +173,49 @@ func ParseJson(jsonBody string) interface{} {
 	return r
 }
 
+// optionsMap reads options given as a map or a json string
+func optionsMap(raw interface{}) (map[string]interface{}, error) {
+	switch o := raw.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return o, nil
+	case string:
+		var parsed interface{}
+		if err := jsoniter.UnmarshalFromString(o, &parsed); err != nil {
+			return nil, fmt.Errorf("cannot parse options: %s", err)
+		}
+		m, ok := parsed.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("options should be an object")
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("cannot use %#v as options", raw)
+	}
+}
+
 func RandomLine(c string) string {
 	lines := strings.Split(c, "\n")
 	choice := rand.Intn(len(lines))
 	return lines[choice]
 }
 
-func RandomFile(dirPath string) string {
-	dir, err := os.ReadDir(dirPath)
-	if err != nil {
-		log.Error("模板解析错误，读取目录", err)
-		return ""
+// RandomFile returns `random_file` that lists directories allowed by sandbox
+func RandomFile(box *sandbox.Sandbox) func(dirPath string) string {
+	return func(dirPath string) string {
+		dir, err := box.ReadDir(dirPath)
+		if err != nil {
+			log.Error("模板解析错误，读取目录", err)
+			return ""
+		}
+		if len(dir) == 0 {
+			log.Error("模板解析错误，目录为空", dirPath)
+			return ""
+		}
+		choice := rand.Intn(len(dir))
+		return path.Join(dirPath, dir[choice].Name())
 	}
-	choice := rand.Intn(len(dir))
-	return path.Join(dirPath, dir[choice].Name())
 }
 
 func Sequence(input interface{}) ([]int, error) {
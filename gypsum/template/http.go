@@ -0,0 +1,309 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+)
+
+const httpCachePrefix = "gypsum-httpCache-"
+
+// maxCachedBodySize is the max size of response body that can be cached
+const maxCachedBodySize = 256 << 10
+
+type httpOptions struct {
+	method   string
+	headers  map[string]string
+	query    url.Values
+	body     []byte
+	timeout  time.Duration
+	user     string
+	password string
+	cacheTTL time.Duration
+}
+
+// cachedResponse is stored in database when caching is enabled
+type cachedResponse struct {
+	Expire int64 // unix seconds
+	Status int
+	Header map[string]string
+	Body   []byte
+}
+
+// HTTPRequest returns `http` that sends requests allowed by sandbox.
+// the options are a map or a json string, see docs for the fields.
+func HTTPRequest(ctx context.Context, box *sandbox.Sandbox) func(rawURL string, options ...interface{}) map[string]interface{} {
+	return func(rawURL string, options ...interface{}) map[string]interface{} {
+		var rawOptions interface{}
+		if len(options) != 0 {
+			rawOptions = options[0]
+		}
+		opts, err := parseHTTPOptions(rawOptions)
+		if err != nil {
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		if len(opts.query) != 0 {
+			q := u.Query()
+			for k, v := range opts.query {
+				q[k] = append(q[k], v...)
+			}
+			u.RawQuery = q.Encode()
+		}
+		// check before looking up cache, so that cache of other plugins does not bypass the sandbox
+		if !box.HostAllowed(u.Hostname()) {
+			err := fmt.Errorf("%w: %s", sandbox.ErrHostNotAllowed, u.Hostname())
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		cacheKey := opts.cacheKey(u.String())
+		if opts.cacheTTL > 0 {
+			if cached, ok := loadCachedResponse(cacheKey); ok {
+				return httpResult(cached.Status, cached.Header, cached.Body, true)
+			}
+		}
+		reqCtx := ctx
+		if opts.timeout > 0 {
+			var cancel context.CancelFunc
+			reqCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+			defer cancel()
+		}
+		req, err := http.NewRequestWithContext(reqCtx, opts.method, u.String(), bytes.NewReader(opts.body))
+		if err != nil {
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		for k, v := range opts.headers {
+			req.Header.Set(k, v)
+		}
+		if opts.user != "" || opts.password != "" {
+			req.SetBasicAuth(opts.user, opts.password)
+		}
+		res, err := box.Client().Do(req)
+		if err != nil {
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			log.Errorf("http: %s", err)
+			return httpFailure(err)
+		}
+		header := make(map[string]string, len(res.Header))
+		for k := range res.Header {
+			header[k] = res.Header.Get(k)
+		}
+		if opts.cacheTTL > 0 && res.StatusCode < 400 && len(body) <= maxCachedBodySize {
+			saveCachedResponse(cacheKey, &cachedResponse{
+				Expire: time.Now().Add(opts.cacheTTL).Unix(),
+				Status: res.StatusCode,
+				Header: header,
+				Body:   body,
+			})
+		}
+		return httpResult(res.StatusCode, header, body, false)
+	}
+}
+
+func parseHTTPOptions(raw interface{}) (*httpOptions, error) {
+	opts := &httpOptions{
+		headers: make(map[string]string),
+		query:   make(url.Values),
+	}
+	m, err := optionsMap(raw)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range m {
+		switch key {
+		case "method":
+			opts.method = strings.ToUpper(fmt.Sprint(value))
+		case "headers":
+			headers, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("headers should be an object")
+			}
+			for k, v := range headers {
+				opts.headers[k] = fmt.Sprint(v)
+			}
+		case "query":
+			query, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("query should be an object")
+			}
+			for k, v := range query {
+				opts.query.Add(k, fmt.Sprint(v))
+			}
+		case "json":
+			body, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot encode json: %s", err)
+			}
+			opts.body = body
+			opts.setDefaultHeader("Content-Type", "application/json")
+		case "form":
+			form, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("form should be an object")
+			}
+			values := make(url.Values)
+			for k, v := range form {
+				values.Add(k, fmt.Sprint(v))
+			}
+			opts.body = []byte(values.Encode())
+			opts.setDefaultHeader("Content-Type", "application/x-www-form-urlencoded")
+		case "body":
+			opts.body = []byte(fmt.Sprint(value))
+		case "timeout":
+			seconds, err := helper.AnyToFloat(value)
+			if err != nil {
+				return nil, fmt.Errorf("timeout should be a number")
+			}
+			opts.timeout = time.Duration(seconds * float64(time.Second))
+		case "auth":
+			auth, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("auth should be an object with user and pass")
+			}
+			opts.user = fmt.Sprint(auth["user"])
+			opts.password = fmt.Sprint(auth["pass"])
+		case "cache":
+			seconds, err := helper.AnyToInt64(value)
+			if err != nil {
+				return nil, fmt.Errorf("cache should be an integer")
+			}
+			opts.cacheTTL = time.Duration(seconds) * time.Second
+		default:
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	if opts.method == "" {
+		if opts.body != nil {
+			opts.method = http.MethodPost
+		} else {
+			opts.method = http.MethodGet
+		}
+	}
+	return opts, nil
+}
+
+// setDefaultHeader sets header unless it is set in options, header names are case-insensitive
+func (o *httpOptions) setDefaultHeader(key, value string) {
+	for k := range o.headers {
+		if strings.EqualFold(k, key) {
+			return
+		}
+	}
+	o.headers[key] = value
+}
+
+// cacheKey identifies a request by everything that is sent
+func (o *httpOptions) cacheKey(fullURL string) []byte {
+	headerKeys := make([]string, 0, len(o.headers))
+	for k := range o.headers {
+		headerKeys = append(headerKeys, k)
+	}
+	sort.Strings(headerKeys)
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s %s\n", o.method, fullURL)
+	for _, k := range headerKeys {
+		_, _ = fmt.Fprintf(h, "%s: %s\n", strings.ToLower(k), o.headers[k])
+	}
+	_, _ = fmt.Fprintf(h, "%s:%s\n", o.user, o.password)
+	h.Write(o.body)
+	return append([]byte(httpCachePrefix), h.Sum(nil)...)
+}
+
+func loadCachedResponse(key []byte) (*cachedResponse, bool) {
+	data, err := db.Get(key, nil)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cached); err != nil {
+		log.Errorf("error when reading http cache from database: %s", err)
+		return nil, false
+	}
+	if cached.Expire < time.Now().Unix() {
+		_ = db.Delete(key, nil)
+		return nil, false
+	}
+	return &cached, true
+}
+
+// CleanHTTPCache deletes expired http responses in cache
+func CleanHTTPCache() (int, error) {
+	return cleanExpired([]byte(httpCachePrefix), func(data []byte, now int64) bool {
+		var cached cachedResponse
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cached); err != nil {
+			// broken cache is useless
+			return true
+		}
+		return cached.Expire < now
+	})
+}
+
+func saveCachedResponse(key []byte, cached *cachedResponse) {
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(cached); err != nil {
+		log.Errorf("error when encoding http cache: %s", err)
+		return
+	}
+	if err := db.Put(key, buffer.Bytes(), nil); err != nil {
+		log.Errorf("error when saving http cache to database: %s", err)
+	}
+}
+
+func httpResult(status int, header map[string]string, body []byte, cached bool) map[string]interface{} {
+	// header names are changed to lower case with underscores, so that they can be used like `resp.headers.content_type`
+	headers := make(map[string]interface{}, len(header))
+	for k, v := range header {
+		headers[strings.ReplaceAll(strings.ToLower(k), "-", "_")] = v
+	}
+	var parsed interface{}
+	if err := jsoniter.Unmarshal(body, &parsed); err != nil {
+		parsed = nil
+	}
+	return map[string]interface{}{
+		"ok":      status >= 200 && status < 300,
+		"status":  status,
+		"headers": headers,
+		"body":    string(body),
+		"json":    parsed,
+		"cached":  cached,
+		"error":   "",
+	}
+}
+
+func httpFailure(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"ok":      false,
+		"status":  0,
+		"headers": map[string]interface{}{},
+		"body":    "",
+		"json":    nil,
+		"cached":  false,
+		"error":   err.Error(),
+	}
+}
@@ -0,0 +1,28 @@
+package template
+
+import (
+	"reflect"
+
+	"github.com/flosch/pongo2"
+)
+
+type tagPassNode struct{}
+
+// PassNodeType is the type of nodes compiled from `pass`, it is used to find out whether a template may pass
+var PassNodeType = reflect.TypeOf(&tagPassNode{})
+
+// Execute marks the execution as passed, the reply will not be sent,
+// and items with lower priority will be matched
+func (node *tagPassNode) Execute(ctx *pongo2.ExecutionContext, _ pongo2.TemplateWriter) *pongo2.Error {
+	if p, ok := ctx.Public["_pass"].(*bool); ok {
+		*p = true
+	}
+	return nil
+}
+
+func TagPassParser(_ *pongo2.Parser, _ *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
+	if arguments.Remaining() != 0 {
+		return nil, arguments.Error("pass takes no arguments", nil)
+	}
+	return &tagPassNode{}, nil
+}
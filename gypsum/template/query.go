@@ -0,0 +1,193 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// Member is the response of get_group_member_info, ids and times are int64 so that they are printed as they are
+type Member struct {
+	GroupID         int64  `json:"group_id"`
+	UserID          int64  `json:"user_id"`
+	Nickname        string `json:"nickname"`
+	Card            string `json:"card"`
+	Sex             string `json:"sex"`
+	Age             int    `json:"age"`
+	Area            string `json:"area"`
+	JoinTime        int64  `json:"join_time"`
+	LastSentTime    int64  `json:"last_sent_time"`
+	Level           string `json:"level"`
+	Role            string `json:"role"` // owner, admin or member
+	Unfriendly      bool   `json:"unfriendly"`
+	Title           string `json:"title"`
+	TitleExpireTime int64  `json:"title_expire_time"`
+	CardChangeable  bool   `json:"card_changeable"`
+}
+
+// GroupInfo is the response of get_group_info and items of get_group_list
+type GroupInfo struct {
+	GroupID        int64  `json:"group_id"`
+	GroupName      string `json:"group_name"`
+	MemberCount    int    `json:"member_count"`
+	MaxMemberCount int    `json:"max_member_count"`
+}
+
+// UserInfo is the response of get_login_info, get_stranger_info and items of get_friend_list,
+// fields that are not in the response are zero
+type UserInfo struct {
+	UserID   int64  `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Remark   string `json:"remark"`
+	Sex      string `json:"sex"`
+	Age      int    `json:"age"`
+}
+
+// Query reads information from onebot, results are cached during one execution
+type Query struct {
+	groupID int64 // group of event, 0 if there is no group
+	cache   map[string]interface{}
+}
+
+func NewQuery(groupID int64) *Query {
+	return &Query{
+		groupID: groupID,
+		cache:   make(map[string]interface{}),
+	}
+}
+
+// Context returns query functions to be put in execution context
+func (q *Query) Context() pongo2.Context {
+	return pongo2.Context{
+		"self_info": func() interface{} {
+			return q.call("get_login_info", zero.Params{}, new(UserInfo))
+		},
+		"stranger_info": func(userID interface{}) interface{} {
+			user, err := helper.AnyToInt64(userID)
+			if err != nil {
+				log.Warnf("stranger_info: cannot accept %#v as qqid", userID)
+				return nil
+			}
+			return q.call("get_stranger_info", zero.Params{"user_id": user}, new(UserInfo))
+		},
+		"friend_list": func() interface{} {
+			return q.call("get_friend_list", zero.Params{}, new([]UserInfo))
+		},
+		"group_list": func() interface{} {
+			return q.call("get_group_list", zero.Params{}, new([]GroupInfo))
+		},
+		"group_info": func(groupID ...interface{}) interface{} {
+			group, ok := q.group("group_info", groupID)
+			if !ok {
+				return nil
+			}
+			return q.call("get_group_info", zero.Params{"group_id": group}, new(GroupInfo))
+		},
+		"member": func(userID interface{}, groupID ...interface{}) interface{} {
+			group, ok := q.group("member", groupID)
+			if !ok {
+				return nil
+			}
+			user, err := helper.AnyToInt64(userID)
+			if err != nil {
+				log.Warnf("member: cannot accept %#v as qqid", userID)
+				return nil
+			}
+			return q.call("get_group_member_info", zero.Params{"group_id": group, "user_id": user}, new(Member))
+		},
+		"member_list": func(groupID ...interface{}) interface{} {
+			group, ok := q.group("member_list", groupID)
+			if !ok {
+				return nil
+			}
+			return q.call("get_group_member_list", zero.Params{"group_id": group}, new([]Member))
+		},
+	}
+}
+
+// queryResults are the types returned by query functions that return a single value
+var queryResults = map[string]reflect.Type{
+	"self_info":     reflect.TypeOf(UserInfo{}),
+	"stranger_info": reflect.TypeOf(UserInfo{}),
+	"group_info":    reflect.TypeOf(GroupInfo{}),
+	"member":        reflect.TypeOf(Member{}),
+}
+
+// QueryFields returns the fields of result of query function, ok is false if function is not a query returning a single value
+func QueryFields(function string) (fields map[string]bool, ok bool) {
+	t, ok := queryResults[function]
+	if !ok {
+		return nil, false
+	}
+	fields = make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	return fields, true
+}
+
+// group returns the group given in arguments, or the group of event
+func (q *Query) group(function string, args []interface{}) (int64, bool) {
+	if len(args) == 0 {
+		if q.groupID == 0 {
+			log.Warnf("%s: no group id is given and the event is not in a group", function)
+			return 0, false
+		}
+		return q.groupID, true
+	}
+	group, err := helper.AnyToInt64(args[0])
+	if err != nil {
+		log.Warnf("%s: cannot accept %#v as group id", function, args[0])
+		return 0, false
+	}
+	return group, true
+}
+
+// call decodes the response of action into result, which is a pointer to a struct or a slice of structs
+func (q *Query) call(action string, params zero.Params, result interface{}) interface{} {
+	key := action + fmt.Sprint(params)
+	if value, ok := q.cache[key]; ok {
+		return value
+	}
+	var value interface{}
+	if r := zero.CallAction(action, params); r.Exists() && r.Type != gjson.Null {
+		if err := json.Unmarshal([]byte(r.Raw), result); err != nil {
+			log.Warnf("%s: cannot decode response: %s", action, err)
+		} else {
+			value = fieldsByJSONName(reflect.ValueOf(result).Elem())
+		}
+	}
+	q.cache[key] = value
+	return value
+}
+
+// fieldsByJSONName converts structs to maps keyed by json names, so that templates use `member.card` instead of `member.Card`,
+// pongo2 only finds fields by their go names
+func fieldsByJSONName(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Slice:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = fieldsByJSONName(v.Index(i))
+		}
+		return s
+	case reflect.Struct:
+		t := v.Type()
+		m := make(map[string]interface{}, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			m[name] = v.Field(i).Interface()
+		}
+		return m
+	default:
+		return v.Interface()
+	}
+}
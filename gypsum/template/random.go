@@ -0,0 +1,371 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// Random generates random values, results are the same every time if it is seeded with the same keys
+type Random struct {
+	r *rand.Rand
+}
+
+// NewRandom returns an unseeded Random
+func NewRandom() *Random {
+	return &Random{r: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// SeededRandom returns a Random seeded by keys, keys can be any values, e.g. user id and date
+func SeededRandom(keys ...interface{}) *Random {
+	h := sha256.New()
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(h, "%v\x00", key)
+	}
+	seed := int64(binary.LittleEndian.Uint64(h.Sum(nil)))
+	return &Random{r: rand.New(rand.NewSource(seed))}
+}
+
+// Int returns an integer in [min, max], both ends are included
+func (r *Random) Int(min, max int) int {
+	if min > max {
+		min, max = max, min
+	}
+	// the span is computed in uint64 so that ranges wider than MaxInt do not overflow
+	span := uint64(max) - uint64(min)
+	if span < uint64(maxInt) {
+		return min + r.r.Intn(int(span)+1)
+	}
+	for {
+		n := r.r.Uint64() & uint64(^uint(0))
+		if span == uint64(^uint(0)) || n <= span {
+			return min + int(n)
+		}
+	}
+}
+
+// Float returns a number in [0, 1)
+func (r *Random) Float() float64 {
+	return r.r.Float64()
+}
+
+// WeightedIndex returns an index with probability proportional to its weight,
+// negative weights are seen as 0. if all weights are 0, the index is chosen uniformly
+func (r *Random) WeightedIndex(weights []float64) int {
+	var total float64
+	for _, w := range weights {
+		if w > 0 {
+			total += w
+		}
+	}
+	if total == 0 {
+		return r.r.Intn(len(weights))
+	}
+	x := r.r.Float64() * total
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+func (r *Random) Choice(list []interface{}) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	return list[r.r.Intn(len(list))]
+}
+
+func (r *Random) WeightedChoice(list []interface{}, weights []float64) (interface{}, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if len(list) != len(weights) {
+		return nil, errors.New("list and weights should have the same length")
+	}
+	return list[r.WeightedIndex(weights)], nil
+}
+
+// Shuffle returns a shuffled copy of list
+func (r *Random) Shuffle(list []interface{}) []interface{} {
+	shuffled := make([]interface{}, len(list))
+	copy(shuffled, list)
+	r.r.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+func (r *Random) Line(text string) string {
+	lines := strings.Split(text, "\n")
+	return lines[r.r.Intn(len(lines))]
+}
+
+// DiceResult is the result of rolling dice notation
+type DiceResult struct {
+	Total int
+	Rolls []int  // all dice in order
+	Text  string // e.g. "3d6+2 = [4,2,6]+2 = 14"
+}
+
+const (
+	maxInt       = int(^uint(0) >> 1)
+	maxDice      = 100
+	maxDiceSides = 10000
+	maxDiceTerms = 20
+)
+
+// Dice rolls dice notation like "3d6+2", "d20" or "2d10-1d4+3", "d%" is the same as "d100"
+func (r *Random) Dice(notation string) (*DiceResult, error) {
+	expr := strings.ToLower(strings.ReplaceAll(notation, " ", ""))
+	if expr == "" {
+		return nil, errors.New("empty dice notation")
+	}
+	result := &DiceResult{}
+	var details strings.Builder
+	terms := 0
+	for len(expr) != 0 {
+		sign := 1
+		switch expr[0] {
+		case '-':
+			sign = -1
+			fallthrough
+		case '+':
+			if terms != 0 {
+				details.WriteByte(expr[0])
+			} else if sign < 0 {
+				details.WriteByte('-')
+			}
+			expr = expr[1:]
+		default:
+			if terms != 0 {
+				return nil, fmt.Errorf("invalid dice notation %s", notation)
+			}
+		}
+		end := strings.IndexAny(expr, "+-")
+		if end == -1 {
+			end = len(expr)
+		}
+		term := expr[:end]
+		expr = expr[end:]
+		terms++
+		if terms > maxDiceTerms {
+			return nil, fmt.Errorf("too many terms in %s", notation)
+		}
+		d := strings.IndexByte(term, 'd')
+		if d == -1 {
+			n, err := strconv.Atoi(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dice notation %s", notation)
+			}
+			result.Total += sign * n
+			details.WriteString(term)
+			continue
+		}
+		count, sides := 1, 0
+		if d != 0 {
+			var err error
+			if count, err = strconv.Atoi(term[:d]); err != nil {
+				return nil, fmt.Errorf("invalid dice notation %s", notation)
+			}
+		}
+		if term[d+1:] == "%" {
+			sides = 100
+		} else {
+			var err error
+			if sides, err = strconv.Atoi(term[d+1:]); err != nil {
+				return nil, fmt.Errorf("invalid dice notation %s", notation)
+			}
+		}
+		if count < 1 || count > maxDice || sides < 1 || sides > maxDiceSides {
+			return nil, fmt.Errorf("at most %d dice with at most %d sides can be rolled", maxDice, maxDiceSides)
+		}
+		rolls := make([]string, count)
+		for i := range rolls {
+			roll := r.r.Intn(sides) + 1
+			result.Rolls = append(result.Rolls, roll)
+			result.Total += sign * roll
+			rolls[i] = strconv.Itoa(roll)
+		}
+		details.WriteString("[" + strings.Join(rolls, ",") + "]")
+	}
+	result.Text = fmt.Sprintf("%s = %s = %d", notation, details.String(), result.Total)
+	return result, nil
+}
+
+// Functions returns functions to be used like `rng(event.user_id, today()).int(1, 100)` in templates
+func (r *Random) Functions() map[string]interface{} {
+	return map[string]interface{}{
+		"int": func(args ...interface{}) int {
+			min, max, err := intRange(args)
+			if err != nil {
+				log.Errorf("int: %s", err)
+				return 0
+			}
+			return r.Int(min, max)
+		},
+		"float": r.Float,
+		"choice": func(list interface{}) interface{} {
+			l, err := toList(list)
+			if err != nil {
+				log.Errorf("choice: %s", err)
+				return nil
+			}
+			return r.Choice(l)
+		},
+		"weighted_choice": func(list, weights interface{}) interface{} {
+			return weightedChoice(r, list, weights)
+		},
+		"shuffle": func(list interface{}) []interface{} {
+			l, err := toList(list)
+			if err != nil {
+				log.Errorf("shuffle: %s", err)
+				return nil
+			}
+			return r.Shuffle(l)
+		},
+		"line": r.Line,
+		"dice": func(notation string) int {
+			result, err := r.Dice(notation)
+			if err != nil {
+				log.Errorf("dice: %s", err)
+				return 0
+			}
+			return result.Total
+		},
+		"dice_detail": func(notation string) string {
+			result, err := r.Dice(notation)
+			if err != nil {
+				log.Errorf("dice_detail: %s", err)
+				return ""
+			}
+			return result.Text
+		},
+		"_random": r,
+	}
+}
+
+// Shuffle returns a shuffled copy of list
+func Shuffle(list interface{}) []interface{} {
+	l, err := toList(list)
+	if err != nil {
+		log.Errorf("shuffle: %s", err)
+		return nil
+	}
+	return NewRandom().Shuffle(l)
+}
+
+// WeightedChoice chooses an item of list, the probability is proportional to its weight
+func WeightedChoice(list, weights interface{}) interface{} {
+	return weightedChoice(NewRandom(), list, weights)
+}
+
+// Dice rolls dice notation like "3d6+2" and returns the total
+func Dice(notation string) int {
+	result, err := NewRandom().Dice(notation)
+	if err != nil {
+		log.Errorf("dice: %s", err)
+		return 0
+	}
+	return result.Total
+}
+
+// DiceDetail rolls dice notation and returns every die, like "3d6+2 = [4,2,6]+2 = 14"
+func DiceDetail(notation string) string {
+	result, err := NewRandom().Dice(notation)
+	if err != nil {
+		log.Errorf("dice_detail: %s", err)
+		return ""
+	}
+	return result.Text
+}
+
+// Rng returns seeded random functions, see Random.Functions
+func Rng(keys ...interface{}) map[string]interface{} {
+	return SeededRandom(keys...).Functions()
+}
+
+// Today returns local date like "2006-01-02", to be used as a key of `rng`
+func Today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+func intRange(args []interface{}) (int, int, error) {
+	switch len(args) {
+	case 0:
+		return 0, 99, nil
+	case 1:
+		max, err := helper.AnyToInt(args[0])
+		return 0, max, err
+	case 2:
+		min, err := helper.AnyToInt(args[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		max, err := helper.AnyToInt(args[1])
+		return min, max, err
+	default:
+		return 0, 0, errors.New("too many arguments")
+	}
+}
+
+func weightedChoice(r *Random, list, weights interface{}) interface{} {
+	l, err := toList(list)
+	if err != nil {
+		log.Errorf("weighted_choice: %s", err)
+		return nil
+	}
+	w, err := toList(weights)
+	if err != nil {
+		log.Errorf("weighted_choice: %s", err)
+		return nil
+	}
+	floats := make([]float64, len(w))
+	for i, weight := range w {
+		if floats[i], err = helper.AnyToFloat(weight); err != nil {
+			log.Errorf("weighted_choice: cannot use %#v as weight", weight)
+			return nil
+		}
+	}
+	choice, err := r.WeightedChoice(l, floats)
+	if err != nil {
+		log.Errorf("weighted_choice: %s", err)
+		return nil
+	}
+	return choice
+}
+
+// toList converts slices of any type, and json strings of arrays
+func toList(value interface{}) ([]interface{}, error) {
+	if s, ok := value.(string); ok {
+		parsed, ok := ParseJson(s).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%#v is not a list", value)
+		}
+		return parsed, nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%#v is not a list", value)
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, nil
+}
@@ -1,31 +1,99 @@
 package template
 
 import (
-	"math/rand"
-
 	"github.com/flosch/pongo2"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
 )
 
 type tagRandomChoiceNode struct {
+	seed     pongo2.IEvaluator   // nil for unseeded
+	weights  []pongo2.IEvaluator // nil for weight 1
 	wrappers []*pongo2.NodeWrapper
 }
 
 func (node *tagRandomChoiceNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
-	choice := rand.Intn(len(node.wrappers))
-	return node.wrappers[choice].Execute(ctx, writer)
+	var r *Random
+	if node.seed == nil {
+		r = NewRandom()
+	} else {
+		seed, err := node.seed.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		// seeded by rng(...), so that following choices are different
+		if functions, ok := seed.Interface().(map[string]interface{}); ok {
+			r, _ = functions["_random"].(*Random)
+		}
+		if r == nil {
+			r = SeededRandom(seed.Interface())
+		}
+	}
+	weights := make([]float64, len(node.wrappers))
+	for i, weight := range node.weights {
+		if weight == nil {
+			weights[i] = 1
+			continue
+		}
+		value, err := weight.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		w, e := helper.AnyToFloat(value.Interface())
+		if e != nil {
+			return ctx.Error("weight of random_choice should be a number", nil)
+		}
+		weights[i] = w
+	}
+	return node.wrappers[r.WeightedIndex(weights)].Execute(ctx, writer)
+}
+
+// parseChoiceArguments parses `weight=...` and `seed=...` (only if allowSeed)
+func parseChoiceArguments(arguments *pongo2.Parser, allowSeed bool) (weight, seed pongo2.IEvaluator, err *pongo2.Error) {
+	for arguments.Remaining() > 0 {
+		key := arguments.MatchType(pongo2.TokenIdentifier)
+		if key == nil || (key.Val != "weight" && (key.Val != "seed" || !allowSeed)) {
+			return nil, nil, arguments.Error("unknown argument of random_choice", nil)
+		}
+		if arguments.Match(pongo2.TokenSymbol, "=") == nil {
+			return nil, nil, arguments.Error("'=' expected", nil)
+		}
+		expr, err := arguments.ParseExpression()
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.Val == "weight" {
+			weight = expr
+		} else {
+			seed = expr
+		}
+	}
+	return weight, seed, nil
 }
 
 func TagRandomChoiceParser(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
 	node := &tagRandomChoiceNode{}
+	weight, seed, err := parseChoiceArguments(arguments, true)
+	if err != nil {
+		return nil, err
+	}
+	node.seed = seed
 	for {
-		wrapper, _, err := doc.WrapUntilTag("otherwise", "end_random_choice")
+		node.weights = append(node.weights, weight)
+		wrapper, endArguments, err := doc.WrapUntilTag("otherwise", "end_random_choice")
 		if err != nil {
 			return nil, err
 		}
 		node.wrappers = append(node.wrappers, wrapper)
 		if wrapper.Endtag == "end_random_choice" {
+			if endArguments.Remaining() > 0 {
+				return nil, endArguments.Error("end_random_choice takes no argument", nil)
+			}
 			break
 		}
+		if weight, _, err = parseChoiceArguments(endArguments, false); err != nil {
+			return nil, err
+		}
 	}
 	return node, nil
 }
@@ -0,0 +1,155 @@
+package template
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRandomInt(t *testing.T) {
+	r := NewRandom()
+	cases := []struct{ min, max int }{
+		{1, 6},
+		{6, 1},
+		{-3, 3},
+		{5, 5},
+		{0, math.MaxInt64},
+		{math.MinInt64, 0},
+		{math.MinInt64, math.MaxInt64},
+		{-9e18, 9e18},
+		{math.MaxInt64 - 1, math.MaxInt64},
+	}
+	for _, c := range cases {
+		lo, hi := c.min, c.max
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		for i := 0; i < 100; i++ {
+			if n := r.Int(c.min, c.max); n < lo || n > hi {
+				t.Fatalf("Int(%d, %d) = %d, out of range", c.min, c.max, n)
+			}
+		}
+	}
+}
+
+func TestRandomIntCoversRange(t *testing.T) {
+	r := SeededRandom("cover")
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		seen[r.Int(1, 6)] = true
+	}
+	for n := 1; n <= 6; n++ {
+		if !seen[n] {
+			t.Fatalf("Int(1, 6) never returned %d", n)
+		}
+	}
+}
+
+func TestSeededRandomDeterminism(t *testing.T) {
+	roll := func(keys ...interface{}) []int {
+		r := SeededRandom(keys...)
+		values := make([]int, 0, 10)
+		for i := 0; i < 8; i++ {
+			values = append(values, r.Int(1, 1000000))
+		}
+		values = append(values, r.Int(math.MinInt64, math.MaxInt64))
+		dice, err := r.Dice("3d6+2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(values, dice.Total)
+	}
+	a := roll(int64(12345), "2021-03-01")
+	b := roll(int64(12345), "2021-03-01")
+	c := roll(int64(12345), "2021-03-02")
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("same keys give different values: %v and %v", a, b)
+		}
+	}
+	same := true
+	for i := range a {
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Fatalf("different keys give the same values: %v", a)
+	}
+	// the separator keeps ("ab", "c") and ("a", "bc") apart
+	if SeededRandom("ab", "c").Int(0, math.MaxInt64) == SeededRandom("a", "bc").Int(0, math.MaxInt64) {
+		t.Fatal("keys are not separated")
+	}
+}
+
+func TestDice(t *testing.T) {
+	r := NewRandom()
+	cases := []struct {
+		notation string
+		min, max int
+		rolls    int
+	}{
+		{"d20", 1, 20, 1},
+		{"3d6+2", 5, 20, 3},
+		{"2d10-1d4+3", -2, 22, 3},
+		{"D%", 1, 100, 1},
+		{"-d6", -6, -1, 1},
+		{" 1d6 + 1 ", 2, 7, 1},
+		{"7", 7, 7, 0},
+		{"100d1", 100, 100, 100},
+	}
+	for _, c := range cases {
+		for i := 0; i < 50; i++ {
+			result, err := r.Dice(c.notation)
+			if err != nil {
+				t.Fatalf("Dice(%q): %s", c.notation, err)
+			}
+			if result.Total < c.min || result.Total > c.max {
+				t.Fatalf("Dice(%q) = %d, want in [%d, %d]", c.notation, result.Total, c.min, c.max)
+			}
+			if len(result.Rolls) != c.rolls {
+				t.Fatalf("Dice(%q) rolled %d dice, want %d", c.notation, len(result.Rolls), c.rolls)
+			}
+		}
+	}
+}
+
+func TestDiceText(t *testing.T) {
+	result, err := SeededRandom("text").Dice("2d1+3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2d1+3 = [1,1]+3 = 5"; result.Text != want {
+		t.Fatalf("got %q, want %q", result.Text, want)
+	}
+	result, err = SeededRandom("text").Dice("-1d1-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-1d1-2 = -[1]-2 = -3"; result.Text != want {
+		t.Fatalf("got %q, want %q", result.Text, want)
+	}
+}
+
+func TestDiceErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"abc",
+		"d",
+		"2d",
+		"0d6",
+		"101d6",
+		"1d0",
+		"1d10001",
+		"1d6x",
+		"1d6+",
+		strings.Repeat("1+", 20) + "1",
+	}
+	r := NewRandom()
+	for _, notation := range cases {
+		if result, err := r.Dice(notation); err == nil {
+			t.Fatalf("Dice(%q) = %d, want an error", notation, result.Total)
+		}
+	}
+	if Dice("abc") != 0 || DiceDetail("abc") != "" {
+		t.Fatal("invalid notation should give zero values")
+	}
+}
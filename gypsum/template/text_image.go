@@ -0,0 +1,105 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/textimage"
+)
+
+var renderTextImage func(text string, opts textimage.Options) (string, error)
+
+// SetTextImageFunc sets the function that renders text and returns the uri of the image
+func SetTextImageFunc(fn func(string, textimage.Options) (string, error)) {
+	renderTextImage = fn
+}
+
+// TextImageCode renders text and returns the CQ code of the image,
+// escaped should be true if the text is rendered by template with auto-escape
+func TextImageCode(text string, rawOptions interface{}, escaped bool) (string, error) {
+	if renderTextImage == nil {
+		return "", fmt.Errorf("text image is not available")
+	}
+	m, err := optionsMap(rawOptions)
+	if err != nil {
+		return "", err
+	}
+	opts, err := textimage.ParseOptions(m)
+	if err != nil {
+		return "", err
+	}
+	opts.Escaped = escaped
+	uri, err := renderTextImage(text, opts)
+	if err != nil {
+		return "", err
+	}
+	return Image(uri).String(), nil
+}
+
+// TextImage renders text into an image, options are a map or a json string
+func TextImage(text string, options ...interface{}) *pongo2.Value {
+	var rawOptions interface{}
+	if len(options) != 0 {
+		rawOptions = options[0]
+	}
+	code, err := TextImageCode(text, rawOptions, false)
+	if err != nil {
+		log.Errorf("text_image: %s", err)
+		return pongo2.AsValue("")
+	}
+	return pongo2.AsSafeValue(code)
+}
+
+type tagTextImageNode struct {
+	options pongo2.IEvaluator // nil for default options
+	wrapper *pongo2.NodeWrapper
+}
+
+func (node *tagTextImageNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
+	var content = &strings.Builder{}
+	if err := node.wrapper.Execute(ctx, content); err != nil {
+		return err
+	}
+	text := strings.TrimSpace(content.String())
+	if len(text) == 0 {
+		return nil
+	}
+	var rawOptions interface{}
+	if node.options != nil {
+		v, err := node.options.Evaluate(ctx)
+		if err != nil {
+			return err
+		}
+		rawOptions = v.Interface()
+	}
+	code, err := TextImageCode(text, rawOptions, ctx.Autoescape)
+	if err != nil {
+		return ctx.Error(fmt.Sprintf("text_image: %s", err), nil)
+	}
+	_, _ = writer.WriteString(code)
+	return nil
+}
+
+// TagTextImageParser parses `{% text_image [options] %}...{% endtext_image %}`
+func TagTextImageParser(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
+	node := &tagTextImageNode{}
+	wrapper, _, err := doc.WrapUntilTag("endtext_image", "end_text_image")
+	if err != nil {
+		return nil, err
+	}
+	node.wrapper = wrapper
+	if arguments.Remaining() != 0 {
+		options, err := arguments.ParseExpression()
+		if err != nil {
+			return nil, err
+		}
+		node.options = options
+	}
+	if arguments.Remaining() != 0 {
+		return nil, arguments.Error("too many arguments", nil)
+	}
+	return node, nil
+}
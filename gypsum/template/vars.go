@@ -0,0 +1,24 @@
+package template
+
+import (
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// scopes of variables, a scope is stored as the type followed by ids
+const (
+	UserScopeType   byte = 'u'
+	GroupScopeType  byte = 'g'
+	MemberScopeType byte = 'm'
+)
+
+func UserScope(userID int64) []byte {
+	return append([]byte{UserScopeType}, helper.U64ToBytes(uint64(userID))...)
+}
+
+func GroupScope(groupID int64) []byte {
+	return append([]byte{GroupScopeType}, helper.U64ToBytes(uint64(groupID))...)
+}
+
+func MemberScope(groupID, userID int64) []byte {
+	return append(append([]byte{MemberScopeType}, helper.U64ToBytes(uint64(groupID))...), helper.U64ToBytes(uint64(userID))...)
+}
@@ -1,6 +1,7 @@
 package gypsum
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -13,10 +14,30 @@ import (
 
 	"github.com/yuudi/gypsum/gypsum/helper"
 	"github.com/yuudi/gypsum/gypsum/luatag"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 	"github.com/yuudi/gypsum/gypsum/template"
 )
 
+var (
+	defaultSandbox  *sandbox.Sandbox
+	pluginSandboxes map[string]*sandbox.Sandbox
+)
+
+func initSandboxes() {
+	defaultSandbox = sandbox.New(Config.Sandbox.Policy)
+	pluginSandboxes = make(map[string]*sandbox.Sandbox, len(Config.Sandbox.Plugins))
+	for name, policy := range Config.Sandbox.Plugins {
+		pluginSandboxes[name] = sandbox.New(Config.Sandbox.Policy.Merge(policy))
+	}
+}
+
 func initTemplating() error {
+	// `ssi` reads any file on disk
+	if err := templateSet.BanTag("ssi"); err != nil {
+		return err
+	}
+	initSandboxes()
+
 	// replace default HTML filter to CQ filter
 	if err := pongo2.ReplaceFilter("escape", filterEscapeCQCode); err != nil {
 		return err
@@ -37,16 +58,33 @@ func initTemplating() error {
 	pongo2.Globals["res"] = resourcePathFunc(Config.ResourceShare)
 	pongo2.Globals["image"] = template.Image
 	pongo2.Globals["record"] = template.Record
-	pongo2.Globals["sleep"] = template.Sleep
+	pongo2.Globals["reply"] = template.Reply
+	pongo2.Globals["sleep"] = template.Sleep(context.Background())
 	pongo2.Globals["range"] = template.Sequence
 	pongo2.Globals["url_encode"] = url.QueryEscape
 	pongo2.Globals["random_int"] = template.RandomInt
 	pongo2.Globals["random_line"] = template.RandomLine
-	pongo2.Globals["random_file"] = template.RandomFile
-	pongo2.Globals["file_get_contents"] = template.FileGetContents
+	pongo2.Globals["random_file"] = template.RandomFile(defaultSandbox)
+	pongo2.Globals["weighted_choice"] = template.WeightedChoice
+	pongo2.Globals["shuffle"] = template.Shuffle
+	pongo2.Globals["dice"] = template.Dice
+	pongo2.Globals["dice_detail"] = template.DiceDetail
+	pongo2.Globals["rng"] = template.Rng
+	pongo2.Globals["today"] = template.Today
+	pongo2.Globals["file_get_contents"] = template.FileGetContents(context.Background(), defaultSandbox)
+	pongo2.Globals["http"] = template.HTTPRequest(context.Background(), defaultSandbox)
 	pongo2.Globals["parse_json"] = template.ParseJson
+	pongo2.Globals["text_image"] = template.TextImage
 	pongo2.Globals["db_get"] = template.DatabaseGet
 	pongo2.Globals["db_put"] = template.DatabasePut
+	pongo2.Globals["db_delete"] = template.DatabaseDelete
+	pongo2.Globals["db_incr"] = template.DatabaseIncr
+	pongo2.Globals["db_keys"] = template.DatabaseKeys
+	pongo2.Globals["shared_db_get"] = template.DatabaseGet
+	pongo2.Globals["shared_db_put"] = template.DatabasePut
+	pongo2.Globals["shared_db_delete"] = template.DatabaseDelete
+	pongo2.Globals["shared_db_incr"] = template.DatabaseIncr
+	pongo2.Globals["shared_db_keys"] = template.DatabaseKeys
 
 	// register tags
 	if err := pongo2.RegisterTag("lua", luatag.TagLuaParser); err != nil {
@@ -70,10 +108,27 @@ func initTemplating() error {
 	if err := pongo2.RegisterTag("send_group", template.TagSendParser(template.GroupMessageType)); err != nil {
 		return err
 	}
+	if err := pongo2.RegisterTag("forward", template.TagForwardParser); err != nil {
+		return err
+	}
+	if err := pongo2.RegisterTag("text_image", template.TagTextImageParser); err != nil {
+		return err
+	}
+	if err := pongo2.RegisterTag("pass", template.TagPassParser); err != nil {
+		return err
+	}
+
+	luatag.SetDefaultSandbox(defaultSandbox)
 
 	// set lua `res` func
 	luatag.SetResFunc(resourcePathFunc(Config.ResourceShare))
 
+	// rendered images of `text_image` are saved as resources
+	template.SetTextImageFunc(textImageFunc(resourcePathFunc(Config.ResourceShare)))
+
+	// let `image` and `record` check the type of resources
+	template.SetResourceMIMEFunc(resourceMIMEByURI)
+
 	return nil
 }
 
@@ -89,8 +144,8 @@ func filterSilence(_ *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Err
 	return pongo2.AsValue(nil), nil
 }
 
-func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.State, luaState *lua.LState) pongo2.Context {
-	return pongo2.Context{
+func buildExecutionContext(execCtx context.Context, matcher *zero.Matcher, event zero.Event, state zero.State, luaState *lua.LState, parentID func() uint64) pongo2.Context {
+	ctx := pongo2.Context{
 		"matcher": matcher,
 		"state":   state,
 		"event": func() interface{} {
@@ -108,6 +163,16 @@ func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.S
 			}
 			return pongo2.AsSafeValue(fmt.Sprintf("[CQ:at,qq=%d]", event.UserID))
 		},
+		"reply": func(messageID ...interface{}) *pongo2.Value {
+			if len(messageID) != 0 {
+				return template.Reply(messageID[0])
+			}
+			if event.MessageID == 0 {
+				log.Warnf("cannot reply in event %s/%s", event.PostType, event.SubType)
+				return pongo2.AsValue(nil)
+			}
+			return template.Reply(event.MessageID)
+		},
 		"approve": func() {
 			if event.PostType != "request" {
 				log.Warnf("cannot approve: event is not a request: %#v", event)
@@ -155,7 +220,16 @@ func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.S
 				}
 			}
 		},
-		"_event": &event,
-		"_lua":   luaState,
+		"_event":  &event,
+		"_lua":    luaState,
+		passedKey: new(bool),
+	}
+	ctx.Update(template.NewQuery(event.GroupID).Context())
+	if parentID == nil {
+		// debugger runs templates outside of any group
+		ctx["param"] = map[string]interface{}{}
+	} else {
+		setNamespace(ctx, parentID())
 	}
+	return bindExecution(ctx, execCtx)
 }
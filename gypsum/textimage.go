@@ -0,0 +1,76 @@
+package gypsum
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/textimage"
+)
+
+// rendered images are saved in resource storage, and their last used time is recorded with this prefix,
+// images not used for textImageCacheDays are deleted
+const (
+	textImageCachePrefix = "gypsum-textImageCache-"
+	textImageCacheDays   = 7
+)
+
+// textImageFunc returns the function that renders text and returns uri of the image,
+// the same text and options are rendered only once
+func textImageFunc(resourcePath func(string) string) func(string, textimage.Options) (string, error) {
+	return func(text string, opts textimage.Options) (string, error) {
+		sum := opts.CacheKey(text)
+		filename := "textimage-" + sum + ".png"
+		cacheKey := []byte(textImageCachePrefix + sum)
+		now := helper.U64ToBytes(uint64(time.Now().Unix()))
+		if _, err := db.Get(cacheKey, nil); err == nil {
+			if exists, err := resStorage.Exists(filename); err == nil && exists {
+				if err := db.Put(cacheKey, now, nil); err != nil {
+					log.Warnf("error when write database: %s", err)
+				}
+				return resourcePath(filename), nil
+			}
+		}
+		data, err := textimage.Render(text, opts)
+		if err != nil {
+			return "", err
+		}
+		if err := resStorage.Put(filename, bytes.NewReader(data), int64(len(data))); err != nil {
+			return "", err
+		}
+		if err := db.Put(cacheKey, now, nil); err != nil {
+			return "", err
+		}
+		return resourcePath(filename), nil
+	}
+}
+
+// cleanTextImages deletes rendered images that are not used recently
+func cleanTextImages() (int, error) {
+	deadline := uint64(time.Now().Add(-textImageCacheDays * 24 * time.Hour).Unix())
+	iter := db.NewIterator(util.BytesPrefix([]byte(textImageCachePrefix)), nil)
+	batch := new(leveldb.Batch)
+	cleaned := 0
+	for iter.Next() {
+		if helper.ToUint(iter.Value()) > deadline {
+			continue
+		}
+		sum := strings.TrimPrefix(string(iter.Key()), textImageCachePrefix)
+		if err := resStorage.Delete("textimage-" + sum + ".png"); err != nil {
+			log.Warnf("error when deleting rendered image: %s", err)
+			continue
+		}
+		batch.Delete(append([]byte{}, iter.Key()...))
+		cleaned++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	return cleaned, db.Write(batch, nil)
+}
@@ -0,0 +1,327 @@
+// Package textimage renders text into png images with an embedded bitmap font,
+// so that long replies can be sent as one image. CJK characters are supported and no network or system font is needed.
+package textimage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hajimehoshi/bitmapfont/v3"
+	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// Options of rendering, sizes are in font pixels (a chinese character is 12 font pixels wide)
+type Options struct {
+	Scale       int // screen pixels per font pixel
+	Padding     int
+	MaxWidth    int // longer lines are wrapped
+	LineSpacing int
+	Color       color.RGBA
+	Background  color.RGBA
+	Markup      bool // whether [b] and [color] are parsed
+	Escaped     bool // whether text is escaped as CQ code, it is unescaped after markup is parsed
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Scale:       2,
+		Padding:     8,
+		MaxWidth:    360,
+		LineSpacing: 3,
+		Color:       color.RGBA{A: 0xff},
+		Background:  color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		Markup:      true,
+	}
+}
+
+const (
+	maxScale      = 8
+	maxMaxWidth   = 2048
+	maxImageSide  = 8192        // screen pixels
+	maxPixels     = 4096 * 4096 // of the scaled image, 64 MiB in RGBA
+	maxTextLength = 20000
+)
+
+var ErrTooLarge = errors.New("text is too long to be rendered")
+
+var face = bitmapfont.FaceSC
+
+// ParseOptions reads options from a map, missing fields are default
+func ParseOptions(m map[string]interface{}) (Options, error) {
+	opts := DefaultOptions()
+	for key, value := range m {
+		switch key {
+		case "scale", "padding", "width", "line_spacing":
+			i, err := helper.AnyToInt(value)
+			if err != nil || i < 0 {
+				return opts, fmt.Errorf("%s should be a non-negative integer", key)
+			}
+			switch key {
+			case "scale":
+				if i < 1 || i > maxScale {
+					return opts, fmt.Errorf("scale should be between 1 and %d", maxScale)
+				}
+				opts.Scale = i
+			case "padding":
+				opts.Padding = i
+			case "width":
+				if i < 12 || i > maxMaxWidth {
+					return opts, fmt.Errorf("width should be between 12 and %d", maxMaxWidth)
+				}
+				opts.MaxWidth = i
+			case "line_spacing":
+				opts.LineSpacing = i
+			}
+		case "color", "background":
+			c, ok := ParseColor(fmt.Sprint(value))
+			if !ok {
+				return opts, fmt.Errorf("%s should be a color name or #rrggbb", key)
+			}
+			if key == "color" {
+				opts.Color = c
+			} else {
+				opts.Background = c
+			}
+		case "markup":
+			b, ok := value.(bool)
+			if !ok {
+				return opts, fmt.Errorf("markup should be a boolean")
+			}
+			opts.Markup = b
+		default:
+			return opts, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return opts, nil
+}
+
+var colorNames = map[string]color.RGBA{
+	"black":  {0x00, 0x00, 0x00, 0xff},
+	"white":  {0xff, 0xff, 0xff, 0xff},
+	"gray":   {0x80, 0x80, 0x80, 0xff},
+	"red":    {0xe0, 0x20, 0x20, 0xff},
+	"green":  {0x20, 0xa0, 0x20, 0xff},
+	"blue":   {0x20, 0x40, 0xe0, 0xff},
+	"yellow": {0xe0, 0xc0, 0x00, 0xff},
+	"orange": {0xff, 0x80, 0x00, 0xff},
+	"purple": {0x90, 0x30, 0xc0, 0xff},
+	"pink":   {0xff, 0x60, 0xa0, 0xff},
+	"cyan":   {0x00, 0xa0, 0xc0, 0xff},
+}
+
+// ParseColor accepts color names, #rgb, #rrggbb and #rrggbbaa
+func ParseColor(s string) (color.RGBA, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := colorNames[s]; ok {
+		return c, true
+	}
+	if !strings.HasPrefix(s, "#") {
+		return color.RGBA{}, false
+	}
+	s = s[1:]
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	if len(s) != 8 {
+		return color.RGBA{}, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, true
+}
+
+// CacheKey identifies the image rendered from the text and options
+func (o Options) CacheKey(text string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v\n%s", o, text)))
+	return hex.EncodeToString(sum[:])
+}
+
+// run is a piece of text with the same style
+type run struct {
+	text  string
+	bold  bool
+	color color.RGBA
+}
+
+// parseMarkup splits text into runs by [b]...[/b] and [color=red]...[/color], unknown tags are kept as text
+func parseMarkup(text string, defaultColor color.RGBA) []run {
+	runs := make([]run, 0)
+	bold := 0
+	colors := []color.RGBA{defaultColor}
+	var current strings.Builder
+	flush := func() {
+		if current.Len() != 0 {
+			runs = append(runs, run{text: current.String(), bold: bold > 0, color: colors[len(colors)-1]})
+			current.Reset()
+		}
+	}
+	for len(text) != 0 {
+		start := strings.IndexByte(text, '[')
+		if start == -1 {
+			current.WriteString(text)
+			break
+		}
+		current.WriteString(text[:start])
+		text = text[start:]
+		end := strings.IndexByte(text, ']')
+		if end == -1 {
+			current.WriteString(text)
+			break
+		}
+		tag := strings.ToLower(text[1:end])
+		switch {
+		case tag == "b":
+			flush()
+			bold++
+		case tag == "/b" && bold > 0:
+			flush()
+			bold--
+		case strings.HasPrefix(tag, "color="):
+			c, ok := ParseColor(tag[len("color="):])
+			if !ok {
+				current.WriteString(text[:end+1])
+				break
+			}
+			flush()
+			colors = append(colors, c)
+		case tag == "/color" && len(colors) > 1:
+			flush()
+			colors = colors[:len(colors)-1]
+		default:
+			// not a tag, write the bracket only so that the rest is parsed again
+			current.WriteByte('[')
+			text = text[1:]
+			continue
+		}
+		text = text[end+1:]
+	}
+	flush()
+	return runs
+}
+
+// glyph is a character placed in a line
+type glyph struct {
+	r     rune
+	x     int
+	bold  bool
+	color color.RGBA
+}
+
+// layout places characters into lines, wrapping lines longer than maxWidth
+func layout(runs []run, maxWidth int) (lines [][]glyph, width int) {
+	line := make([]glyph, 0)
+	x := 0
+	newLine := func() {
+		lines = append(lines, line)
+		if x > width {
+			width = x
+		}
+		line = make([]glyph, 0)
+		x = 0
+	}
+	for _, r := range runs {
+		for _, c := range r.text {
+			switch c {
+			case '\r':
+				continue
+			case '\n':
+				newLine()
+				continue
+			case '\t':
+				c = ' '
+			}
+			advance, ok := face.GlyphAdvance(c)
+			if !ok {
+				c = '?'
+				advance, _ = face.GlyphAdvance(c)
+			}
+			w := advance.Round()
+			if r.bold {
+				w++
+			}
+			if x+w > maxWidth && len(line) != 0 {
+				newLine()
+			}
+			line = append(line, glyph{r: c, x: x, bold: r.bold, color: r.color})
+			x += w
+		}
+	}
+	newLine()
+	return lines, width
+}
+
+// Render draws the text into a png image
+func Render(text string, opts Options) ([]byte, error) {
+	text = strings.TrimRight(text, " \t\r\n")
+	// reject obviously long texts before layout
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return nil, ErrTooLarge
+	}
+	var runs []run
+	if opts.Markup {
+		runs = parseMarkup(text, opts.Color)
+	} else {
+		runs = []run{{text: text, color: opts.Color}}
+	}
+	if opts.Escaped {
+		for i := range runs {
+			runs[i].text = zeroMessage.UnescapeCQCodeText(runs[i].text)
+		}
+	}
+	lines, width := layout(runs, opts.MaxWidth)
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil() + opts.LineSpacing
+	imageWidth := width + 2*opts.Padding
+	imageHeight := len(lines)*lineHeight - opts.LineSpacing + 2*opts.Padding
+	if imageWidth*opts.Scale > maxImageSide || imageHeight*opts.Scale > maxImageSide ||
+		int64(imageWidth*opts.Scale)*int64(imageHeight*opts.Scale) > maxPixels {
+		return nil, ErrTooLarge
+	}
+	img := image.NewRGBA(image.Rect(0, 0, imageWidth, imageHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(opts.Background), image.Point{}, draw.Src)
+	drawer := &font.Drawer{Dst: img, Face: face}
+	for i, line := range lines {
+		baseline := opts.Padding + i*lineHeight + metrics.Ascent.Ceil()
+		for _, g := range line {
+			drawer.Src = image.NewUniform(g.color)
+			s := string(g.r)
+			drawer.Dot = fixed.P(opts.Padding+g.x, baseline)
+			drawer.DrawString(s)
+			if g.bold {
+				drawer.Dot = fixed.P(opts.Padding+g.x+1, baseline)
+				drawer.DrawString(s)
+			}
+		}
+	}
+	var out image.Image = img
+	if opts.Scale > 1 {
+		scaled := image.NewRGBA(image.Rect(0, 0, imageWidth*opts.Scale, imageHeight*opts.Scale))
+		xdraw.NearestNeighbor.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+		out = scaled
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, out); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
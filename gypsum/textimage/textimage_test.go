@@ -0,0 +1,40 @@
+package textimage
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	data, err := Render("[b]今日运势[/b]：[color=red]大吉[/color]\nline 2", DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X <= 0 || size.Y <= 0 || size.X%2 != 0 || size.Y%2 != 0 {
+		t.Fatalf("unexpected size %v with scale 2", size)
+	}
+}
+
+func TestRenderTooLarge(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxWidth = maxMaxWidth
+	// every side is below maxImageSide, but the whole image has too many pixels
+	line := strings.Repeat("汉", maxMaxWidth/12)
+	text := strings.Repeat(line+"\n", 115)
+	if _, err := Render(text, opts); err != ErrTooLarge {
+		t.Fatalf("too many pixels: got %v", err)
+	}
+	opts.Scale = 1
+	if _, err := Render(text, opts); err != nil {
+		t.Fatalf("same text without scaling: got %v", err)
+	}
+	if _, err := Render(strings.Repeat("a", maxTextLength+1), DefaultOptions()); err != ErrTooLarge {
+		t.Fatalf("too long text: got %v", err)
+	}
+}
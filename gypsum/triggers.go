@@ -20,15 +20,18 @@ import (
 type TriggerCategory int
 
 type Trigger struct {
-	DisplayName string   `json:"display_name"`
-	Active      bool     `json:"active"`
-	GroupsID    []int64  `json:"groups_id"`
-	UsersID     []int64  `json:"users_id"`
-	TriggerType []string `json:"trigger_type"`
-	Response    string   `json:"response"`
-	Priority    int      `json:"priority"`
-	Block       bool     `json:"block"`
-	ParentGroup uint64   `json:"-"`
+	DisplayName string          `json:"display_name"`
+	Active      bool            `json:"active"`
+	GroupsID    []int64         `json:"groups_id"`
+	UsersID     []int64         `json:"users_id"`
+	GroupsParam string          `json:"groups_param,omitempty"` // name of parameter holding extra groups id
+	UsersParam  string          `json:"users_param,omitempty"`  // name of parameter holding extra user id
+	TriggerType []string        `json:"trigger_type"`
+	Response    string          `json:"response"`
+	Priority    int             `json:"priority"`
+	Block       bool            `json:"block"`
+	Outbound    *OutboundPolicy `json:"outbound,omitempty"` // overrides policy in config
+	ParentGroup uint64          `json:"-"`
 }
 
 var (
@@ -85,31 +88,54 @@ func (t *Trigger) Register(id uint64) error {
 	if !t.Active {
 		return nil
 	}
-	tmpl, err := pongo2.FromString(t.Response)
+	tmpl, err := templateSet.FromString(t.Response)
 	if err != nil {
 		log.Errorf("模板预处理出错：%s", err)
 		return err
 	}
-	zeroTrigger[id] = zero.OnNotice(noticeRule(t.TriggerType), groupsRule(t.GroupsID), usersRule(t.UsersID)).SetPriority(t.Priority).SetBlock(t.Block).Handle(templateTriggerHandler(*tmpl, zero.Send, log.Error))
+	parentID := func() uint64 { return t.ParentGroup }
+	policy := outboundPolicy(t.Outbound)
+	zeroTrigger[id] = zero.OnNotice(unclaimedRule, groupActiveRule(parentID), noticeRule(t.TriggerType), paramIDsRule(t.GroupsID, parentID, t.GroupsParam, groupsRule), paramIDsRule(t.UsersID, parentID, t.UsersParam, usersRule)).SetPriority(t.Priority).SetBlock(t.Block && !mayPass(tmpl)).Handle(blockable(t.Block, templateTriggerHandler(*tmpl, TriggerItem, id, parentID, &policy, zero.Send, log.Error)))
 	return nil
 }
 
-func templateTriggerHandler(tmpl pongo2.Template, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
+// policy is nil if reply should be sent as it is
+func templateTriggerHandler(tmpl pongo2.Template, itemType ItemType, itemID uint64, parentID func() uint64, policy *OutboundPolicy, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
 	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
+		execCtx, finish, ok := startExecution(itemType, itemID)
+		if !ok {
+			return zero.FinishResponse
+		}
+		defer finish()
 		var luaState *lua.LState
 		defer func() {
 			if luaState != nil {
 				luaState.Close()
 			}
 		}()
-		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, luaState))
+		ctx := buildExecutionContext(execCtx, matcher, event, state, luaState, parentID)
+		reply, err := tmpl.Execute(ctx)
 		if err != nil {
 			errLogger("渲染模板出错：" + err.Error())
 			return zero.FinishResponse
 		}
+		if execCtx.Err() != nil {
+			errLogger("执行超时或被取消，不会发送回复")
+			return zero.FinishResponse
+		}
+		if passed(ctx) {
+			return PassResponse
+		}
 		reply = strings.TrimSpace(reply)
-		if reply != "" {
+		if reply == "" {
+			return zero.FinishResponse
+		}
+		if policy == nil {
 			send(event, reply)
+		} else if err := policy.deliver(execCtx, reply, event.GroupID, func(msg string) {
+			send(event, msg)
+		}); err != nil {
+			errLogger("发送回复时执行超时或被取消，其余消息不会发送")
 		}
 		return zero.FinishResponse
 	}
@@ -291,6 +317,7 @@ func createTrigger(c *gin.Context) {
 		"code":       0,
 		"message":    "ok",
 		"trigger_id": cursor,
+		"warnings":   lintWarnings(trigger.Response, false),
 	})
 	return
 }
@@ -411,9 +438,13 @@ func modifyTrigger(c *gin.Context) {
 			log.Errorf("error when change trigger %d from parent group %d: %s", triggerID, newTrigger.ParentGroup, err)
 		}
 	}
+	if err = markCustomized(newTrigger.ParentGroup, triggerID); err != nil {
+		log.Errorf("error when mark trigger %d customized in parent group %d: %s", triggerID, newTrigger.ParentGroup, err)
+	}
 	c.JSON(200, gin.H{
-		"code":    0,
-		"message": "ok",
+		"code":     0,
+		"message":  "ok",
+		"warnings": lintWarnings(newTrigger.Response, false),
 	})
 	return
 }
@@ -0,0 +1,331 @@
+package gypsum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ItemChange string
+
+const (
+	ItemAdded    ItemChange = "added"
+	ItemRemoved  ItemChange = "removed"
+	ItemChanged  ItemChange = "changed"
+	ItemKept     ItemChange = "kept"     // changed or removed by new version, but kept because user customized it
+	ItemConflict ItemChange = "conflict" // name of snippet is used by another snippet, so the plugin cannot be imported
+)
+
+type ItemDiff struct {
+	Path     string     `json:"path"`
+	ItemType ItemType   `json:"item_type"`
+	Change   ItemChange `json:"change"`
+}
+
+// isPluginInstallation tells whether a plugin is installed in the group.
+// sub groups of a plugin carry the name of the plugin as well, only the outermost one of them is the installation
+func isPluginInstallation(groupID uint64) bool {
+	g, ok := groups[groupID]
+	if !ok || groupID == 0 || g.PluginName == "" {
+		return false
+	}
+	parent, ok := groups[g.ParentGroup]
+	return g.ParentGroup == 0 || !ok || parent.PluginName != g.PluginName
+}
+
+// pluginInstallations lists the groups where the plugin is installed, in order of group id
+func pluginInstallations(pluginName string) []uint64 {
+	ids := make([]uint64, 0)
+	if pluginName == "" {
+		return ids
+	}
+	for id, g := range groups {
+		if g.PluginName == pluginName && isPluginInstallation(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// findPluginGroup finds the installed group of plugin, the earliest installed one is returned
+func findPluginGroup(pluginName string) (uint64, bool) {
+	ids := pluginInstallations(pluginName)
+	if len(ids) == 0 {
+		return 0, false
+	}
+	return ids[0], true
+}
+
+// sameRecord tells whether two records have same content, regardless of their ids and parents
+func sameRecord(a, b UserRecord) bool {
+	if ra, ok := a.(*Resource); ok {
+		rb, ok := b.(*Resource)
+		return ok && ra.Sha256Sum == rb.Sha256Sum && ra.Ext == rb.Ext && ra.FileName == rb.FileName
+	}
+	return reflect.DeepEqual(normalizedRecord(a), normalizedRecord(b))
+}
+
+// recordSum digests content of the record like sameRecord compares it,
+// it is kept in the group as the content installed by plugin
+func recordSum(record UserRecord) string {
+	var b []byte
+	if r, ok := record.(*Resource); ok {
+		b = []byte(r.Sha256Sum + r.Ext + "/" + r.FileName)
+	} else {
+		// keys of map are sorted by json
+		b, _ = json.Marshal(normalizedRecord(record))
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizedRecord converts record to a generic map, empty lists are treated as null
+func normalizedRecord(record UserRecord) map[string]interface{} {
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Error(err)
+		return nil
+	}
+	for k, v := range m {
+		if list, ok := v.([]interface{}); ok && len(list) == 0 {
+			m[k] = nil
+		}
+	}
+	return m
+}
+
+// diffInstall lists all items of manifest as added
+func (mg *ManifestGroup) diffInstall(prefix string, diffs *[]ItemDiff) {
+	for _, item := range mg.Items {
+		path := prefix + "/" + item.DisplayName
+		*diffs = append(*diffs, ItemDiff{
+			Path:     path,
+			ItemType: item.ItemType,
+			Change:   ItemAdded,
+		})
+		if item.ItemType == GroupItem && item.Group != nil {
+			item.Group.diffInstall(path, diffs)
+		}
+	}
+}
+
+// upgradeJournal records changes made by an upgrade, so that they can be undone if the upgrade fails halfway
+type upgradeJournal struct {
+	undo []func() error
+	// removals are done after everything else succeeds, since removed groups cannot be restored easily
+	removals []Item
+}
+
+// rollback undoes changes in reverse order, errors are logged since nothing more can be done
+func (j *upgradeJournal) rollback() {
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		if err := j.undo[i](); err != nil {
+			log.Errorf("error when rolling back upgrade: %s", err)
+		}
+	}
+}
+
+// applyUpgrade upgrades installed group to manifest, changes are undone if an error happens halfway.
+// checkTemplates should be called first, since templates that cannot be compiled are installed without error
+func (mg *ManifestGroup) applyUpgrade(groupID uint64, diffs *[]ItemDiff) error {
+	j := &upgradeJournal{}
+	if err := mg.upgradeGroup(groupID, "", j, diffs); err != nil {
+		j.rollback()
+		return err
+	}
+	for _, item := range j.removals {
+		// items are already out of their groups, a failure only leaves an unused record
+		if err := removeUserRecord(item.ItemType, item.ItemID); err != nil {
+			log.Errorf("error when removing %s %d: %s", item.ItemType, item.ItemID, err)
+		}
+	}
+	return nil
+}
+
+// upgradeGroup upgrades items in installed group to those in manifest, items are matched by type and display name.
+// customized items are left untouched. if j is nil, only diffs are reported and nothing is changed,
+// otherwise changes are recorded in j, and removed items are left for the caller to remove.
+func (mg *ManifestGroup) upgradeGroup(groupID uint64, prefix string, j *upgradeJournal, diffs *[]ItemDiff) error {
+	g, ok := groups[groupID]
+	if !ok {
+		return nil
+	}
+	apply := j != nil
+	oldItems := g.Items
+	matched := make([]bool, len(oldItems))
+	newItems := make([]Item, 0, len(mg.Items))
+	for _, item := range mg.Items {
+		path := prefix + "/" + item.DisplayName
+		oldIndex := -1
+		for i, oldItem := range oldItems {
+			if !matched[i] && oldItem.ItemType == item.ItemType && oldItem.DisplayName == item.DisplayName {
+				oldIndex = i
+				break
+			}
+		}
+		if oldIndex == -1 {
+			// added
+			*diffs = append(*diffs, ItemDiff{
+				Path:     path,
+				ItemType: item.ItemType,
+				Change:   ItemAdded,
+			})
+			if item.ItemType == GroupItem {
+				item.Group.diffInstall(path, diffs)
+			}
+			if !apply {
+				continue
+			}
+			var idx uint64
+			var sum string
+			var err error
+			if item.ItemType == GroupItem {
+				idx, err = item.Group.restoreAsChild(groupID)
+			} else {
+				record, ok := item.record()
+				if !ok {
+					log.Warnf("unknown type: %s", item.ItemType)
+					continue
+				}
+				sum = recordSum(record)
+				idx, err = restoreUserRecord(record, groupID)
+			}
+			if err != nil {
+				return err
+			}
+			added := Item{ItemType: item.ItemType, ItemID: idx}
+			j.undo = append(j.undo, func() error {
+				return removeUserRecord(added.ItemType, added.ItemID)
+			})
+			newItems = append(newItems, Item{
+				ItemType:     item.ItemType,
+				DisplayName:  item.DisplayName,
+				ItemID:       idx,
+				InstalledSum: sum,
+			})
+			continue
+		}
+		matched[oldIndex] = true
+		oldItem := oldItems[oldIndex]
+		newItems = append(newItems, oldItem)
+		if item.ItemType == GroupItem {
+			if err := item.Group.upgradeGroup(oldItem.ItemID, path, j, diffs); err != nil {
+				return err
+			}
+			continue
+		}
+		newRecord, ok := item.record()
+		if !ok {
+			continue
+		}
+		newSum := recordSum(newRecord)
+		oldRecord, oldFound := findItem(oldItem.ItemType, oldItem.ItemID)
+		if oldFound && sameRecord(oldRecord, newRecord) {
+			newItems[len(newItems)-1].InstalledSum = newSum
+			continue
+		}
+		if oldItem.InstalledSum == newSum {
+			// the plugin has not changed the item since it was installed, so the difference is made locally
+			continue
+		}
+		if oldItem.Customized {
+			*diffs = append(*diffs, ItemDiff{
+				Path:     path,
+				ItemType: item.ItemType,
+				Change:   ItemKept,
+			})
+			continue
+		}
+		*diffs = append(*diffs, ItemDiff{
+			Path:     path,
+			ItemType: item.ItemType,
+			Change:   ItemChanged,
+		})
+		if !apply {
+			continue
+		}
+		// replace in place, so that the item keeps its id
+		replaced := oldItem
+		unregisterUserRecord(replaced.ItemType, replaced.ItemID)
+		j.undo = append(j.undo, func() error {
+			unregisterUserRecord(replaced.ItemType, replaced.ItemID)
+			if !oldFound {
+				return nil
+			}
+			return putUserRecord(replaced.ItemID, oldRecord, groupID)
+		})
+		if err := putUserRecord(oldItem.ItemID, newRecord, groupID); err != nil {
+			return err
+		}
+		newItems[len(newItems)-1].InstalledSum = newSum
+	}
+	for i, oldItem := range oldItems {
+		if matched[i] {
+			continue
+		}
+		path := prefix + "/" + oldItem.DisplayName
+		if oldItem.Customized {
+			*diffs = append(*diffs, ItemDiff{
+				Path:     path,
+				ItemType: oldItem.ItemType,
+				Change:   ItemKept,
+			})
+			newItems = append(newItems, oldItem)
+			continue
+		}
+		*diffs = append(*diffs, ItemDiff{
+			Path:     path,
+			ItemType: oldItem.ItemType,
+			Change:   ItemRemoved,
+		})
+		if !apply {
+			continue
+		}
+		j.removals = append(j.removals, oldItem)
+	}
+	if !apply {
+		return nil
+	}
+	oldGroup := *g
+	j.undo = append(j.undo, func() error {
+		*g = oldGroup
+		return g.SaveToDB(groupID)
+	})
+	g.Items = newItems
+	g.ParameterValues = upgradedParameterValues(g, mg)
+	g.Parameters = mg.Parameters
+	if groupID != 0 && mg.PluginName != "" {
+		g.PluginName = mg.PluginName
+		g.PluginVersion = mg.PluginVersion
+	}
+	return g.SaveToDB(groupID)
+}
+
+// upgradedParameterValues keeps values of parameters whose name and type are not changed, new values given by user take precedence
+func upgradedParameterValues(g *Group, mg *ManifestGroup) map[string]string {
+	values := make(map[string]string)
+	for _, p := range mg.Parameters {
+		if value, ok := mg.parameterValues[p.Name]; ok {
+			values[p.Name] = value
+			continue
+		}
+		for _, old := range g.Parameters {
+			if old.Name == p.Name && old.Type == p.Type {
+				if value, ok := g.ParameterValues[p.Name]; ok {
+					values[p.Name] = value
+				}
+			}
+		}
+	}
+	return values
+}
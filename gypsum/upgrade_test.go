@@ -0,0 +1,120 @@
+package gypsum
+
+import (
+	"testing"
+)
+
+func testGreetingManifest(response string) *ManifestGroup {
+	return &ManifestGroup{
+		DisplayName:   "greeting",
+		PluginName:    "greeting",
+		PluginVersion: 1,
+		Items: []ManifestItem{
+			{ItemType: RuleItem, DisplayName: "hello", Rule: &Rule{
+				DisplayName: "hello",
+				Active:      true,
+				MatcherType: Keyword,
+				Patterns:    []string{"hello"},
+				Response:    response,
+			}},
+			{ItemType: TriggerItem, DisplayName: "welcome", Trigger: &Trigger{
+				DisplayName: "welcome",
+				Active:      true,
+				TriggerType: []string{"group_increase"},
+				Response:    "welcome",
+			}},
+		},
+	}
+}
+
+func installTestManifest(t *testing.T, mg *ManifestGroup) uint64 {
+	groupID, err := mg.restoreAsChild(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups[0].Items = append(groups[0].Items, Item{ItemType: GroupItem, DisplayName: mg.DisplayName, ItemID: groupID})
+	return groupID
+}
+
+func upgradeTestPlugin(t *testing.T, groupID uint64, mg *ManifestGroup) []ItemDiff {
+	diffs := make([]ItemDiff, 0)
+	if err := mg.applyUpgrade(groupID, &diffs); err != nil {
+		t.Fatal(err)
+	}
+	return diffs
+}
+
+func TestUpgradeKeepsLocalChanges(t *testing.T) {
+	useTestDB(t)
+	groupID := installTestManifest(t, testGreetingManifest("hi"))
+	ruleID := groups[groupID].Items[0].ItemID
+
+	// changed locally without marking it customized
+	rules[ruleID].Active = false
+	rules[ruleID].Patterns = []string{"hello", "hey"}
+	if diffs := upgradeTestPlugin(t, groupID, testGreetingManifest("hi")); len(diffs) != 0 {
+		t.Fatalf("item not changed by plugin is reported: %+v", diffs)
+	}
+	if rules[ruleID].Active || len(rules[ruleID].Patterns) != 2 {
+		t.Fatalf("local changes are overwritten: %+v", rules[ruleID])
+	}
+
+	// changed by plugin
+	diffs := upgradeTestPlugin(t, groupID, testGreetingManifest("hello there"))
+	if len(diffs) != 1 || diffs[0].Path != "/hello" || diffs[0].Change != ItemChanged {
+		t.Fatalf("unexpected diffs: %+v", diffs)
+	}
+	if rule := rules[ruleID]; rule.Response != "hello there" || !rule.Active {
+		t.Fatalf("rule is not upgraded: %+v", rule)
+	}
+	if diffs := upgradeTestPlugin(t, groupID, testGreetingManifest("hello there")); len(diffs) != 0 {
+		t.Fatalf("upgraded item is reported again: %+v", diffs)
+	}
+}
+
+func TestUpgradeKeepsCustomizedItems(t *testing.T) {
+	useTestDB(t)
+	groupID := installTestManifest(t, testGreetingManifest("hi"))
+	ruleID := groups[groupID].Items[0].ItemID
+	rules[ruleID].Response = "my own reply"
+	if err := markCustomized(groupID, ruleID); err != nil {
+		t.Fatal(err)
+	}
+	if !groups[groupID].Items[0].Customized {
+		t.Fatal("item of plugin is not marked customized")
+	}
+	diffs := upgradeTestPlugin(t, groupID, testGreetingManifest("hello there"))
+	if len(diffs) != 1 || diffs[0].Change != ItemKept {
+		t.Fatalf("unexpected diffs: %+v", diffs)
+	}
+	if rules[ruleID].Response != "my own reply" {
+		t.Fatalf("customized item is overwritten: %+v", rules[ruleID])
+	}
+
+	// items outside of plugins are not marked
+	ownID := addTestGroup(t, 0, "own")
+	triggerID := addTestItem(t, ownID, TriggerItem, "mine", &Trigger{Response: "mine"})
+	if err := markCustomized(ownID, triggerID); err != nil {
+		t.Fatal(err)
+	}
+	if groups[ownID].Items[0].Customized {
+		t.Fatal("item outside of plugins is marked customized")
+	}
+}
+
+func TestUpgradeWithoutInstalledSum(t *testing.T) {
+	useTestDB(t)
+	groupID := installTestManifest(t, testGreetingManifest("hi"))
+	// installed by old version, which did not record installed content
+	for i := range groups[groupID].Items {
+		groups[groupID].Items[i].InstalledSum = ""
+	}
+	if diffs := upgradeTestPlugin(t, groupID, testGreetingManifest("hi")); len(diffs) != 0 {
+		t.Fatalf("same content is reported: %+v", diffs)
+	}
+	for _, item := range groups[groupID].Items {
+		if item.InstalledSum == "" {
+			t.Fatalf("installed content of %q is not recorded", item.DisplayName)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"encoding/json"
+
+	"github.com/flosch/pongo2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+const pluginDataFileName = "gypsum-data.json"
+
+// namespaceOwner finds the installation of plugin that the group belongs to,
+// items of the plugin share one database namespace, items outside of plugins use the shared namespace.
+func namespaceOwner(groupID uint64) (uint64, bool) {
+	var owner uint64
+	var ownerName string
+	found := false
+	for depth := 0; depth < 64; depth++ {
+		g, exists := groups[groupID]
+		if !exists || groupID == 0 {
+			break
+		}
+		if found && g.PluginName != ownerName {
+			// sub groups of a plugin are exported with the name of the plugin,
+			// namespace belongs to the outermost one of them
+			break
+		}
+		if g.PluginName != "" {
+			owner, ownerName, found = groupID, g.PluginName, true
+		}
+		groupID = g.ParentGroup
+	}
+	return owner, found
+}
+
+func pluginDataPrefix(owner uint64) []byte {
+	return append(append([]byte("gypsum-pluginDB-"), helper.U64ToBytes(owner)...), '-')
+}
+
+// setNamespace puts plugin parameters, database and sandbox of the namespace into context,
+// scoped variables of the namespace are bound in bindExecution
+func setNamespace(ctx pongo2.Context, groupID uint64) pongo2.Context {
+	ctx["param"] = groupParameters(groupID)
+	owner, ok := namespaceOwner(groupID)
+	if !ok {
+		return ctx
+	}
+	if box, ok := pluginSandboxes[groups[owner].PluginName]; ok {
+		// functions are bound to the sandbox in bindExecution
+		ctx["_sandbox"] = box
+	}
+	namespace := pluginDataPrefix(owner)
+	database := template.NewDatabase(append(append([]byte{}, namespace...), "p-"...))
+	ctx["_db"] = namespace
+	ctx["_vars"] = varsPrefix(owner, true)
+	ctx["db_get"] = database.Get
+	ctx["db_put"] = database.Put
+	ctx["db_delete"] = database.Delete
+	ctx["db_incr"] = database.Incr
+	ctx["db_keys"] = database.Keys
+	return ctx
+}
+
+type pluginDataEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// writePluginData saves the database namespace of the group into plugin file,
+// nothing is written if the group does not own a namespace
+func writePluginData(zipWriter archiveWriter, groupID uint64) error {
+	if owner, ok := namespaceOwner(groupID); !ok || owner != groupID {
+		return nil
+	}
+	prefix := pluginDataPrefix(groupID)
+	entries := make([]pluginDataEntry, 0)
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		entries = append(entries, pluginDataEntry{
+			Key:   append([]byte{}, iter.Key()[len(prefix):]...),
+			Value: append([]byte{}, iter.Value()...),
+		})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	f, err := zipWriter.Create(pluginDataFileName)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(entries)
+}
+
+// restorePluginData loads data in plugin file into the namespace of newly installed group
+func restorePluginData(files map[string]*zip.File, groupID uint64) error {
+	f, ok := files[pluginDataFileName]
+	if !ok {
+		return nil
+	}
+	if owner, ok := namespaceOwner(groupID); !ok || owner != groupID {
+		return nil
+	}
+	fr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	var entries []pluginDataEntry
+	if err := json.NewDecoder(fr).Decode(&entries); err != nil {
+		return err
+	}
+	prefix := pluginDataPrefix(groupID)
+	batch := new(leveldb.Batch)
+	for _, entry := range entries {
+		batch.Put(append(append([]byte{}, prefix...), entry.Key...), entry.Value)
+	}
+	return db.Write(batch, nil)
+}
+
+// deletePluginData removes the database namespace owned by the group
+func deletePluginData(groupID uint64) error {
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(util.BytesPrefix(pluginDataPrefix(groupID)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
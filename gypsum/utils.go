@@ -8,10 +8,16 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"sync"
 )
 
-var hotSalt []byte  // refresh at every start
-var coldSalt []byte //
+var hotSalt []byte   // refresh at every start
+var loginSalt []byte // persist in database, login cookie is derived from it
+
+var (
+	coldSalt     []byte // persist in database, refresh on request
+	coldSaltLock sync.RWMutex
+)
 
 func init() {
 	seed := make([]byte, 8)
@@ -22,6 +28,29 @@ func init() {
 	rand.Read(hotSalt)
 }
 
+// getColdSalt returns coldSalt, it is safe to be called while coldSalt is rotated
+func getColdSalt() []byte {
+	coldSaltLock.RLock()
+	defer coldSaltLock.RUnlock()
+	return coldSalt
+}
+
+// rotateColdSalt replaces coldSalt, every permanent signature made before will be invalid
+func rotateColdSalt() error {
+	newSalt := make([]byte, 16)
+	if _, err := cryptoRand.Read(newSalt); err != nil {
+		return err
+	}
+	coldSaltLock.Lock()
+	defer coldSaltLock.Unlock()
+	// persist first, so that links are never signed with a salt that is lost at restart
+	if err := db.Put([]byte("gypsum-$meta-coldsalt"), newSalt, nil); err != nil {
+		return err
+	}
+	coldSalt = newSalt
+	return nil
+}
+
 func ExtractWebAssets(extractPath string) error {
 	s, err := os.Stat(extractPath)
 	if err != nil {
@@ -0,0 +1,345 @@
+package gypsum
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/flosch/pongo2"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// sharedVarsPrefix is the namespace of scoped variables outside of plugins,
+// variables of plugins are stored in the plugin database namespace with "v-"
+const sharedVarsPrefix = "gypsum-userDB-v-"
+
+func varsPrefix(owner uint64, isPlugin bool) []byte {
+	if !isPlugin {
+		return []byte(sharedVarsPrefix)
+	}
+	return append(pluginDataPrefix(owner), "v-"...)
+}
+
+// setScopedVars puts variables of the user, group and member of event into context,
+// scopes that the event does not have are not set
+func setScopedVars(ctx pongo2.Context) pongo2.Context {
+	prefix, ok := ctx["_vars"].([]byte)
+	if !ok {
+		prefix = []byte(sharedVarsPrefix)
+		ctx["_vars"] = prefix
+	}
+	database := template.NewDatabase(prefix)
+	var userID, groupID int64
+	if event, ok := ctx["_event"].(*zero.Event); ok && event != nil {
+		userID, groupID = event.UserID, event.GroupID
+	}
+	if userID != 0 {
+		ctx["user_vars"] = database.Sub(template.UserScope(userID)).Functions()
+	}
+	if groupID != 0 {
+		ctx["group_vars"] = database.Sub(template.GroupScope(groupID)).Functions()
+	}
+	if userID != 0 && groupID != 0 {
+		ctx["member_vars"] = database.Sub(template.MemberScope(groupID, userID)).Functions()
+	}
+	ctx["user_vars_of"] = func(user interface{}) interface{} {
+		id, err := helper.AnyToInt64(user)
+		if err != nil {
+			log.Warnf("user_vars_of: cannot accept %#v as qqid", user)
+			return nil
+		}
+		return database.Sub(template.UserScope(id)).Functions()
+	}
+	ctx["group_vars_of"] = func(group interface{}) interface{} {
+		id, err := helper.AnyToInt64(group)
+		if err != nil {
+			log.Warnf("group_vars_of: cannot accept %#v as group id", group)
+			return nil
+		}
+		return database.Sub(template.GroupScope(id)).Functions()
+	}
+	ctx["member_vars_of"] = func(user interface{}, group ...interface{}) interface{} {
+		uid, err := helper.AnyToInt64(user)
+		if err != nil {
+			log.Warnf("member_vars_of: cannot accept %#v as qqid", user)
+			return nil
+		}
+		gid := groupID
+		if len(group) != 0 {
+			if gid, err = helper.AnyToInt64(group[0]); err != nil {
+				log.Warnf("member_vars_of: cannot accept %#v as group id", group[0])
+				return nil
+			}
+		}
+		if gid == 0 {
+			log.Warnf("member_vars_of: no group id is given and the event is not in a group")
+			return nil
+		}
+		return database.Sub(template.MemberScope(gid, uid)).Functions()
+	}
+	return ctx
+}
+
+// ScopedVar is a variable shown in api
+type ScopedVar struct {
+	Namespace uint64      `json:"namespace"` // plugin group id, 0 for shared namespace
+	Scope     string      `json:"scope"`     // "user", "group" or "member"
+	UserID    int64       `json:"user_id,omitempty"`
+	GroupID   int64       `json:"group_id,omitempty"`
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"` // only used when modifying, seconds
+	Expire    int64       `json:"expire,omitempty"`
+}
+
+// varNamespaces lists all namespaces that may have variables, keyed by plugin group id (0 for shared)
+func varNamespaces() map[uint64][]byte {
+	namespaces := map[uint64][]byte{
+		0: []byte(sharedVarsPrefix),
+	}
+	for id := range groups {
+		if owner, ok := namespaceOwner(id); ok && owner == id {
+			namespaces[id] = varsPrefix(id, true)
+		}
+	}
+	return namespaces
+}
+
+// key returns the database key of the variable, ok is false if the variable is not valid
+func (v *ScopedVar) key() ([]byte, bool) {
+	if v.Name == "" {
+		return nil, false
+	}
+	var prefix []byte
+	if v.Namespace == 0 {
+		prefix = varsPrefix(0, false)
+	} else {
+		if owner, ok := namespaceOwner(v.Namespace); !ok || owner != v.Namespace {
+			return nil, false
+		}
+		prefix = varsPrefix(v.Namespace, true)
+	}
+	var scope []byte
+	switch v.Scope {
+	case "user":
+		if v.UserID == 0 {
+			return nil, false
+		}
+		scope = template.UserScope(v.UserID)
+	case "group":
+		if v.GroupID == 0 {
+			return nil, false
+		}
+		scope = template.GroupScope(v.GroupID)
+	case "member":
+		if v.UserID == 0 || v.GroupID == 0 {
+			return nil, false
+		}
+		scope = template.MemberScope(v.GroupID, v.UserID)
+	default:
+		return nil, false
+	}
+	return append(append(prefix, scope...), v.Name...), true
+}
+
+// scopeOrder sorts variables of user and group before member
+var scopeOrder = map[string]int{"user": 0, "group": 1, "member": 2}
+
+// listScopedVars lists variables of all namespaces in the scope, filter selects member variables
+func listScopedVars(scope []byte, memberFilter func(groupID, userID int64) bool) ([]ScopedVar, error) {
+	vars := make([]ScopedVar, 0)
+	for namespace, prefix := range varNamespaces() {
+		entries, err := template.ListEntries(append(append([]byte{}, prefix...), scope...))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			v := ScopedVar{
+				Namespace: namespace,
+				Value:     entry.Value,
+				Expire:    entry.Expire,
+			}
+			rest := entry.Key[len(prefix):]
+			switch rest[0] {
+			case template.UserScopeType:
+				if len(rest) < 9 {
+					continue
+				}
+				v.Scope = "user"
+				v.UserID = int64(helper.ToUint(rest[1:9]))
+				v.Name = string(rest[9:])
+			case template.GroupScopeType:
+				if len(rest) < 9 {
+					continue
+				}
+				v.Scope = "group"
+				v.GroupID = int64(helper.ToUint(rest[1:9]))
+				v.Name = string(rest[9:])
+			case template.MemberScopeType:
+				if len(rest) < 17 {
+					continue
+				}
+				v.Scope = "member"
+				v.GroupID = int64(helper.ToUint(rest[1:9]))
+				v.UserID = int64(helper.ToUint(rest[9:17]))
+				v.Name = string(rest[17:])
+				if memberFilter != nil && !memberFilter(v.GroupID, v.UserID) {
+					continue
+				}
+			default:
+				continue
+			}
+			vars = append(vars, v)
+		}
+	}
+	sort.SliceStable(vars, func(i, j int) bool {
+		if vars[i].Namespace != vars[j].Namespace {
+			return vars[i].Namespace < vars[j].Namespace
+		}
+		if vars[i].Scope != vars[j].Scope {
+			return scopeOrder[vars[i].Scope] < scopeOrder[vars[j].Scope]
+		}
+		if vars[i].GroupID != vars[j].GroupID {
+			return vars[i].GroupID < vars[j].GroupID
+		}
+		return vars[i].Name < vars[j].Name
+	})
+	return vars, nil
+}
+
+func getUserVars(c *gin.Context) {
+	userID, err := helper.AnyToInt64(c.Param("uid"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such user",
+		})
+		return
+	}
+	userVars, err := listScopedVars(template.UserScope(userID), nil)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	memberVars, err := listScopedVars([]byte{template.MemberScopeType}, func(_, uid int64) bool {
+		return uid == userID
+	})
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, append(userVars, memberVars...))
+}
+
+func getGroupVars(c *gin.Context) {
+	groupID, err := helper.AnyToInt64(c.Param("gid"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	groupVars, err := listScopedVars(template.GroupScope(groupID), nil)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	memberVars, err := listScopedVars(append([]byte{template.MemberScopeType}, helper.U64ToBytes(uint64(groupID))...), nil)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, append(groupVars, memberVars...))
+}
+
+// bindScopedVar reads the variable in request body, numbers are kept as integers when possible
+func bindScopedVar(c *gin.Context) (*ScopedVar, []byte, bool) {
+	var v ScopedVar
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return nil, nil, false
+	}
+	v.Value = template.NormalizeNumbers(v.Value)
+	key, ok := v.key()
+	if !ok {
+		c.JSON(422, gin.H{
+			"code":    2060,
+			"message": "invalid variable: namespace, scope, ids and name should be given",
+		})
+		return nil, nil, false
+	}
+	return &v, key, true
+}
+
+func modifyScopedVar(c *gin.Context) {
+	v, key, ok := bindScopedVar(c)
+	if !ok {
+		return
+	}
+	if v.Value == nil {
+		c.JSON(422, gin.H{
+			"code":    2061,
+			"message": "value is missing",
+		})
+		return
+	}
+	if err := template.PutValue(key, v.Value, v.TTL); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
+
+func deleteScopedVar(c *gin.Context) {
+	_, key, ok := bindScopedVar(c)
+	if !ok {
+		return
+	}
+	if _, found, _ := template.GetValue(key); !found {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such variable",
+		})
+		return
+	}
+	if err := template.DeleteValue(key); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
@@ -91,6 +91,6 @@ func getGypsumInformation(c *gin.Context) {
 }
 
 func initialLoginAuth() {
-	cookieBytes := sha256.Sum256(append([]byte(Config.Password), coldSalt...)) //每次运行相同
+	cookieBytes := sha256.Sum256(append([]byte(Config.Password), loginSalt...)) //每次运行相同
 	loginValidator.Cookie = hex.EncodeToString(cookieBytes[:])
 }